@@ -72,6 +72,10 @@
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysRawDisco is the name of the wgengine/magicsock raw disco
+	// receivers, unhealthy when one that should work has failed.
+	SysRawDisco = Subsystem("raw-disco")
 )
 
 type watchHandle byte
@@ -127,6 +131,12 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetRawDiscoHealth sets the state of the magicsock raw disco receivers.
+func SetRawDiscoHealth(err error) { set(SysRawDisco, err) }
+
+// RawDiscoHealth returns the magicsock raw disco receivers' error state.
+func RawDiscoHealth() error { return get(SysRawDisco) }
+
 func RegisterDebugHandler(typ string, h http.Handler) {
 	mu.Lock()
 	defer mu.Unlock()
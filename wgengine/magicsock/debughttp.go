@@ -70,6 +70,17 @@ type D struct {
 	}
 	fmt.Fprintf(w, "</ul>\n")
 
+	fmt.Fprintf(w, "<h2 id=rawdisco><a href=#rawdisco>#</a> raw disco</h2><ul>")
+	{
+		st := c.RawDiscoStatus()
+		printRawDiscoHTML(w, "IPv4", st.V4Active, st.V4Err, st.V4SelfTestRTT)
+		printRawDiscoHTML(w, "IPv6", st.V6Active, st.V6Err, st.V6SelfTestRTT)
+		if st.Paused {
+			fmt.Fprintf(w, "<li>paused: disco handled from the regular sockets</li>\n")
+		}
+	}
+	fmt.Fprintf(w, "</ul>\n")
+
 	fmt.Fprintf(w, "<h2 id=ipport><a href=#ipport>#</a> ip:port to endpoint</h2><ul>")
 	{
 		type kv struct {
@@ -124,6 +135,17 @@ type kv struct {
 	}
 }
 
+func printRawDiscoHTML(w io.Writer, family string, active bool, err error, selfTestRTT time.Duration) {
+	switch {
+	case active:
+		fmt.Fprintf(w, "<li>%s: active, self-test took %v</li>\n", family, selfTestRTT)
+	case err != nil:
+		fmt.Fprintf(w, "<li>%s: inactive: %s</li>\n", family, html.EscapeString(err.Error()))
+	default:
+		fmt.Fprintf(w, "<li>%s: inactive</li>\n", family)
+	}
+}
+
 func printEndpointHTML(w io.Writer, ep *endpoint) {
 	lastRecv := ep.lastRecv.LoadAtomic()
 
@@ -0,0 +1,530 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/bpf"
+	"tailscale.com/disco"
+	"tailscale.com/envknob"
+	"tailscale.com/types/key"
+)
+
+// The disco filters are classic BPF, which can't loop. They don't
+// need to: Linux runs raw socket filters only after walking IPv6
+// extension headers and reassembling fragments (see
+// TestRawDiscoIPv6ExtensionHeaders and TestRawDiscoIPv4Fragments), so
+// an eBPF program attached with SO_ATTACH_BPF would see the same bytes
+// and have nothing further to parse. BPF devices, where that parsing
+// would matter, only take classic BPF; see bpfDeviceFilter.
+
+const (
+	udpHeaderSize          = 8
+	ipv6FragmentHeaderSize = 8
+	ipv6FlowLabelMask      = 0xfffff // of the first 4 bytes of an IPv6 header
+
+	// STUN binding responses start with their message type, then
+	// after a 2 byte length, the magic cookie. See RFC 5389.
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+)
+
+// rawDiscoMagic is a disco magic number in the form the BPF filters
+// match on: its first 4 bytes and the 2 that follow, big-endian.
+type rawDiscoMagic struct {
+	hi uint32
+	lo uint16
+
+	version int // disco protocol version using this magic, from 1
+
+	// stun, if set, makes this match STUN binding responses instead,
+	// by their message type and magic cookie, ignoring hi and lo. See
+	// rawDiscoSTUNMatch.
+	stun bool
+
+	// offset, if non-zero, is how far into the UDP payload the magic
+	// is, for disco encapsulated in another protocol. See
+	// rawDiscoEncapOffset.
+	offset uint32
+}
+
+// rawDiscoMagics are the disco magic numbers accepted by the raw disco
+// path. When rolling out a disco protocol version with a new magic,
+// add it here alongside the old one for the migration window, so that
+// nodes using the raw path accept both.
+var rawDiscoMagics = []rawDiscoMagic{
+	{hi: discoMagic1, lo: discoMagic2, version: 1},
+}
+
+// rawDiscoSTUNMatch, added to the magics the BPF filters match with
+// TS_DEBUG_RAW_DISCO_STUN, makes them accept STUN binding responses
+// too. They're passed to the func set with SetRawDiscoSTUNFunc, not
+// handled as disco; the regular UDP socket handles them as ever.
+var rawDiscoSTUNMatch = rawDiscoMagic{stun: true}
+
+// debugRawDiscoSTUN makes the raw disco receivers also accept STUN
+// binding responses for our port, for observing NAT behavior at the
+// same vantage point as disco.
+var debugRawDiscoSTUN = envknob.RegisterBool("TS_DEBUG_RAW_DISCO_STUN")
+
+// debugRawDiscoEncapOffset, if set, is how many bytes into the UDP
+// payload the raw disco receivers also look for the disco magic, for
+// experiments carrying disco inside another transport's framing. See
+// rawDiscoEncapOffset.
+var debugRawDiscoEncapOffset = envknob.RegisterString("TS_DEBUG_RAW_DISCO_ENCAP_OFFSET")
+
+// maxRawDiscoEncapOffset bounds TS_DEBUG_RAW_DISCO_ENCAP_OFFSET, well
+// past any encapsulation header worth experimenting with.
+const maxRawDiscoEncapOffset = 256
+
+// rawDiscoEncapOffset returns the offset TS_DEBUG_RAW_DISCO_ENCAP_OFFSET
+// sets, reporting whether it's set to a valid one, from 1 to
+// maxRawDiscoEncapOffset. Packets with the disco magic there are passed
+// to the func set with SetRawDiscoEncapFunc instead of being handled as
+// disco.
+func rawDiscoEncapOffset() (off int, ok bool) {
+	off, err := strconv.Atoi(debugRawDiscoEncapOffset())
+	if err != nil || off < 1 || off > maxRawDiscoEncapOffset {
+		return 0, false
+	}
+	return off, true
+}
+
+// defaultRawDiscoMaxSize is the largest UDP payload the raw disco
+// filters accept by default. Disco messages are tiny but for
+// CallMeMaybe's endpoint list, which at 18 bytes an endpoint leaves
+// room here for over 200 of them.
+const defaultRawDiscoMaxSize = 4096
+
+// rawDiscoMaxSize returns the largest UDP payload the raw disco filters
+// accept, defaultRawDiscoMaxSize unless TS_DEBUG_RAW_DISCO_MAX_SIZE sets
+// it to something from the size of the self-test's packet to the most
+// UDP can carry. A packet with the disco magic but longer than any
+// disco message is at best garbage, so it's dropped in the kernel
+// rather than copied out only to be dropped here.
+func rawDiscoMaxSize() int {
+	if n, ok := envknob.LookupInt("TS_DEBUG_RAW_DISCO_MAX_SIZE"); ok && n >= len(testDiscoPacket) && n <= 1<<16-1-udpHeaderSize {
+		return n
+	}
+	return defaultRawDiscoMaxSize
+}
+
+// rawDiscoFilterMagics returns the magics for the raw disco receivers'
+// BPF filters to match: rawDiscoMagics, plus rawDiscoSTUNMatch with
+// TS_DEBUG_RAW_DISCO_STUN, and the current magic at an offset with
+// TS_DEBUG_RAW_DISCO_ENCAP_OFFSET.
+func rawDiscoFilterMagics() []rawDiscoMagic {
+	magics := rawDiscoMagics
+	if debugRawDiscoSTUN() {
+		magics = append(slices.Clip(magics), rawDiscoSTUNMatch)
+	}
+	if off, ok := rawDiscoEncapOffset(); ok {
+		m := rawDiscoMagics[0]
+		m.offset = uint32(off)
+		magics = append(slices.Clip(magics), m)
+	}
+	return magics
+}
+
+// magicsockFilterV4 returns the BPF program for raw UDPv4 sockets,
+// accepting packets for port (or rawDiscoTestPort) whose UDP payload
+// starts with any of magics and is no longer than rawDiscoMaxSize. A
+// zero port accepts any port.
+//
+// A raw socket's filter only sees the IP packet, never the link-layer
+// header, so 802.1Q VLAN tags make no difference to it; only BPF
+// devices, which capture frames whole, need to allow for them (see
+// debugRawDiscoVLAN).
+func magicsockFilterV4(magics []rawDiscoMagic, port uint16) []bpf.Instruction {
+	// For raw UDPv4 sockets, BPF receives the entire IP packet to
+	// inspect.
+	//
+	// The fragment checks below jump over the header length load,
+	// the port and magic comparisons and the accept, straight to the
+	// drop.
+	matchLen := uint8(discoMatchLen(magics, port) + 1)
+	prog := []bpf.Instruction{
+		// Disco packets are so small they should never get
+		// fragmented. If they do, the kernel reassembles them before
+		// local delivery (and thus before this filter runs), so these
+		// checks only ever see a lone fragment that the kernel
+		// couldn't reassemble. See TestRawDiscoIPv4Fragments.
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		// More Fragments bit set means this is part of a fragmented packet.
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x2000, SkipTrue: matchLen + 2, SkipFalse: 0},
+		// Non-zero fragment offset with MF=0 means this is the last
+		// fragment of packet.
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: matchLen + 1, SkipFalse: 0},
+
+		// Load IP header length into X register.
+		bpf.LoadMemShift{Off: 0},
+	}
+	return appendDiscoMagicMatch(prog, magics, port, func(off uint32, size int) bpf.Instruction {
+		return bpf.LoadIndirect{Off: off, Size: size}
+	})
+}
+
+// magicsockFilterV6 returns the BPF program for raw UDPv6 sockets,
+// accepting packets for port (or rawDiscoTestPort) whose UDP payload
+// starts with any of magics and is no longer than rawDiscoMaxSize. A
+// zero port accepts any port.
+//
+// IPv6 extension headers (Hop-by-Hop, Routing, Destination Options,
+// Fragment) don't need handling here: the kernel walks them before
+// delivering to a raw IPPROTO_UDP socket, and the filter runs on the
+// datagram from the UDP header onwards no matter how many extension
+// headers preceded it. See TestRawDiscoIPv6ExtensionHeaders.
+func magicsockFilterV6(magics []rawDiscoMagic, port uint16) []bpf.Instruction {
+	// For raw UDPv6 sockets, BPF receives _only_ the UDP header onwards, not an entire IP packet.
+	//
+	//    https://stackoverflow.com/questions/24514333/using-bpf-with-sock-dgram-on-linux-machine
+	//    https://blog.cloudflare.com/epbf_sockets_hop_distance/
+	//
+	// This is especially confusing because this *isn't* true for
+	// IPv4; see the following code from the 'ping' utility that
+	// corroborates this:
+	//
+	//    https://github.com/iputils/iputils/blob/1ab5fa/ping/ping.c#L1667-L1676
+	//    https://github.com/iputils/iputils/blob/1ab5fa/ping/ping6_common.c#L933-L941
+	return appendDiscoMagicMatch(nil, magics, port, func(off uint32, size int) bpf.Instruction {
+		return bpf.LoadAbsolute{Off: off, Size: size}
+	})
+}
+
+// appendDiscoMagicMatch appends to prog the instructions comparing the
+// UDP destination port against port, the length against
+// rawDiscoMaxSize and the payload against each of magics in turn,
+// followed by an accept (reached on the first match) and a drop. load
+// returns the instruction loading size bytes at offset off from the
+// start of the UDP header.
+//
+// The length compared is the UDP header's, which the kernel trims
+// datagrams to before handing them to the regular socket. One with a
+// shorter length than it really has is let through, to be parsed by
+// what it says.
+//
+// Besides port, packets for rawDiscoTestPort are accepted too, for the
+// self-test and health checks. A zero port skips the port comparison,
+// leaving it to handleRawDiscoDatagram.
+func appendDiscoMagicMatch(prog []bpf.Instruction, magics []rawDiscoMagic, port uint16, load func(off uint32, size int) bpf.Instruction) []bpf.Instruction {
+	magicLen := uint8(4 * len(magics))
+	if port != 0 {
+		prog = append(prog,
+			load(2, 2), // destination port
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(port), SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: rawDiscoTestPort, SkipFalse: discoMaxSizeLen + magicLen + 1},
+		)
+	}
+	prog = append(prog,
+		load(4, 2), // length, of the header and payload
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: uint32(udpHeaderSize + rawDiscoMaxSize()), SkipTrue: magicLen + 1},
+	)
+	for i, m := range magics {
+		// On a match, jump over the comparisons for the remaining
+		// magics to the accept. On a mismatch, fall through to the
+		// next magic, or for the last one hop over the accept to the
+		// drop.
+		remaining := uint8(4 * (len(magics) - i - 1))
+		var last uint8
+		if i == len(magics)-1 {
+			last = 1
+		}
+		if m.stun {
+			prog = append(prog,
+				// Compare the STUN message type.
+				load(udpHeaderSize, 2),
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: stunBindingResponse, SkipTrue: 0, SkipFalse: 2 + last},
+
+				// Compare the magic cookie, after the length.
+				load(udpHeaderSize+4, 4),
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: stunMagicCookie, SkipTrue: remaining, SkipFalse: last},
+			)
+			continue
+		}
+		prog = append(prog,
+			// Compare the first 4 bytes of the UDP payload (from the
+			// offset, if any) with the magic. Past the end of the
+			// packet, the load drops it.
+			load(udpHeaderSize+m.offset, 4),
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: m.hi, SkipTrue: 0, SkipFalse: 2 + last},
+
+			// Compare the next 2 bytes.
+			load(udpHeaderSize+m.offset+4, 2),
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(m.lo), SkipTrue: remaining, SkipFalse: last},
+		)
+	}
+	return append(prog,
+		// Accept the whole packet
+		bpf.RetConstant{Val: 0xFFFFFFFF},
+
+		// Skip the packet
+		bpf.RetConstant{Val: 0x0},
+	)
+}
+
+// discoMaxSizeLen is the number of instructions appendDiscoMagicMatch
+// uses comparing the length against rawDiscoMaxSize.
+const discoMaxSizeLen = 2
+
+// discoMatchLen returns the number of instructions
+// appendDiscoMagicMatch appends before the accept.
+func discoMatchLen(magics []rawDiscoMagic, port uint16) int {
+	n := discoMaxSizeLen + 4*len(magics)
+	if port != 0 {
+		n += 3
+	}
+	return n
+}
+
+// testDiscoPacket is what the raw disco self-test and health checks
+// send: the header of a disco message, with a zero sender key and
+// nonce, and no box. No peer has the zero key, so it's never handled as
+// if it were from one.
+var testDiscoPacket = func() []byte {
+	b := make([]byte, len(disco.Magic)+key.DiscoPublicRawLen+disco.NonceLen)
+	copy(b, disco.Magic)
+	return b
+}()
+
+// dumpBPF formats prog, one instruction per line, in the style of
+// tcpdump -d followed by the assembled instruction as with tcpdump -dd.
+func dumpBPF(prog []bpf.Instruction) (string, error) {
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, ins := range prog {
+		r := raw[i]
+		fmt.Fprintf(&sb, "(%03d) %-30v { 0x%02x, %d, %d, 0x%08x },\n", i, ins, r.Op, r.Jt, r.Jf, r.K)
+	}
+	return sb.String(), nil
+}
+
+// bpfAsmCacheSize is how many assembled programs assembleBPF keeps:
+// enough for both families' filters for the current and previous port,
+// and on the BSDs, for each link type's variant of them.
+const bpfAsmCacheSize = 8
+
+// bpfAsmCache holds the programs assembleBPF assembled most recently,
+// most recent first.
+var bpfAsmCache struct {
+	mu      sync.Mutex
+	entries []bpfAsm
+}
+
+type bpfAsm struct {
+	prog []bpf.Instruction
+	asm  []bpf.RawInstruction
+}
+
+// assembleBPF returns prog assembled, reusing the result of a recent
+// call with the same program. The filters only change with the port
+// and debug knobs, but are rebuilt for every receiver started, on
+// every rebind and retry. The returned program is shared, so mustn't be
+// modified.
+//
+// TestAssembleRawDiscoFilters assembles the built-in filters with
+// every option, so an error here is from a custom one (see
+// rawDiscoFilter), and with it comes from the first listenRawDisco,
+// not a later restart.
+func assembleBPF(prog []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	c := &bpfAsmCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.entries {
+		if sameInstructions(e.prog, prog) {
+			copy(c.entries[1:i+1], c.entries[:i])
+			c.entries[0] = e
+			return e.asm, nil
+		}
+	}
+	asm, err := bpf.Assemble(prog)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.entries) < bpfAsmCacheSize {
+		c.entries = append(c.entries, bpfAsm{})
+	}
+	copy(c.entries[1:], c.entries[:len(c.entries)-1])
+	c.entries[0] = bpfAsm{prog: slices.Clone(prog), asm: asm}
+	return asm, nil
+}
+
+// sameInstructions reports whether a and b are the same program.
+func sameInstructions(a, b []bpf.Instruction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// debugRawDiscoBPFV4 and debugRawDiscoBPFV6, if set, are BPF programs
+// to use on Linux in place of magicsockFilterV4 and magicsockFilterV6,
+// for operators tweaking the filter without a rebuild. They're in the
+// form tcpdump -ddd outputs, of an instruction count followed by that
+// many instructions of four decimal numbers, separated by newlines or,
+// as for iptables' bpf match, commas. A value starting with @ names
+// a file to read the program from instead. They must still accept the
+// self-test's packets, to rawDiscoTestPort, or the receiver won't
+// start.
+var (
+	debugRawDiscoBPFV4 = envknob.RegisterString("TS_DEBUG_RAW_DISCO_BPF_V4")
+	debugRawDiscoBPFV6 = envknob.RegisterString("TS_DEBUG_RAW_DISCO_BPF_V6")
+)
+
+// rawDiscoFilter returns the BPF program for the raw disco receiver
+// for family on Linux to use with port: magicsockFilterV4 or
+// magicsockFilterV6, unless overridden by TS_DEBUG_RAW_DISCO_BPF_V4 or
+// TS_DEBUG_RAW_DISCO_BPF_V6, in which case custom is true. A custom
+// program is used for any port; handleRawDiscoDatagram checks it.
+func rawDiscoFilter(family string, port uint16) (prog []bpf.Instruction, custom bool, err error) {
+	v := debugRawDiscoBPFV4()
+	if family == "ip6" {
+		v = debugRawDiscoBPFV6()
+	}
+	if v == "" {
+		if family == "ip6" {
+			return magicsockFilterV6(rawDiscoFilterMagics(), port), false, nil
+		}
+		return magicsockFilterV4(rawDiscoFilterMagics(), port), false, nil
+	}
+	if strings.HasPrefix(v, "@") {
+		b, err := os.ReadFile(v[1:])
+		if err != nil {
+			return nil, true, err
+		}
+		v = string(b)
+	}
+	raw, err := parseBPF(v)
+	if err != nil {
+		return nil, true, fmt.Errorf("custom %v filter: %w", family, err)
+	}
+	prog, _ = bpf.Disassemble(raw)
+	if err := checkCustomBPF(prog); err != nil {
+		return nil, true, fmt.Errorf("custom %v filter: %w", family, err)
+	}
+	return prog, true, nil
+}
+
+// maxBPFLen is the most instructions Linux accepts in a classic BPF
+// program, BPF_MAXINSNS.
+const maxBPFLen = 4096
+
+// parseBPF parses a BPF program in the form tcpdump -ddd outputs. See
+// debugRawDiscoBPFV4.
+func parseBPF(s string) ([]bpf.RawInstruction, error) {
+	var lines []string
+	for _, l := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty program")
+	}
+	n, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad instruction count %q", lines[0])
+	}
+	if n != len(lines)-1 {
+		return nil, fmt.Errorf("instruction count is %d, but %d instructions follow", n, len(lines)-1)
+	}
+	if n == 0 || n > maxBPFLen {
+		return nil, fmt.Errorf("%d instructions; want 1 to %d", n, maxBPFLen)
+	}
+	prog := make([]bpf.RawInstruction, n)
+	for i, l := range lines[1:] {
+		f := strings.Fields(l)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("instruction %d: %q isn't 4 numbers", i, l)
+		}
+		var v [4]uint64
+		for j, bits := range []int{16, 8, 8, 32} {
+			if v[j], err = strconv.ParseUint(f[j], 10, bits); err != nil {
+				return nil, fmt.Errorf("instruction %d: %v", i, err)
+			}
+		}
+		prog[i] = bpf.RawInstruction{Op: uint16(v[0]), Jt: uint8(v[1]), Jf: uint8(v[2]), K: uint32(v[3])}
+	}
+	return prog, nil
+}
+
+// checkCustomBPF checks that prog, a custom raw disco filter, can't
+// jump or run off its end, and doesn't accept every packet: a filter
+// that does would have every UDP packet the host receives copied to
+// the receiver. The kernel does its own validation on attaching it.
+func checkCustomBPF(prog []bpf.Instruction) error {
+	// Classic BPF only jumps forwards, so one pass in order visits
+	// every instruction after all those that might jump to it.
+	reachable := make([]bool, len(prog))
+	reachable[0] = true
+	mayDrop := false
+	for i, ins := range prog {
+		if !reachable[i] {
+			continue
+		}
+		var next []int
+		switch ins := ins.(type) {
+		case bpf.RetConstant:
+			if ins.Val == 0 {
+				mayDrop = true
+			}
+		case bpf.RetA:
+			mayDrop = true // A could be anything
+		case bpf.Jump:
+			next = []int{i + 1 + int(ins.Skip)}
+		case bpf.JumpIf:
+			next = []int{i + 1 + int(ins.SkipTrue), i + 1 + int(ins.SkipFalse)}
+		case bpf.JumpIfX:
+			next = []int{i + 1 + int(ins.SkipTrue), i + 1 + int(ins.SkipFalse)}
+		default:
+			next = []int{i + 1}
+		}
+		for _, j := range next {
+			if j >= len(prog) {
+				return fmt.Errorf("instruction %d runs past the end", i)
+			}
+			reachable[j] = true
+		}
+	}
+	if !mayDrop {
+		return errors.New("program accepts every packet")
+	}
+	return nil
+}
+
+// RawDiscoFilters returns the BPF programs the raw disco receivers use
+// on Linux for IPv4 and IPv6, given c's current ports, formatted for
+// comparing with tcpdump -d and -dd output when debugging. It doesn't
+// need any socket, so works on any platform.
+func (c *Conn) RawDiscoFilters() (v4, v6 string, err error) {
+	prog, _, err := rawDiscoFilter("ip4", c.discoPort("ip4"))
+	if err != nil {
+		return "", "", err
+	}
+	if v4, err = dumpBPF(prog); err != nil {
+		return "", "", err
+	}
+	if prog, _, err = rawDiscoFilter("ip6", c.discoPort("ip6")); err != nil {
+		return "", "", err
+	}
+	if v6, err = dumpBPF(prog); err != nil {
+		return "", "", err
+	}
+	return v4, v6, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"tailscale.com/envknob"
+)
+
+// debugDiscoMulticast, if set, is a multicast group and port, as
+// "239.1.2.3:4567" or "[ff02::1234]:4567", to listen on for disco-like
+// probes for LAN discovery experiments. See startDiscoMulticast.
+var debugDiscoMulticast = envknob.RegisterString("TS_DEBUG_DISCO_MULTICAST")
+
+// discoMulticastGroup returns the group and port TS_DEBUG_DISCO_MULTICAST
+// names, reporting whether it's set to a valid one: a multicast
+// address, without a zone, and a non-zero port.
+func discoMulticastGroup() (_ netip.AddrPort, ok bool) {
+	group, err := netip.ParseAddrPort(debugDiscoMulticast())
+	if err != nil || !group.Addr().IsMulticast() || group.Addr().Zone() != "" || group.Port() == 0 {
+		return netip.AddrPort{}, false
+	}
+	return group, true
+}
+
+// startDiscoMulticast, with TS_DEBUG_DISCO_MULTICAST, joins its group
+// and passes the disco-like probes sent to it to the func set with
+// SetDiscoMulticastFunc. They're never handled as disco, and unicast
+// disco is received as ever, whether or not this works; failures are
+// only logged.
+//
+// It's a regular UDP socket, not one of the raw disco receivers: those
+// match on our port with no regard for the destination address, which
+// for IPv6 their filters never see, and joining the group takes a
+// socket anyway. Nothing else binds the group's port, so there's no
+// other socket to get to them first. Like the receivers, it's on the
+// interface TS_DEBUG_RAW_DISCO_INTERFACE names, if any, or else the
+// one the system picks.
+func (c *Conn) startDiscoMulticast() {
+	group, ok := discoMulticastGroup()
+	if !ok {
+		if v := debugDiscoMulticast(); v != "" {
+			c.logf("disco multicast: ignoring invalid TS_DEBUG_DISCO_MULTICAST %q", v)
+		}
+		return
+	}
+	var ifi *net.Interface
+	if c.rawDiscoIface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(c.rawDiscoIface); err != nil {
+			c.logf("disco multicast: not joining %v: %v", group, err)
+			return
+		}
+	}
+	network := "udp4"
+	if group.Addr().Is6() {
+		network = "udp6"
+	}
+	uc, err := net.ListenMulticastUDP(network, ifi, net.UDPAddrFromAddrPort(group))
+	if err != nil {
+		c.logf("disco multicast: not joining %v: %v", group, err)
+		return
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		uc.Close()
+		return
+	}
+	c.discoMulticastConn = uc
+	c.mu.Unlock()
+	c.logf("[v1] disco multicast: receiving on %v", group)
+	c.goRawDiscoReader(func() { c.receiveDiscoMulticast(uc) })
+}
+
+// receiveDiscoMulticast reads and handles the probes sent to
+// startDiscoMulticast's group until uc is closed, by Conn.Close.
+func (c *Conn) receiveDiscoMulticast(uc *net.UDPConn) {
+	// One more than the largest accepted, to tell those too large apart.
+	buf := make([]byte, rawDiscoMaxSize()+1)
+	for {
+		n, src, err := uc.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			c.logf("disco multicast: reader failed: %v", err)
+			return
+		}
+		c.handleDiscoMulticast(buf[:n], netip.AddrPortFrom(src.Addr().Unmap(), src.Port()))
+	}
+}
+
+// handleDiscoMulticast passes msg, a UDP payload sent by src to
+// startDiscoMulticast's group, to the func set with
+// SetDiscoMulticastFunc, if it starts with a disco magic and is no
+// longer than rawDiscoMaxSize, as the raw disco receivers' filters
+// would.
+func (c *Conn) handleDiscoMulticast(msg []byte, src netip.AddrPort) {
+	if len(msg) > rawDiscoMaxSize() || rawDiscoVersion(msg) == 0 {
+		metricRecvDiscoMulticastDropped.Add(1)
+		return
+	}
+	metricRecvDiscoMulticast.Add(1)
+	if fn := c.discoMulticastFunc.Load(); fn != nil {
+		(*fn)(msg, src)
+	}
+}
+
+// SetDiscoMulticastFunc sets fn to be passed the disco-like probes
+// received with TS_DEBUG_DISCO_MULTICAST, and their source, for LAN
+// discovery experiments. It replaces any previous fn; a nil fn removes
+// it. Without the knob, fn is never called.
+//
+// fn is called on the receiver's goroutine, so mustn't block, and
+// mustn't keep pkt after returning.
+func (c *Conn) SetDiscoMulticastFunc(fn func(pkt []byte, src netip.AddrPort)) {
+	if fn == nil {
+		c.discoMulticastFunc.Store(nil)
+		return
+	}
+	c.discoMulticastFunc.Store(&fn)
+}
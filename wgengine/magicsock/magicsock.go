@@ -14,7 +14,6 @@
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"io"
 	"math"
 	"math/rand"
 	"net"
@@ -29,6 +28,7 @@
 	"time"
 
 	"go4.org/mem"
+	"go4.org/netipx"
 	"golang.zx2c4.com/wireguard/conn"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/derp"
@@ -265,11 +265,72 @@ type Conn struct {
 	pconn4 RebindingUDPConn
 	pconn6 RebindingUDPConn
 
-	// closeDisco4 and closeDisco6 are io.Closers to shut down the raw
-	// disco packet receivers. If nil, no raw disco receiver is
-	// running for the given family.
-	closeDisco4 io.Closer
-	closeDisco6 io.Closer
+	// rawDisco4 and rawDisco6 track the raw disco packet receivers
+	// for each family. See listenRawDisco.
+	rawDisco4 rawDiscoState
+	rawDisco6 rawDiscoState
+
+	// rawDiscoObserver, if non-nil, is told about disco packets
+	// accepted by the raw disco receivers. See SetRawDiscoObserver.
+	rawDiscoObserver atomic.Pointer[rawDiscoObserver]
+
+	// rawDiscoSTUNFunc, if non-nil, is passed STUN binding responses
+	// accepted by the raw disco receivers. See SetRawDiscoSTUNFunc.
+	rawDiscoSTUNFunc atomic.Pointer[func(pkt []byte, src netip.AddrPort)]
+
+	// rawDiscoEncapFunc, if non-nil, is passed encapsulated disco
+	// accepted by the raw disco receivers. See SetRawDiscoEncapFunc.
+	rawDiscoEncapFunc atomic.Pointer[func(pkt []byte, src netip.AddrPort)]
+
+	// rawDiscoAllowedSrcs, if non-nil, is the only sources the raw
+	// disco receivers accept disco from. See
+	// SetRawDiscoSourceAllowlist.
+	rawDiscoAllowedSrcs atomic.Pointer[netipx.IPSet]
+
+	// rawDiscoPaused is whether disco is handled from the regular UDP
+	// sockets even while raw disco receivers run. See PauseRawDisco.
+	rawDiscoPaused atomic.Bool
+
+	// rawDiscoIface, if non-empty, is the name of the only interface
+	// the raw disco receivers listen on. See rawDiscoInterface.
+	rawDiscoIface string
+
+	// rawDiscoProbing is set on the throwaway Conn ProbeRawDisco
+	// starts a receiver on, which goRawDiscoReader then starts no
+	// readers for.
+	rawDiscoProbing bool
+
+	// rawDiscoSources counts the packets the raw disco receivers
+	// accept by source. See RawDiscoSources.
+	rawDiscoSources rawDiscoSources
+
+	// rawDiscoHistory is the last packets the raw disco receivers
+	// accepted. See RecentRawDisco.
+	rawDiscoHistory rawDiscoHistory
+
+	// rawDiscoHealth reports the raw disco receivers' failures to the
+	// health subsystem.
+	rawDiscoHealth rawDiscoHealth
+
+	// rawDiscoDedup drops disco packets handled from both the raw and
+	// regular paths.
+	rawDiscoDedup rawDiscoDedup
+
+	// rawDiscoPcap is the file TS_DEBUG_RAW_DISCO_PCAP has the raw
+	// disco receivers write their packets to.
+	rawDiscoPcap rawDiscoPcap
+
+	// rawDiscoWorkers are the goroutines TS_DEBUG_RAW_DISCO_WORKERS
+	// has the raw disco receivers hand their disco to.
+	rawDiscoWorkers rawDiscoWorkers
+
+	// discoMulticastConn, if non-nil, is the socket joined to the
+	// group TS_DEBUG_DISCO_MULTICAST names. See startDiscoMulticast.
+	discoMulticastConn *net.UDPConn
+
+	// discoMulticastFunc, if non-nil, is passed the probes received on
+	// discoMulticastConn. See SetDiscoMulticastFunc.
+	discoMulticastFunc atomic.Pointer[func(pkt []byte, src netip.AddrPort)]
 
 	// netChecker is the prober that discovers local network
 	// conditions, including the closest DERP relay and NAT mappings.
@@ -358,6 +419,9 @@ type Conn struct {
 	// currently running. It's used to deduplicate concurrent endpoint
 	// update requests.
 	endpointsUpdateActive bool
+	// rawDiscoReadersRunning is the number of goroutines started by
+	// goRawDiscoReader that haven't returned yet. Close waits for them.
+	rawDiscoReadersRunning int
 	// wantEndpointsUpdate, if non-empty, means that a new endpoints
 	// update should begin immediately after the currently-running one
 	// completes. It can only be non-empty if
@@ -570,6 +634,11 @@ func newConn() *Conn {
 	c.bind = &connBind{Conn: c, closed: true}
 	c.muCond = sync.NewCond(&c.mu)
 	c.networkUp.Store(true) // assume up until told otherwise
+	c.rawDisco4.activeGauge = metricRawDiscoActiveIPv4
+	c.rawDisco6.activeGauge = metricRawDiscoActiveIPv6
+	// Set up front, as raw disco receivers run until it's done.
+	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
+	c.donec = c.connCtx.Done()
 	return c
 }
 
@@ -592,11 +661,10 @@ func NewConn(opts Options) (*Conn, error) {
 	c.linkMon = opts.LinkMonitor
 
 	if err := c.rebind(keepCurrentPort); err != nil {
+		c.connCtxCancel()
 		return nil, err
 	}
 
-	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
-	c.donec = c.connCtx.Done()
 	c.netChecker = &netcheck.Client{
 		Logf:                logger.WithPrefix(c.logf, "netcheck: "),
 		GetSTUNConn4:        func() netcheck.STUNConn { return &c.pconn4 },
@@ -607,18 +675,11 @@ func NewConn(opts Options) (*Conn, error) {
 
 	c.ignoreSTUNPackets()
 
-	if d4, err := c.listenRawDisco("ip4"); err == nil {
-		c.logf("[v1] using BPF disco receiver for IPv4")
-		c.closeDisco4 = d4
-	} else {
-		c.logf("[v1] couldn't create raw v4 disco listener, using regular listener instead: %v", err)
-	}
-	if d6, err := c.listenRawDisco("ip6"); err == nil {
-		c.logf("[v1] using BPF disco receiver for IPv6")
-		c.closeDisco6 = d6
-	} else {
-		c.logf("[v1] couldn't create raw v6 disco listener, using regular listener instead: %v", err)
-	}
+	c.rawDiscoIface = rawDiscoInterface()
+	c.startRawDisco("ip4")
+	c.startRawDisco("ip6")
+	go c.rawDiscoHealthLoop()
+	c.startDiscoMulticast()
 
 	return c, nil
 }
@@ -986,6 +1047,7 @@ func (c *Conn) DiscoPublicKey() key.DiscoPublic {
 		c.discoPublic = priv.Public()
 		c.discoShort = c.discoPublic.ShortString()
 		c.logf("magicsock: disco key = %v", c.discoShort)
+		c.rawDiscoKeyChanged()
 	}
 	return c.discoPublic
 }
@@ -1682,7 +1744,7 @@ func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6, c.closeDisco6 == nil); ok {
+		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6, !c.rawDiscoHandling("ip6")); ok {
 			metricRecvDataIPv6.Add(1)
 			return n, ep, nil
 		}
@@ -1698,7 +1760,7 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4, c.closeDisco4 == nil); ok {
+		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4, !c.rawDiscoHandling("ip4")); ok {
 			metricRecvDataIPv4.Add(1)
 			return n, ep, nil
 		}
@@ -1715,12 +1777,33 @@ func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache,
 		return nil, false
 	}
 	if checkDisco {
+		if disco.LooksLikeDiscoWrapper(b) && c.socketDiscoDup(b, ipp) {
+			return nil, false
+		}
 		if c.handleDiscoMessage(b, ipp, key.NodePublic{}) {
+			if ipp.Addr().Unmap().Is4() {
+				metricRecvDiscoSocketIPv4.Add(1)
+			} else {
+				metricRecvDiscoSocketIPv6.Add(1)
+			}
 			return nil, false
 		}
 	} else if disco.LooksLikeDiscoWrapper(b) {
 		// Caller told us to ignore disco traffic, don't let it fall
-		// through to wireguard-go.
+		// through to wireguard-go. It's left to the raw disco
+		// receiver, which should be getting it too.
+		family := "ip6"
+		if ipp.Addr().Unmap().Is4() {
+			family = "ip4"
+		}
+		s := c.rawDiscoState(family)
+		s.lastSocketDisco.Store(int64(mono.Now()))
+		s.socketDiscoCount.Add(1)
+		if family == "ip4" {
+			metricRecvDiscoSocketIgnoredIPv4.Add(1)
+		} else {
+			metricRecvDiscoSocketIgnoredIPv6.Add(1)
+		}
 		return nil, false
 	}
 	if !c.havePrivateKey.Load() {
@@ -1892,9 +1975,19 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 // it was received from at the DERP layer. derpNodeSrc is zero when received
 // over UDP.
 func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc key.NodePublic) (isDiscoMsg bool) {
+	isDiscoMsg, _ = c.handleDiscoMessageAuth(msg, src, derpNodeSrc, mono.Now())
+	return isDiscoMsg
+}
+
+// handleDiscoMessageAuth is handleDiscoMessage, additionally reporting
+// whether msg looked like disco but failed authentication: it was from
+// a disco key we don't know, or its box didn't open with that key.
+// rxAt is when msg was received, from which pong latencies are
+// measured.
+func (c *Conn) handleDiscoMessageAuth(msg []byte, src netip.AddrPort, derpNodeSrc key.NodePublic, rxAt mono.Time) (isDiscoMsg, authFailed bool) {
 	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
 	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
-		return false
+		return false, false
 	}
 
 	// If the first four parts are the prefix of disco.Magic
@@ -1928,6 +2021,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 
 	if !c.peerMap.anyEndpointForDiscoKey(sender) {
 		metricRecvDiscoBadPeer.Add(1)
+		authFailed = true
 		if debugDisco() {
 			c.logf("magicsock: disco: ignoring disco-looking frame, don't know endpoint for %v", sender.ShortString())
 		}
@@ -1956,6 +2050,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
 		}
 		metricRecvDiscoBadKey.Add(1)
+		authFailed = true
 		return
 	}
 
@@ -1991,7 +2086,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		// the Pong's TxID was theirs.
 		handled := false
 		c.peerMap.forEachEndpointWithDiscoKey(sender, func(ep *endpoint) {
-			if !handled && ep.handlePongConnLocked(dm, di, src) {
+			if !handled && ep.handlePongConnLocked(dm, di, src, rxAt) {
 				handled = true
 			}
 		})
@@ -2679,12 +2774,8 @@ func (c *connBind) Close() error {
 	// Unblock all outstanding receives.
 	c.pconn4.Close()
 	c.pconn6.Close()
-	if c.closeDisco4 != nil {
-		c.closeDisco4.Close()
-	}
-	if c.closeDisco6 != nil {
-		c.closeDisco6.Close()
-	}
+	c.rawDisco4.stopped(nil)
+	c.rawDisco6.stopped(nil)
 	// Send an empty read result to unblock receiveDERP,
 	// which will then check connBind.Closed.
 	// connBind.Closed takes c.mu, but c.derpRecvCh is buffered.
@@ -2725,6 +2816,12 @@ func (c *Conn) Close() error {
 	// They will frequently have been closed already by a call to connBind.Close.
 	c.pconn6.Close()
 	c.pconn4.Close()
+	c.rawDisco4.stopped(nil)
+	c.rawDisco6.stopped(nil)
+	c.rawDiscoHealth.clear()
+	if c.discoMulticastConn != nil {
+		c.discoMulticastConn.Close()
+	}
 
 	// Wait on goroutines updating right at the end, once everything is
 	// already closed. We want everything else in the Conn to be
@@ -2733,11 +2830,12 @@ func (c *Conn) Close() error {
 	for c.goroutinesRunningLocked() {
 		c.muCond.Wait()
 	}
+	c.rawDiscoPcap.close()
 	return nil
 }
 
 func (c *Conn) goroutinesRunningLocked() bool {
-	if c.endpointsUpdateActive {
+	if c.endpointsUpdateActive || c.rawDiscoReadersRunning > 0 {
 		return true
 	}
 	// The goroutine running dc.Connect in derpWriteChanOfAddr may linger
@@ -2893,7 +2991,10 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 			c.logf("magicsock: unable to bind %v port %d: %v", network, port, err)
 			continue
 		}
-		// Success.
+		// Success. Point the raw disco receiver's filter at the new
+		// port before ruc starts handing out reads from pconn, as from
+		// then on those ignore disco in favor of the raw path.
+		c.setRawDiscoFilterPort(network, uint16(pconn.LocalAddr().(*net.UDPAddr).Port))
 		ruc.setConnLocked(pconn)
 		if network == "udp4" {
 			health.SetUDP4Unbound(false)
@@ -2905,6 +3006,7 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 	// Set pconn to a dummy conn whose reads block until closed.
 	// This keeps the receive funcs alive for a future in which
 	// we get a link change and we can try binding again.
+	c.setRawDiscoFilterPort(network, 0)
 	ruc.setConnLocked(newBlockForeverConn())
 	if network == "udp4" {
 		health.SetUDP4Unbound(true)
@@ -2940,6 +3042,7 @@ func (c *Conn) Rebind() {
 		c.logf("%w", err)
 		return
 	}
+	c.refreshRawDiscoInterfaces()
 
 	var ifIPs []netip.Prefix
 	if c.linkMon != nil {
@@ -3882,7 +3985,8 @@ func (de *endpoint) noteConnectivityChange() {
 // It should be called with the Conn.mu held.
 //
 // It reports whether m.TxID corresponds to a ping that this endpoint sent.
-func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip.AddrPort) (knownTxID bool) {
+// rxAt is when m was received, which may be a little before now.
+func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip.AddrPort, rxAt mono.Time) (knownTxID bool) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
@@ -3898,7 +4002,10 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	di.setNodeKey(de.publicKey)
 
 	now := mono.Now()
-	latency := now.Sub(sp.at)
+	if rxAt.Before(sp.at) || rxAt.After(now) {
+		rxAt = now
+	}
+	latency := rxAt.Sub(sp.at)
 
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
@@ -4246,4 +4353,181 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	// Disco packets received bpf read path
 	metricRecvDiscoPacketIPv4 = clientmetric.NewCounter("magicsock_disco_recv_bpf_ipv4")
 	metricRecvDiscoPacketIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_ipv6")
+
+	// Bytes of UDP payload in those disco packets.
+	metricRecvDiscoBytesIPv4 = clientmetric.NewCounter("magicsock_disco_recv_bpf_bytes_ipv4")
+	metricRecvDiscoBytesIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_bytes_ipv6")
+
+	// Disco packets received on the regular UDP sockets, while the bpf
+	// read path for their family isn't active.
+	metricRecvDiscoSocketIPv4 = clientmetric.NewCounter("magicsock_disco_recv_socket_ipv4")
+	metricRecvDiscoSocketIPv6 = clientmetric.NewCounter("magicsock_disco_recv_socket_ipv6")
+
+	// Disco packets that arrived on the regular UDP sockets while the
+	// bpf read path for their family was active, and so were left to
+	// it. Compared to metricRecvDiscoPacketIPv4 and IPv6, they give the
+	// bpf path's coverage: packets it misses (fragments, IPv6 extension
+	// headers) show up here but not there.
+	metricRecvDiscoSocketIgnoredIPv4 = clientmetric.NewCounter("magicsock_disco_recv_socket_ignored_ipv4")
+	metricRecvDiscoSocketIgnoredIPv6 = clientmetric.NewCounter("magicsock_disco_recv_socket_ignored_ipv6")
+
+	// Disco packets dropped as copies of ones already handled from the
+	// other of the bpf and regular read paths. See rawDiscoDedup.
+	metricRecvDiscoDedup = clientmetric.NewCounter("magicsock_disco_recv_dedup")
+
+	// Disco packets dropped on the bpf read path because they were
+	// for a UDP port other than ours.
+	metricRecvDiscoRawPortMismatchIPv4 = clientmetric.NewCounter("magicsock_disco_recv_bpf_port_mismatch_ipv4")
+	metricRecvDiscoRawPortMismatchIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_port_mismatch_ipv6")
+
+	// Disco packets dropped on the bpf read path because they were
+	// for UDP port 0, which is invalid.
+	metricRecvDiscoRawPortZero = clientmetric.NewCounter("magicsock_disco_recv_bpf_port_zero")
+
+	// Disco packets dropped on the bpf read path because their
+	// family's regular UDP socket wasn't bound, so had no port for
+	// them to be for.
+	metricRecvDiscoRawNoPort = clientmetric.NewCounter("magicsock_disco_recv_bpf_no_port")
+
+	// Disco packets dropped on the bpf read path, or skipped by its
+	// self-test, because they were too small to hold a UDP header.
+	metricRecvDiscoRawShort = clientmetric.NewCounter("magicsock_disco_recv_bpf_short")
+
+	// Disco packets dropped on the bpf read path because their source
+	// address wasn't a valid IP address.
+	metricRecvDiscoRawBadSrc = clientmetric.NewCounter("magicsock_disco_recv_bpf_bad_src")
+
+	// Disco packets dropped on the bpf read path while paused, being
+	// handled from the regular UDP socket instead.
+	metricRecvDiscoRawPaused = clientmetric.NewCounter("magicsock_disco_recv_bpf_paused")
+
+	// Packets the kernel dropped on the bpf read path for want of
+	// receive buffer space, where it says.
+	metricRecvDiscoRawKernelDrops = clientmetric.NewCounter("magicsock_disco_recv_bpf_kernel_drops")
+
+	// Panics handling disco packets from the bpf read path, recovered
+	// from.
+	metricRecvDiscoRawPanics = clientmetric.NewCounter("magicsock_disco_recv_bpf_panics")
+
+	// Transient errors reading from the bpf read path, after which it
+	// kept reading.
+	metricRecvDiscoRawRecvErrors = clientmetric.NewCounter("magicsock_disco_recv_bpf_recv_errors")
+
+	// Disco packets dropped on the bpf read path because they didn't
+	// fit in the receive buffer.
+	metricRecvDiscoRawTruncated = clientmetric.NewCounter("magicsock_disco_recv_bpf_truncated")
+
+	// First fragments of fragmented disco packets for our port,
+	// dropped on the bpf read path, over IPv4 and IPv6. Only counted
+	// with BPF devices and TS_DEBUG_RAW_DISCO_COUNT_FRAGMENTS; raw
+	// sockets only ever see reassembled packets, which they accept.
+	metricRecvDiscoRawFragmented     = clientmetric.NewCounter("magicsock_disco_recv_bpf_fragmented")
+	metricRecvDiscoRawFragmentedIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_fragmented_ipv6")
+
+	// Disco packets dropped on the bpf read path because their sender
+	// key was all zeros, like the self-test's but not it.
+	metricRecvDiscoRawZeroKey = clientmetric.NewCounter("magicsock_disco_recv_bpf_zero_key")
+
+	// Disco packets dropped on the bpf read path because their source
+	// wasn't in the allowlist set with SetRawDiscoSourceAllowlist.
+	metricRecvDiscoRawSrcDenied = clientmetric.NewCounter("magicsock_disco_recv_bpf_src_denied")
+
+	// Disco packets from the bpf read path that failed authentication,
+	// being from an unknown disco key or not opening with it. A rise
+	// may mean spoofing, or other traffic matching the disco magic.
+	metricRecvDiscoRawUndecryptable = clientmetric.NewCounter("magicsock_disco_recv_bpf_undecryptable")
+
+	// Disco packets from the bpf read path not passed on to the
+	// observer set with SetRawDiscoObserver, as it was behind.
+	metricRecvDiscoRawObserverDropped = clientmetric.NewCounter("magicsock_disco_recv_bpf_observer_dropped")
+
+	// Disco packets from the bpf read path not handled, as the workers
+	// TS_DEBUG_RAW_DISCO_WORKERS hands them to were behind.
+	metricRecvDiscoRawWorkerDropped = clientmetric.NewCounter("magicsock_disco_recv_bpf_worker_dropped")
+
+	// STUN binding responses accepted on the bpf read path, with
+	// TS_DEBUG_RAW_DISCO_STUN, and passed to the func set with
+	// SetRawDiscoSTUNFunc, if any, instead of handled as disco.
+	metricRecvDiscoRawSTUN = clientmetric.NewCounter("magicsock_disco_recv_bpf_stun")
+
+	// Packets accepted by the bpf read path as encapsulated disco, with
+	// TS_DEBUG_RAW_DISCO_ENCAP_OFFSET. See SetRawDiscoEncapFunc.
+	metricRecvDiscoRawEncap = clientmetric.NewCounter("magicsock_disco_recv_bpf_encap")
+
+	// Probes received on, and dropped from, the multicast group
+	// TS_DEBUG_DISCO_MULTICAST joins, the latter for not starting with
+	// a disco magic or being too long. See SetDiscoMulticastFunc.
+	metricRecvDiscoMulticast        = clientmetric.NewCounter("magicsock_disco_recv_multicast")
+	metricRecvDiscoMulticastDropped = clientmetric.NewCounter("magicsock_disco_recv_multicast_dropped")
+
+	// Outcomes of the self-test run when starting the bpf read path.
+	metricRawDiscoSelfTestOKIPv4   = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_ok_ipv4")
+	metricRawDiscoSelfTestOKIPv6   = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_ok_ipv6")
+	metricRawDiscoSelfTestFailIPv4 = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_fail_ipv4")
+	metricRawDiscoSelfTestFailIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_fail_ipv6")
+
+	// Self-test and health check failures, by whether the test packet
+	// couldn't be sent or was sent but not received in time.
+	metricRawDiscoSelfTestWriteFailIPv4 = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_write_fail_ipv4")
+	metricRawDiscoSelfTestWriteFailIPv6 = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_write_fail_ipv6")
+	metricRawDiscoSelfTestTimeoutIPv4   = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_timeout_ipv4")
+	metricRawDiscoSelfTestTimeoutIPv6   = clientmetric.NewCounter("magicsock_disco_recv_bpf_selftest_timeout_ipv6")
+
+	// The bpf read path's disco as a percentage of what the regular
+	// socket ignored for it, over the last window checkRawDiscoStarved
+	// compared, and how often that shut the bpf read path down.
+	metricRawDiscoShareIPv4 = clientmetric.NewGauge("magicsock_disco_recv_bpf_share_pct_ipv4")
+	metricRawDiscoShareIPv6 = clientmetric.NewGauge("magicsock_disco_recv_bpf_share_pct_ipv6")
+	metricRawDiscoStarved   = clientmetric.NewCounter("magicsock_disco_recv_bpf_starved")
+
+	// Failures attaching a bpf read path filter to its socket, by
+	// errno; see bpfInstallErrno.
+	metricRawDiscoBPFInstallFail = func() map[string]*clientmetric.Metric {
+		m := make(map[string]*clientmetric.Metric)
+		for _, class := range []string{"eperm", "enosys", "einval", "enomem", "other"} {
+			m[class] = clientmetric.NewCounter("magicsock_disco_recv_bpf_install_fail_" + class)
+		}
+		return m
+	}()
+
+	// Disco packets accepted on the bpf read path, by the disco
+	// protocol version of the magic they start with.
+	metricRecvDiscoRawVersion = func() map[int]*clientmetric.Metric {
+		m := make(map[int]*clientmetric.Metric)
+		for _, dm := range rawDiscoMagics {
+			m[dm.version] = clientmetric.NewCounter(fmt.Sprintf("magicsock_disco_recv_bpf_v%d", dm.version))
+		}
+		return m
+	}()
+
+	// Time handleDiscoMessage took with disco packets from the bpf
+	// read path, as a histogram: each counts the packets it took less
+	// than the named time for (and no less than the previous one's)
+	// or, for slow, those taking rawDiscoSlowHandle or more.
+	metricRecvDiscoRawHandleLt100us = clientmetric.NewCounter("magicsock_disco_recv_bpf_handle_lt_100us")
+	metricRecvDiscoRawHandleLt1ms   = clientmetric.NewCounter("magicsock_disco_recv_bpf_handle_lt_1ms")
+	metricRecvDiscoRawHandleLt10ms  = clientmetric.NewCounter("magicsock_disco_recv_bpf_handle_lt_10ms")
+	metricRecvDiscoRawHandleSlow    = clientmetric.NewCounter("magicsock_disco_recv_bpf_handle_slow")
+
+	// Payload sizes of the packets the bpf read path's filter accepted,
+	// as a histogram: each counts those of less than the named number
+	// of bytes (and no less than the previous one's) or, for large,
+	// those of 2048 or more, up to rawDiscoMaxSize. See rawDiscoSizeMetric.
+	metricRecvDiscoRawSizeLt128  = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_lt_128")
+	metricRecvDiscoRawSizeLt256  = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_lt_256")
+	metricRecvDiscoRawSizeLt512  = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_lt_512")
+	metricRecvDiscoRawSizeLt1024 = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_lt_1024")
+	metricRecvDiscoRawSizeLt2048 = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_lt_2048")
+	metricRecvDiscoRawSizeLarge  = clientmetric.NewCounter("magicsock_disco_recv_bpf_size_large")
+
+	// Round trip time, in microseconds, of the last successful raw
+	// disco self-test.
+	metricRawDiscoSelfTestRTTIPv4 = clientmetric.NewGauge("magicsock_disco_recv_bpf_selftest_rtt_us_ipv4")
+	metricRawDiscoSelfTestRTTIPv6 = clientmetric.NewGauge("magicsock_disco_recv_bpf_selftest_rtt_us_ipv6")
+
+	// Whether disco is read from the raw disco receiver (1) or, having
+	// fallen back, from the regular UDP socket (0). Unlike the packet
+	// counters, they say what a node is doing even when it's idle.
+	metricRawDiscoActiveIPv4 = clientmetric.NewGauge("magicsock_raw_disco_active_ipv4")
+	metricRawDiscoActiveIPv6 = clientmetric.NewGauge("magicsock_raw_disco_active_ipv6")
 )
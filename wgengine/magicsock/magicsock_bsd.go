@@ -0,0 +1,874 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (darwin && !ios) || freebsd
+// +build darwin,!ios freebsd
+
+package magicsock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"tailscale.com/envknob"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/endian"
+	"tailscale.com/util/multierr"
+)
+
+// debugRawDiscoCountFragments makes BPF devices also capture the first
+// fragment of fragmented disco packets, to count them in
+// metricRecvDiscoRawFragmented and metricRecvDiscoRawFragmentedIPv6.
+// Unlike with a Linux raw socket, which only sees reassembled packets,
+// those are otherwise lost: the filter can't reassemble them, and the
+// regular socket ignores disco while the raw path is active.
+var debugRawDiscoCountFragments = envknob.RegisterBool("TS_DEBUG_RAW_DISCO_COUNT_FRAGMENTS")
+
+// debugRawDiscoVLAN makes BPF devices on Ethernet interfaces also
+// capture disco in 802.1Q VLAN-tagged frames, for interfaces that are
+// the parent of VLANs whose traffic we're to receive: a device on one
+// sees the frames with their tags, which otherwise shift the IP header
+// past where the filter looks. The VLAN interfaces themselves, like
+// Linux raw sockets, only ever see untagged frames.
+var debugRawDiscoVLAN = envknob.RegisterBool("TS_DEBUG_RAW_DISCO_VLAN")
+
+// rawDiscoBPFDevices opts in to receiving disco with BPF devices. They
+// capture ahead of pf and ipfw (see listenRawDisco), and the regular
+// socket ignores disco while they're in use, so without it disco is
+// left to the regular socket, behind the firewall.
+var rawDiscoBPFDevices = envknob.RegisterBool("TS_RAW_DISCO_BPF_DEVICES")
+
+// bpfDeviceBufSize is the read buffer size requested for BPF devices.
+// Each read returns as many captured packets as fit.
+const bpfDeviceBufSize = 1 << 16
+
+// listenRawDisco starts listening for disco packets on the given
+// address family, which must be "ip4" or "ip6", using BPF devices.
+//
+// Unlike a Linux raw socket, a BPF device captures frames from a
+// single interface (link-layer header and all, and before any IP
+// processing), so we open one per interface that's up and has an
+// address of the family. Interfaces that appear or gain such an
+// address later, as when joining Wi-Fi or docking, are picked up by
+// refreshRawDiscoInterfaces restarting the listener on the next
+// Rebind. If c.rawDiscoIface is set, only it and loopback are
+// captured. As on Linux, a disco packet sent over loopback must be
+// received before we commit to this path.
+// https://github.com/tailscale/tailscale/issues/3824
+//
+// Also unlike a Linux raw socket, and like the AF_PACKET sockets
+// avoided there, a BPF device captures ahead of pf and ipfw, so disco
+// for our port is handled even where the firewall would block it. The
+// BSDs have nothing that captures after the firewall, their raw
+// sockets never seeing UDP, so it's only done when opted in to with
+// TS_RAW_DISCO_BPF_DEVICES, by someone who knows their firewall isn't
+// what keeps disco out.
+func (c *Conn) listenRawDisco(family string, port uint16) (_ io.Closer, err error) {
+	if rawDiscoDisabled(family) {
+		return nil, ErrRawDiscoDisabled
+	}
+	if !rawDiscoBPFDevices() {
+		return nil, fmt.Errorf("%w: BPF devices capture ahead of the firewall; set TS_RAW_DISCO_BPF_DEVICES to use them", ErrRawDiscoDisabled)
+	}
+	if family != "ip4" && family != "ip6" {
+		return nil, fmt.Errorf("%w: address family %q", ErrRawDiscoUnsupported, family)
+	}
+
+	var devs bpfDevices
+	var unopened []string // interfaces we tried to capture on but couldn't
+	var accessErr error   // from the first device we weren't allowed to open
+	defer closeOnError(&devs, &err)
+	err = rawDiscoForeachInterface(func(i interfaces.Interface, pfxs []netip.Prefix) {
+		if accessErr != nil || !c.capturesRawDiscoOn(i, pfxs, family) {
+			return
+		}
+		d, err := openBPFDevice(i.Name, i.Index, family, i.IsLoopback(), port)
+		if isBPFAccessError(err) {
+			accessErr = err
+			return
+		}
+		if err != nil {
+			c.logf("[v1] disco raw: not capturing on %s: %v", i.Name, err)
+			unopened = append(unopened, i.Name)
+			return
+		}
+		devs = append(devs, d)
+	})
+	if err == nil && accessErr != nil {
+		// It won't be any different next time, nor on any other
+		// interface.
+		err = fmt.Errorf("%w: opening BPF device: %v", ErrRawDiscoUnsupported, accessErr)
+		return nil, err
+	}
+	if err == nil && len(devs) == 0 {
+		err = errors.New("no interfaces to capture on")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening BPF devices: %w", err)
+	}
+	if why := c.rawDiscoSkipSelfTest(); why == "" {
+		rtt, err := devs.selfTest(family)
+		c.noteRawDiscoSelfTest(family, rtt, err)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.logf("disco raw: skipping %v self-test: %s", family, why)
+	}
+
+	r := &bpfReceiver{devs: devs, unopened: unopened}
+	for _, d := range devs {
+		d := d
+		c.goRawDiscoReader(func() { c.receiveDiscoBPF(c.connCtx, r, d, family) })
+	}
+	return r, nil
+}
+
+// rawDiscoForeachInterface is interfaces.ForeachInterface, which tests
+// replace to add interfaces.
+var rawDiscoForeachInterface = interfaces.ForeachInterface
+
+// capturesRawDiscoOn reports whether listenRawDisco captures family on
+// i, whose addresses are pfxs.
+func (c *Conn) capturesRawDiscoOn(i interfaces.Interface, pfxs []netip.Prefix, family string) bool {
+	if !i.IsUp() || !hasPrefixOfFamily(pfxs, family) {
+		return false
+	}
+	return c.rawDiscoIface == "" || i.Name == c.rawDiscoIface || i.IsLoopback()
+}
+
+// rawDiscoInterfacesStale reports whether rc, a receiver for family
+// returned by listenRawDisco, is missing interfaces it would capture on
+// if started now: ones that came up since, or whose devices it dropped
+// when they went away (see receiveDiscoBPF) and that are back. Ones it
+// couldn't open a device on at the time don't count.
+func (c *Conn) rawDiscoInterfacesStale(rc io.Closer, family string) bool {
+	r, ok := rc.(*bpfReceiver)
+	if !ok {
+		return false
+	}
+	have := r.ifNames()
+	stale := false
+	err := rawDiscoForeachInterface(func(i interfaces.Interface, pfxs []netip.Prefix) {
+		if c.capturesRawDiscoOn(i, pfxs, family) && !slices.Contains(have, i.Name) {
+			stale = true
+		}
+	})
+	return err == nil && stale
+}
+
+// selfTest checks that a disco packet sent to loopback is captured by
+// the loopback device in ds, returning how long that took.
+func (ds bpfDevices) selfTest(family string) (time.Duration, error) {
+	var lo *bpfDevice
+	for _, d := range ds {
+		if d.isLoopback {
+			lo = d
+			break
+		}
+	}
+	if lo == nil {
+		return 0, errors.New("no loopback interface for raw disco self-test")
+	}
+
+	start := time.Now()
+	if err := writeRawDiscoTestPacket(family); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrRawDiscoSelfTestWrite, err)
+	}
+	lo.f.SetReadDeadline(time.Now().Add(rawDiscoSelfTestTimeout()))
+	defer lo.f.SetReadDeadline(time.Time{})
+	for found := false; !found; {
+		err := lo.read(func(pkt []byte, truncated bool) {
+			udp, _, ok := lo.parse(pkt)
+			if !ok || truncated {
+				return
+			}
+			if len(udp) < udpHeaderSize {
+				metricRecvDiscoRawShort.Add(1)
+				return
+			}
+			if bytes.Equal(udp[udpHeaderSize:], testDiscoPacket) {
+				found = true
+			}
+		})
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrRawDiscoSelfTestTimeout, err)
+		}
+	}
+	return time.Since(start), nil
+}
+
+func hasPrefixOfFamily(pfxs []netip.Prefix, family string) bool {
+	for _, p := range pfxs {
+		if p.Addr().Is6() == (family == "ip6") {
+			return true
+		}
+	}
+	return false
+}
+
+// bpfDevice is a BPF device capturing disco packets of one address
+// family on one interface.
+type bpfDevice struct {
+	f          *os.File
+	ifName     string
+	ifIndex    int
+	isIPv6     bool
+	isLoopback bool
+	dlt        uint32 // datalink type
+	linkHdrLen int    // bytes of link-layer header in front of the IP header, untagged
+	vlan       bool   // also capturing 802.1Q-tagged frames; see debugRawDiscoVLAN
+	buf        []byte // read buffer, of the size the device requires
+}
+
+// bpfDevices closes all its devices.
+type bpfDevices []*bpfDevice
+
+func (ds bpfDevices) Close() error {
+	var errs []error
+	for _, d := range ds {
+		if err := d.f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
+
+// rawDiscoSockets implements rawDiscoSocketer. The filter lengths
+// aren't known; BPF devices don't report them.
+func (ds bpfDevices) rawDiscoSockets(family string) []RawDiscoSocket {
+	ret := make([]RawDiscoSocket, 0, len(ds))
+	for _, d := range ds {
+		ret = append(ret, RawDiscoSocket{
+			Family:    family,
+			LocalAddr: d.f.Name(),
+			Interface: d.ifName,
+			FD:        rawDiscoFD(d.f),
+		})
+	}
+	return ret
+}
+
+// bpfReceiver is the raw disco receiver listenRawDisco returns: the BPF
+// devices it still has open, and the interfaces it couldn't open them
+// on, for rawDiscoInterfacesStale. It's a pointer, unlike bpfDevices,
+// so that rawDiscoState can compare it.
+type bpfReceiver struct {
+	unopened []string
+
+	mu   sync.Mutex
+	devs bpfDevices // nil once closed
+}
+
+func (r *bpfReceiver) Close() error {
+	r.mu.Lock()
+	devs := r.devs
+	r.devs = nil
+	r.mu.Unlock()
+	return devs.Close()
+}
+
+// rawDiscoSockets implements rawDiscoSocketer.
+func (r *bpfReceiver) rawDiscoSockets(family string) []RawDiscoSocket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.devs.rawDiscoSockets(family)
+}
+
+// ifNames returns the interfaces r captures on or couldn't open a
+// device on.
+func (r *bpfReceiver) ifNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := slices.Clone(r.unopened)
+	for _, d := range r.devs {
+		ret = append(ret, d.ifName)
+	}
+	return ret
+}
+
+// drop closes d and stops capturing with it, reporting how many devices
+// r has left.
+func (r *bpfReceiver) drop(d *bpfDevice) (left int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := slices.Index(r.devs, d); i >= 0 {
+		r.devs = slices.Delete(slices.Clone(r.devs), i, i+1)
+		d.f.Close()
+	}
+	return len(r.devs)
+}
+
+// openBPF opens an unused BPF device. FreeBSD has a cloning /dev/bpf;
+// macOS has only the numbered devices, creating more on demand.
+func openBPF() (fd int, err error) {
+	const flags = unix.O_RDWR | unix.O_CLOEXEC | unix.O_NONBLOCK
+	fd, err = unix.Open("/dev/bpf", flags, 0)
+	if err != unix.ENOENT {
+		return fd, err
+	}
+	for i := 0; i < 256; i++ {
+		fd, err = unix.Open("/dev/bpf"+strconv.Itoa(i), flags, 0)
+		if err != unix.EBUSY {
+			return fd, err
+		}
+	}
+	return -1, err
+}
+
+// isBPFAccessError reports whether err, from openBPFDevice, means we
+// can't use BPF devices at all: there are none (ENOENT), as in some
+// jails, or we may not open them (EACCES, EPERM), as without root or
+// in the macOS app sandbox.
+func isBPFAccessError(err error) bool {
+	return errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOENT)
+}
+
+// openBPFDevice opens a BPF device capturing inbound disco packets of
+// family for port on the interface named ifName.
+func openBPFDevice(ifName string, ifIndex int, family string, isLoopback bool, port uint16) (_ *bpfDevice, err error) {
+	fd, err := openBPF()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+
+	// The buffer size can only be set before attaching to an
+	// interface, and the kernel may pick a different one.
+	bufLen := uint32(bpfDeviceBufSize)
+	if err := ioctlPtr(fd, unix.BIOCSBLEN, unsafe.Pointer(&bufLen)); err != nil {
+		return nil, fmt.Errorf("BIOCSBLEN: %w", err)
+	}
+	var ifr [unix.IFNAMSIZ + 16]byte // struct ifreq
+	if len(ifName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %q too long", ifName)
+	}
+	copy(ifr[:], ifName)
+	if err := ioctlPtr(fd, unix.BIOCSETIF, unsafe.Pointer(&ifr[0])); err != nil {
+		return nil, fmt.Errorf("BIOCSETIF: %w", err)
+	}
+	if err := ioctlPtr(fd, unix.BIOCGBLEN, unsafe.Pointer(&bufLen)); err != nil {
+		return nil, fmt.Errorf("BIOCGBLEN: %w", err)
+	}
+	// Return packets as soon as they arrive, rather than when the
+	// buffer fills.
+	one := uint32(1)
+	if err := ioctlPtr(fd, unix.BIOCIMMEDIATE, unsafe.Pointer(&one)); err != nil {
+		return nil, fmt.Errorf("BIOCIMMEDIATE: %w", err)
+	}
+	// Don't capture our own outgoing disco. On loopback, though,
+	// everything we receive is something we sent; there the kernel
+	// only taps packets on their way out.
+	if !isLoopback {
+		zero := uint32(0)
+		if err := ioctlPtr(fd, unix.BIOCSSEESENT, unsafe.Pointer(&zero)); err != nil {
+			return nil, fmt.Errorf("BIOCSSEESENT: %w", err)
+		}
+	}
+	var dlt uint32
+	if err := ioctlPtr(fd, unix.BIOCGDLT, unsafe.Pointer(&dlt)); err != nil {
+		return nil, fmt.Errorf("BIOCGDLT: %w", err)
+	}
+
+	// The link-layer header length depends only on dlt.
+	_, linkHdrLen, err := bpfDeviceFilter(dlt, family == "ip6", nil, 0, false, false)
+	if err != nil {
+		return nil, err
+	}
+	d := &bpfDevice{
+		ifName:     ifName,
+		ifIndex:    ifIndex,
+		isIPv6:     family == "ip6",
+		isLoopback: isLoopback,
+		dlt:        dlt,
+		linkHdrLen: linkHdrLen,
+		vlan:       dlt == unix.DLT_EN10MB && debugRawDiscoVLAN(),
+		buf:        make([]byte, bufLen),
+	}
+	// BIOCSETF also discards anything captured before the filter was
+	// in place.
+	if err := d.setFilter(fd, unix.BIOCSETF, port); err != nil {
+		return nil, err
+	}
+	d.f = os.NewFile(uintptr(fd), "/dev/bpf")
+	return d, nil
+}
+
+// setFilter installs on fd, d's BPF device, the filter accepting disco
+// for port, using the ioctl req (BIOCSETF or BIOCSETFNR).
+func (d *bpfDevice) setFilter(fd int, req uint, port uint16) error {
+	prog, _, err := bpfDeviceFilter(d.dlt, d.isIPv6, rawDiscoFilterMagics(), port, debugRawDiscoCountFragments(), d.vlan)
+	if err != nil {
+		return err
+	}
+	asm, err := assembleBPF(prog)
+	if err != nil {
+		return fmt.Errorf("%w: assembling filter: %v", ErrRawDiscoBPFInstall, err)
+	}
+	fprog := unix.BpfProgram{
+		Len:   uint32(len(asm)),
+		Insns: (*unix.BpfInsn)(unsafe.Pointer(&asm[0])),
+	}
+	if err := ioctlPtr(fd, req, unsafe.Pointer(&fprog)); err != nil {
+		return fmt.Errorf("%w: %v", ErrRawDiscoBPFInstall, err)
+	}
+	return nil
+}
+
+// injectRawDiscoTestPacket isn't needed here: the BPF devices are
+// opened per interface, with the loopback one kept whatever
+// TS_DEBUG_RAW_DISCO_INTERFACE says, so the self-test doesn't lose
+// sight of its packet in the setups it's for on Linux.
+func injectRawDiscoTestPacket(family, ifName string) error {
+	return fmt.Errorf("%w: TS_DEBUG_RAW_DISCO_TEST_INTERFACE is only supported on Linux", ErrRawDiscoUnsupported)
+}
+
+// setRawDiscoPort replaces the BPF filters of rc, a receiver for
+// family returned by listenRawDisco, with ones accepting disco for
+// port.
+func setRawDiscoPort(rc io.Closer, family string, port uint16) error {
+	r, ok := rc.(*bpfReceiver)
+	if !ok {
+		return fmt.Errorf("unexpected raw disco receiver %T", rc)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, d := range r.devs {
+		sc, err := d.f.SyscallConn()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var setErr error
+		if err := sc.Control(func(fd uintptr) {
+			// Unlike BIOCSETF, BIOCSETFNR keeps what's already
+			// been captured.
+			setErr = d.setFilter(int(fd), unix.BIOCSETFNR, port)
+		}); err != nil {
+			setErr = err
+		}
+		if setErr != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.ifName, setErr))
+		}
+	}
+	return multierr.New(errs...)
+}
+
+func ioctlPtr(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IPv6 Next Header values of the extension headers bpfDeviceFilter
+// handles.
+const (
+	ipv6HopByHop = 0
+	ipv6Fragment = 44
+)
+
+// bpfDrop is a placeholder jump offset in bpfDeviceFilter's program,
+// patched by patchBPFDrop to the distance to a drop instruction.
+const bpfDrop = 0xff
+
+// etherTypeVLAN is the EtherType of an 802.1Q tag, which is followed
+// by the tag control information and the frame's real EtherType.
+const etherTypeVLAN = 0x8100
+
+// vlanTagLen is the length of an 802.1Q tag.
+const vlanTagLen = 4
+
+// bpfDeviceFilter returns the BPF program for a BPF device whose
+// datalink type is dlt, accepting unfragmented UDP packets of the
+// given family whose payload starts with any of magics, along with the
+// length of the link-layer header the program skips. As with
+// magicsockFilterV4, only packets for port (or rawDiscoTestPort) are
+// accepted, unless it's zero. IPv6 packets may have a Hop-by-Hop
+// Options header, but no other extension headers. If firstFragments
+// is set, the first fragments of such packets are accepted too, for
+// IPv6 only right after a Fragment header.
+//
+// If vlan is set and dlt is DLT_EN10MB, frames with a single 802.1Q
+// tag are accepted too, their link-layer header being vlanTagLen
+// longer than the one returned (see bpfDevice.linkHdrLenOf). The rest
+// of the program is repeated for them with the longer header, as BPF
+// has no way to shift every load at once.
+func bpfDeviceFilter(dlt uint32, isIPv6 bool, magics []rawDiscoMagic, port uint16, firstFragments, vlan bool) (_ []bpf.Instruction, linkHdrLen int, _ error) {
+	var prog []bpf.Instruction
+	switch dlt {
+	case unix.DLT_EN10MB:
+		linkHdrLen = 14
+		etherType := uint32(0x0800)
+		if isIPv6 {
+			etherType = 0x86dd
+		}
+		if vlan {
+			untagged := bpfDeviceIPFilter(uint32(linkHdrLen), isIPv6, magics, port, firstFragments)
+			tagged := []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 12 + vlanTagLen, Size: 2}, // after the tag
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherType, SkipFalse: bpfDrop},
+			}
+			taggedIP := bpfDeviceIPFilter(uint32(linkHdrLen+vlanTagLen), isIPv6, magics, port, firstFragments)
+			patchBPFDrop(tagged, len(tagged)+len(taggedIP)-1)
+			tagged = append(tagged, taggedIP...)
+			prog = append(prog,
+				bpf.LoadAbsolute{Off: 12, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherType, SkipTrue: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeVLAN, SkipFalse: bpfDrop},
+				bpf.Jump{Skip: uint32(len(untagged))},
+			)
+			patchBPFDrop(prog, len(prog)+len(untagged)-1)
+			prog = append(prog, untagged...)
+			return append(prog, tagged...), linkHdrLen, nil
+		}
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherType, SkipFalse: bpfDrop},
+		)
+	case unix.DLT_NULL:
+		// Loopback and tun: a 4 byte address family, in host byte
+		// order.
+		linkHdrLen = 4
+		af := uint32(unix.AF_INET)
+		if isIPv6 {
+			af = unix.AF_INET6
+		}
+		if !endian.Big {
+			af = uint32(af>>24 | af>>8&0xff00 | af<<8&0xff0000 | af<<24)
+		}
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: 0, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: af, SkipFalse: bpfDrop},
+		)
+	case unix.DLT_RAW:
+		// No link-layer header; the IP version nibble says which
+		// family it is.
+		version := uint32(4 << 4)
+		if isIPv6 {
+			version = 6 << 4
+		}
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: version, SkipFalse: bpfDrop},
+		)
+	default:
+		return nil, 0, fmt.Errorf("unsupported datalink type %d", dlt)
+	}
+	ip := bpfDeviceIPFilter(uint32(linkHdrLen), isIPv6, magics, port, firstFragments)
+	patchBPFDrop(prog, len(prog)+len(ip)-1)
+	return append(prog, ip...), linkHdrLen, nil
+}
+
+// bpfDeviceIPFilter returns the part of bpfDeviceFilter's program
+// after the link-layer header's check, for packets whose IP header
+// starts l bytes in. It ends with an accept and a drop, which any
+// jumps to bpfDrop in front of it are for the caller to patch to.
+func bpfDeviceIPFilter(l uint32, isIPv6 bool, magics []rawDiscoMagic, port uint16, firstFragments bool) []bpf.Instruction {
+	var prog []bpf.Instruction
+	var load func(off uint32, size int) bpf.Instruction
+	if isIPv6 {
+		// With a BPF device we see packets as they came off the
+		// wire, before the kernel walks their extension headers. As
+		// BPF can't loop, only UDP right after the IPv6 header or
+		// after a single Hop-by-Hop Options header, the most common
+		// one, is matched. X holds the length of the latter, if any.
+		//
+		// With firstFragments, so is UDP right after a Fragment
+		// header with a zero offset.
+		const ext = ipv6.HeaderLen // offset of the extension header
+		hopByHop := []bpf.Instruction{
+			bpf.LoadAbsolute{Off: l + ext, Size: 1}, // its Next Header
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: bpfDrop},
+			bpf.LoadAbsolute{Off: l + ext + 1, Size: 1}, // Hdr Ext Len, in 8 bytes beyond the first 8
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.TAX{},
+			bpf.Jump{Skip: 1}, // over the LoadConstant below
+		}
+		var fragment []bpf.Instruction
+		notHopByHop := uint8(bpfDrop)
+		if firstFragments {
+			notHopByHop = 0
+			fragment = []bpf.Instruction{
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipv6Fragment, SkipFalse: bpfDrop},
+				bpf.LoadAbsolute{Off: l + ext + 2, Size: 2}, // Fragment Offset, reserved bits, M
+				bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0xfff8, SkipTrue: bpfDrop},
+				bpf.LoadAbsolute{Off: l + ext, Size: 1}, // its Next Header
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: bpfDrop},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: ipv6FragmentHeaderSize},
+				bpf.Jump{Skip: uint32(len(hopByHop) + 1)},
+			}
+		}
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: l + 6, Size: 1}, // Next Header
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipTrue: uint8(1 + len(fragment) + len(hopByHop))},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipv6HopByHop, SkipTrue: uint8(len(fragment)), SkipFalse: notHopByHop},
+		)
+		prog = append(prog, fragment...)
+		prog = append(prog, hopByHop...)
+		prog = append(prog, bpf.LoadConstant{Dst: bpf.RegX, Val: 0})
+		load = func(off uint32, size int) bpf.Instruction {
+			return bpf.LoadIndirect{Off: l + ipv6.HeaderLen + off, Size: size}
+		}
+	} else {
+		// Likewise, fragments arrive here before reassembly; drop
+		// any with MF set or a non-zero offset, or with
+		// firstFragments, just the latter. The first fragment holds
+		// the UDP header and magic.
+		fragMask := uint32(0x3fff)
+		if firstFragments {
+			fragMask = 0x1fff
+		}
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: l + 9, Size: 1}, // Protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: bpfDrop},
+			bpf.LoadAbsolute{Off: l + 6, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: fragMask, SkipTrue: bpfDrop},
+			// Load IP header length into X register.
+			bpf.LoadMemShift{Off: l},
+		)
+		load = func(off uint32, size int) bpf.Instruction {
+			return bpf.LoadIndirect{Off: l + off, Size: size}
+		}
+	}
+
+	// The match appended below is followed by the accept and then
+	// the drop.
+	patchBPFDrop(prog, len(prog)+discoMatchLen(magics, port)+1)
+	return appendDiscoMagicMatch(prog, magics, port, load)
+}
+
+// patchBPFDrop patches the jumps to bpfDrop in prog to jump to the
+// instruction at dropAt instead, which may be past prog's end.
+func patchBPFDrop(prog []bpf.Instruction, dropAt int) {
+	for i, ins := range prog {
+		if j, ok := ins.(bpf.JumpIf); ok {
+			if j.SkipTrue == bpfDrop {
+				j.SkipTrue = uint8(dropAt - i - 1)
+			}
+			if j.SkipFalse == bpfDrop {
+				j.SkipFalse = uint8(dropAt - i - 1)
+			}
+			prog[i] = j
+		}
+	}
+}
+
+// receiveDiscoBPF reads disco from d, one of r's devices, until ctx is
+// done or d is closed. If d's interface goes away, only d is dropped,
+// the rest of r carrying on, unless it was the last.
+//
+// As with receiveDisco, what it reads is counted in its own
+// rawDiscoCounts, and ending with ctx leaves d with a read deadline in
+// the past; closing it is still up to r.
+func (c *Conn) receiveDiscoBPF(ctx context.Context, r *bpfReceiver, d *bpfDevice, family string) {
+	counts := c.newRawDiscoCounts(family)
+	readDone := make(chan struct{})
+	defer close(readDone)
+	go func() {
+		t := time.NewTicker(rawDiscoCountsFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// Unblock the read in progress.
+				d.f.SetReadDeadline(time.Unix(1, 0))
+				return
+			case <-readDone:
+				return
+			case <-t.C:
+				counts.flush()
+			}
+		}
+	}()
+	defer counts.flush()
+
+	transientErrs := 0
+	for {
+		err := d.read(func(pkt []byte, truncated bool) {
+			if truncated {
+				metricRecvDiscoRawTruncated.Add(1)
+				return
+			}
+			udp, src, ok := d.parse(pkt)
+			if !ok {
+				return
+			}
+			if d.isFragment(pkt) {
+				// Only captured with debugRawDiscoCountFragments.
+				if len(udp) < udpHeaderSize || binary.BigEndian.Uint16(udp[2:4]) != c.discoPort(family) {
+					return
+				}
+				if d.isIPv6 {
+					metricRecvDiscoRawFragmentedIPv6.Add(1)
+				} else {
+					metricRecvDiscoRawFragmented.Add(1)
+				}
+				return
+			}
+			rx := rawDiscoRx{at: mono.Now(), ifIndex: d.ifIndex, counts: counts}
+			if d.isIPv6 {
+				// Unlike a raw socket, the device has the IPv6
+				// header to hand; parse checked it's all there.
+				rx.flowLabel = binary.BigEndian.Uint32(pkt[d.linkHdrLenOf(pkt):]) & ipv6FlowLabelMask
+			}
+			c.handleRawDiscoDatagram(udp, src, family, rx)
+		})
+		if errors.Is(err, os.ErrClosed) || ctx.Err() != nil {
+			return
+		} else if err != nil && isTransientRawDiscoErr(err) && transientErrs < rawDiscoMaxTransientErrs {
+			transientErrs++
+			metricRecvDiscoRawRecvErrors.Add(1)
+			c.rawDiscoErrLogf(family)("disco raw reader on %s: %v; continuing", d.ifName, err)
+			continue
+		} else if isBPFDeviceGoneError(err) && r.drop(d) > 0 {
+			c.logf("disco raw: %s gone (%v); no longer capturing %v disco on it", d.ifName, err, family)
+			return
+		} else if err != nil {
+			c.rawDiscoErrLogf(family)("disco raw reader on %s failed: %v", d.ifName, err)
+			if c.rawDiscoState(family).stoppedIf(r, err) {
+				c.logRawDiscoEvent(family, "fallback", err)
+				c.retryRawDiscoLater(family, err)
+			}
+			return
+		}
+		transientErrs = 0
+	}
+}
+
+// isBPFDeviceGoneError reports whether err, from reading a BPF device,
+// means its interface went away or down, as when undocking or tearing
+// down a VPN, rather than anything wrong with the device.
+func isBPFDeviceGoneError(err error) bool {
+	return errors.Is(err, unix.ENXIO) || errors.Is(err, unix.EIO) || errors.Is(err, unix.ENETDOWN)
+}
+
+// read reads from d, calling fn with each captured packet. A read
+// returns one or more packets, each preceded by a bpf_hdr and padded
+// out to BPF_ALIGNMENT; truncated reports whether the packet was
+// longer than what was captured.
+func (d *bpfDevice) read(fn func(pkt []byte, truncated bool)) error {
+	n, err := d.f.Read(d.buf)
+	if err != nil {
+		return err
+	}
+	hdrLen := int(unsafe.Sizeof(unix.BpfHdr{}))
+	for b := d.buf[:n]; len(b) >= hdrLen; {
+		hdr := (*unix.BpfHdr)(unsafe.Pointer(&b[0]))
+		start := int(hdr.Hdrlen)
+		end := start + int(hdr.Caplen)
+		if end > len(b) {
+			break
+		}
+		fn(b[start:end], hdr.Caplen < hdr.Datalen)
+		if next := bpfWordAlign(end); next < len(b) {
+			b = b[next:]
+		} else {
+			b = nil
+		}
+	}
+	return nil
+}
+
+// linkHdrLenOf returns the length of the link-layer header of pkt, a
+// frame captured by d: d.linkHdrLen, plus vlanTagLen if d.vlan and pkt
+// is 802.1Q-tagged.
+func (d *bpfDevice) linkHdrLenOf(pkt []byte) int {
+	if d.vlan && len(pkt) >= 14 && binary.BigEndian.Uint16(pkt[12:14]) == etherTypeVLAN {
+		return d.linkHdrLen + vlanTagLen
+	}
+	return d.linkHdrLen
+}
+
+// isFragment reports whether pkt, a frame captured by d, holds a
+// fragment of an IP packet.
+func (d *bpfDevice) isFragment(pkt []byte) bool {
+	off := d.linkHdrLenOf(pkt) + 6
+	if d.isIPv6 {
+		return len(pkt) > off && pkt[off] == ipv6Fragment
+	}
+	return len(pkt) >= off+2 && binary.BigEndian.Uint16(pkt[off:])&0x3fff != 0
+}
+
+func bpfWordAlign(n int) int {
+	return (n + unix.BPF_ALIGNMENT - 1) &^ (unix.BPF_ALIGNMENT - 1)
+}
+
+// parse returns the UDP datagram in pkt, a frame captured by d, and
+// its source address, or ok false if pkt is malformed.
+func (d *bpfDevice) parse(pkt []byte) (udp []byte, src *net.IPAddr, ok bool) {
+	l := d.linkHdrLenOf(pkt)
+	if len(pkt) < l {
+		return nil, nil, false
+	}
+	ip := pkt[l:]
+	// Trim to the length in the IP header, as frames can be padded.
+	if d.isIPv6 {
+		if len(ip) < ipv6.HeaderLen {
+			return nil, nil, false
+		}
+		end := ipv6.HeaderLen + int(binary.BigEndian.Uint16(ip[4:6]))
+		if end > len(ip) {
+			return nil, nil, false
+		}
+		// Skip the one extension header the filter allows.
+		start := ipv6.HeaderLen
+		switch ip[6] {
+		case ipv6HopByHop:
+			if end < start+2 {
+				return nil, nil, false
+			}
+			start += (int(ip[start+1]) + 1) * 8
+		case ipv6Fragment:
+			start += ipv6FragmentHeaderSize
+		}
+		if start > end {
+			return nil, nil, false
+		}
+		srcIP := make(net.IP, net.IPv6len)
+		copy(srcIP, ip[8:24])
+		src := &net.IPAddr{IP: srcIP}
+		if srcIP.IsLinkLocalUnicast() {
+			// As the kernel would have it for a socket.
+			src.Zone = d.ifName
+		}
+		return ip[start:end], src, true
+	}
+	payload := stripIPv4Header(ip)
+	if payload == nil {
+		return nil, nil, false
+	}
+	end := int(binary.BigEndian.Uint16(ip[2:4]))
+	hdrLen := len(ip) - len(payload)
+	if end < hdrLen || end > len(ip) {
+		return nil, nil, false
+	}
+	srcIP := make(net.IP, net.IPv4len)
+	copy(srcIP, ip[12:16])
+	return ip[hdrLen:end], &net.IPAddr{IP: srcIP}, true
+}
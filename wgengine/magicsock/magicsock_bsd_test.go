@@ -0,0 +1,429 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (darwin && !ios) || freebsd
+// +build darwin,!ios freebsd
+
+package magicsock
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/util/endian"
+)
+
+func TestBPFDeviceFilter(t *testing.T) {
+	udp := make([]byte, udpHeaderSize, udpHeaderSize+len(testDiscoPacket))
+	binary.BigEndian.PutUint16(udp[0:2], 1234)
+	binary.BigEndian.PutUint16(udp[2:4], 1)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(cap(udp)))
+	udp = append(udp, testDiscoPacket...)
+
+	ip4 := func(frag uint16) []byte {
+		h := make([]byte, 20, 20+len(udp))
+		h[0] = 0x45
+		binary.BigEndian.PutUint16(h[2:4], uint16(cap(h)))
+		binary.BigEndian.PutUint16(h[6:8], frag)
+		h[8] = 64
+		h[9] = unix.IPPROTO_UDP
+		copy(h[12:16], []byte{192, 0, 2, 1})
+		return append(h, udp...)
+	}
+	// ip6 returns an IPv6 packet of udp, after ext, extension
+	// headers starting with nextHeader.
+	ip6 := func(nextHeader byte, ext ...byte) []byte {
+		h := make([]byte, 40, 40+len(ext)+len(udp))
+		h[0] = 0x60
+		binary.BigEndian.PutUint16(h[4:6], uint16(len(ext)+len(udp)))
+		h[6] = nextHeader
+		h[7] = 64
+		copy(h[8:24], net.ParseIP("2001:db8::1"))
+		h = append(h, ext...)
+		return append(h, udp...)
+	}
+	// hopByHop returns a Hop-by-Hop Options header, padded with PadN to
+	// 8*(extLen+1) bytes.
+	hopByHop := func(nextHeader byte, extLen int) []byte {
+		h := make([]byte, 8*(extLen+1))
+		h[0] = nextHeader
+		h[1] = byte(extLen)
+		h[2] = 1 // PadN
+		h[3] = byte(len(h) - 4)
+		return h
+	}
+	// fragment returns an IPv6 Fragment header for the fragment at
+	// offset (in 8 byte units), with more fragments to follow if more.
+	fragment := func(nextHeader byte, offset uint16, more bool) []byte {
+		h := make([]byte, 8)
+		h[0] = nextHeader
+		v := offset << 3
+		if more {
+			v |= 1
+		}
+		binary.BigEndian.PutUint16(h[2:4], v)
+		return h
+	}
+	ether := func(etherType uint16, ip []byte) []byte {
+		b := make([]byte, 14, 14+len(ip))
+		binary.BigEndian.PutUint16(b[12:14], etherType)
+		return append(b, ip...)
+	}
+	null := func(af uint32, ip []byte) []byte {
+		b := make([]byte, 4, 4+len(ip))
+		if endian.Big {
+			binary.BigEndian.PutUint32(b, af)
+		} else {
+			binary.LittleEndian.PutUint32(b, af)
+		}
+		return append(b, ip...)
+	}
+
+	tests := []struct {
+		name      string
+		dlt       uint32
+		isIPv6    bool
+		firstFrag bool
+		pkt       []byte
+		want      bool
+	}{
+		{"ether/ip4", unix.DLT_EN10MB, false, false, ether(0x0800, ip4(0)), true},
+		{"ether/ip4/fragment", unix.DLT_EN10MB, false, false, ether(0x0800, ip4(0x2000)), false},
+		{"ether/ip4/first-fragment", unix.DLT_EN10MB, false, true, ether(0x0800, ip4(0x2000)), true},
+		{"ether/ip4/last-fragment", unix.DLT_EN10MB, false, true, ether(0x0800, ip4(0x0004)), false},
+		{"ether/ip6-on-ip4", unix.DLT_EN10MB, false, false, ether(0x86dd, ip6(unix.IPPROTO_UDP)), false},
+		{"ether/ip6", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(unix.IPPROTO_UDP)), true},
+		{"ether/ip6/hop-by-hop", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(0, hopByHop(unix.IPPROTO_UDP, 0)...)), true},
+		{"ether/ip6/long-hop-by-hop", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(0, hopByHop(unix.IPPROTO_UDP, 2)...)), true},
+		{"ether/ip6/hop-by-hop-not-udp", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(0, hopByHop(unix.IPPROTO_TCP, 0)...)), false},
+		{"ether/ip6/two-hop-by-hop", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(0, append(hopByHop(0, 0), hopByHop(unix.IPPROTO_UDP, 0)...)...)), false},
+		{"ether/ip6/destination-options", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(60, hopByHop(unix.IPPROTO_UDP, 0)...)), false},
+		{"ether/ip6/fragment", unix.DLT_EN10MB, true, false, ether(0x86dd, ip6(44, fragment(unix.IPPROTO_UDP, 0, true)...)), false},
+		{"ether/ip6/first-fragment", unix.DLT_EN10MB, true, true, ether(0x86dd, ip6(44, fragment(unix.IPPROTO_UDP, 0, true)...)), true},
+		{"ether/ip6/last-fragment", unix.DLT_EN10MB, true, true, ether(0x86dd, ip6(44, fragment(unix.IPPROTO_UDP, 4, false)...)), false},
+		{"ether/ip6/hop-by-hop/first-fragments", unix.DLT_EN10MB, true, true, ether(0x86dd, ip6(0, hopByHop(unix.IPPROTO_UDP, 0)...)), true},
+		{"ether/ip6/first-fragments", unix.DLT_EN10MB, true, true, ether(0x86dd, ip6(unix.IPPROTO_UDP)), true},
+		{"raw/ip6/hop-by-hop", unix.DLT_RAW, true, false, ip6(0, hopByHop(unix.IPPROTO_UDP, 1)...), true},
+		{"null/ip4", unix.DLT_NULL, false, false, null(unix.AF_INET, ip4(0)), true},
+		{"null/ip6", unix.DLT_NULL, true, false, null(unix.AF_INET6, ip6(unix.IPPROTO_UDP)), true},
+		{"null/ip4-on-ip6", unix.DLT_NULL, true, false, null(unix.AF_INET, ip4(0)), false},
+		{"raw/ip4", unix.DLT_RAW, false, false, ip4(0), true},
+		{"raw/ip6", unix.DLT_RAW, true, false, ip6(unix.IPPROTO_UDP), true},
+		{"raw/ip6-on-ip4", unix.DLT_RAW, false, false, ip6(unix.IPPROTO_UDP), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, linkHdrLen, err := bpfDeviceFilter(tt.dlt, tt.isIPv6, rawDiscoMagics, 1, tt.firstFrag, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm, err := bpf.NewVM(prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := vm.Run(tt.pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n > 0; got != tt.want {
+				t.Fatalf("accepted = %v; want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			d := &bpfDevice{ifName: "test0", isIPv6: tt.isIPv6, linkHdrLen: linkHdrLen}
+			wantFrag := strings.HasSuffix(tt.name, "/first-fragment")
+			if got := d.isFragment(tt.pkt); got != wantFrag {
+				t.Errorf("isFragment = %v; want %v", got, wantFrag)
+			}
+			b, src, ok := d.parse(tt.pkt)
+			if !ok || string(b) != string(udp) {
+				t.Errorf("parse = % x, %v; want % x", b, ok, udp)
+			}
+			if src == nil || src.IP == nil {
+				t.Errorf("parse returned no source address")
+			}
+		})
+	}
+}
+
+func TestBPFDeviceFilterVLAN(t *testing.T) {
+	udp := make([]byte, udpHeaderSize, udpHeaderSize+len(testDiscoPacket))
+	binary.BigEndian.PutUint16(udp[0:2], 1234)
+	binary.BigEndian.PutUint16(udp[2:4], 1)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(cap(udp)))
+	udp = append(udp, testDiscoPacket...)
+
+	ip4 := make([]byte, 20, 20+len(udp))
+	ip4[0] = 0x45
+	binary.BigEndian.PutUint16(ip4[2:4], uint16(cap(ip4)))
+	ip4[8] = 64
+	ip4[9] = unix.IPPROTO_UDP
+	copy(ip4[12:16], []byte{192, 0, 2, 1})
+	ip4 = append(ip4, udp...)
+
+	ip6 := make([]byte, 40, 40+len(udp))
+	ip6[0] = 0x60
+	ip6[1] = 0x0a // a flow label of 0xabccd
+	ip6[2] = 0xbc
+	ip6[3] = 0xcd
+	binary.BigEndian.PutUint16(ip6[4:6], uint16(len(udp)))
+	ip6[6] = unix.IPPROTO_UDP
+	ip6[7] = 64
+	copy(ip6[8:24], net.ParseIP("2001:db8::1"))
+	ip6 = append(ip6, udp...)
+
+	// ether returns an Ethernet frame of ip, behind 802.1Q tags with
+	// the given EtherTypes, if any.
+	ether := func(etherType uint16, ip []byte, tags ...uint16) []byte {
+		var b []byte
+		b = append(b, make([]byte, 12)...) // MAC addresses
+		for _, tag := range tags {
+			b = binary.BigEndian.AppendUint16(b, tag)
+			b = binary.BigEndian.AppendUint16(b, 42) // VLAN ID
+		}
+		b = binary.BigEndian.AppendUint16(b, etherType)
+		return append(b, ip...)
+	}
+
+	tests := []struct {
+		name   string
+		isIPv6 bool
+		vlan   bool
+		pkt    []byte
+		want   bool
+	}{
+		{"ip4", false, true, ether(0x0800, ip4), true},
+		{"ip4/tagged", false, true, ether(0x0800, ip4, etherTypeVLAN), true},
+		{"ip4/tagged/no-vlan", false, false, ether(0x0800, ip4, etherTypeVLAN), false},
+		{"ip4/tagged/ip6", false, true, ether(0x86dd, ip6, etherTypeVLAN), false},
+		{"ip4/double-tagged", false, true, ether(0x0800, ip4, etherTypeVLAN, etherTypeVLAN), false},
+		{"ip4/qinq", false, true, ether(0x0800, ip4, 0x88a8), false},
+		{"ip6", true, true, ether(0x86dd, ip6), true},
+		{"ip6/tagged", true, true, ether(0x86dd, ip6, etherTypeVLAN), true},
+		{"ip6/tagged/no-vlan", true, false, ether(0x86dd, ip6, etherTypeVLAN), false},
+		{"ip6/tagged/ip4", true, true, ether(0x0800, ip4, etherTypeVLAN), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, linkHdrLen, err := bpfDeviceFilter(unix.DLT_EN10MB, tt.isIPv6, rawDiscoMagics, 1, false, tt.vlan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm, err := bpf.NewVM(prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := vm.Run(tt.pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n > 0; got != tt.want {
+				t.Fatalf("accepted = %v; want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			d := &bpfDevice{ifName: "test0", isIPv6: tt.isIPv6, linkHdrLen: linkHdrLen, vlan: tt.vlan}
+			if d.isFragment(tt.pkt) {
+				t.Error("isFragment = true; want false")
+			}
+			b, _, ok := d.parse(tt.pkt)
+			if !ok || string(b) != string(udp) {
+				t.Errorf("parse = % x, %v; want % x", b, ok, udp)
+			}
+			if tt.isIPv6 {
+				if got := binary.BigEndian.Uint32(tt.pkt[d.linkHdrLenOf(tt.pkt):]) & ipv6FlowLabelMask; got != 0xabccd {
+					t.Errorf("flow label = %#x; want 0xabccd", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRawDiscoInterfacesStale(t *testing.T) {
+	type iface struct {
+		name  string
+		flags net.Flags
+		pfxs  []netip.Prefix
+	}
+	up := net.FlagUp
+	v4 := []netip.Prefix{netip.MustParsePrefix("192.0.2.1/24")}
+	v6 := []netip.Prefix{netip.MustParsePrefix("2001:db8::1/64")}
+	var ifaces []iface
+	old := rawDiscoForeachInterface
+	defer func() { rawDiscoForeachInterface = old }()
+	rawDiscoForeachInterface = func(fn func(interfaces.Interface, []netip.Prefix)) error {
+		for i, ifc := range ifaces {
+			fn(interfaces.Interface{Interface: &net.Interface{Index: i + 1, Name: ifc.name, Flags: ifc.flags}}, ifc.pfxs)
+		}
+		return nil
+	}
+	lo0 := iface{"lo0", up | net.FlagLoopback, append(v4, v6...)}
+	en0 := iface{"en0", up, v4}
+	// The receivers started with devices on these, for IPv4 failing
+	// to open one on utun0.
+	opened := map[string][]string{
+		"ip4": {"lo0", "en0"},
+		"ip6": {"lo0"},
+	}
+	started := []iface{lo0, en0, {"utun0", up, v4}}
+
+	for _, tt := range []struct {
+		name   string
+		iface  string // rawDiscoIface
+		family string
+		now    []iface
+		drop   string // interface whose device was dropped
+		want   bool
+	}{
+		{"unchanged", "", "ip4", started, "", false},
+		{"removed", "", "ip4", []iface{lo0}, "", false},
+		{"added", "", "ip4", append(started, iface{"en1", up, v4}), "", true},
+		{"added_down", "", "ip4", append(started, iface{"en1", 0, v4}), "", false},
+		{"added_other_family", "", "ip4", append(started, iface{"en1", up, v6}), "", false},
+		{"gained_address", "", "ip6", []iface{lo0, {"en0", up, append(v4, v6...)}}, "", true},
+		{"added_not_chosen", "en0", "ip4", append(started, iface{"en1", up, v4}), "", false},
+		{"added_chosen", "en1", "ip4", append(started, iface{"en1", up, v4}), "", true},
+		{"dropped", "", "ip4", []iface{lo0}, "en0", false},
+		{"dropped_and_back", "", "ip4", started, "en0", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn()
+			c.logf = t.Logf
+			c.rawDiscoIface = tt.iface
+			ifaces = tt.now
+			rc := &bpfReceiver{}
+			if tt.family == "ip4" {
+				rc.unopened = []string{"utun0"}
+			}
+			for _, name := range opened[tt.family] {
+				rc.devs = append(rc.devs, &bpfDevice{ifName: name})
+			}
+			if tt.drop != "" {
+				i := slices.IndexFunc(rc.devs, func(d *bpfDevice) bool { return d.ifName == tt.drop })
+				rc.drop(rc.devs[i])
+			}
+			if got := c.rawDiscoInterfacesStale(rc, tt.family); got != tt.want {
+				t.Errorf("rawDiscoInterfacesStale = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBPFAccessError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{unix.EACCES, true},
+		{unix.EPERM, true},
+		{unix.ENOENT, true},
+		{unix.EBUSY, false},
+		{fmt.Errorf("BIOCSETIF: %w", unix.ENXIO), false},
+		{fmt.Errorf("BIOCSETIF: %w", unix.EPERM), true},
+	} {
+		if got := isBPFAccessError(tt.err); got != tt.want {
+			t.Errorf("isBPFAccessError(%v) = %v; want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBPFReceiverDrop(t *testing.T) {
+	var files []*os.File
+	r := &bpfReceiver{}
+	for _, name := range []string{"lo0", "en0"} {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pw.Close()
+		files = append(files, pr)
+		r.devs = append(r.devs, &bpfDevice{f: pr, ifName: name})
+	}
+	lo0, en0 := r.devs[0], r.devs[1]
+	if left := r.drop(en0); left != 1 {
+		t.Errorf("after dropping en0, %d devices left; want 1", left)
+	}
+	if _, err := files[1].Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("dropped device not closed: read err = %v", err)
+	}
+	if left := r.drop(en0); left != 1 {
+		t.Errorf("after dropping en0 again, %d devices left; want 1", left)
+	}
+	if got := r.rawDiscoSockets("ip4"); len(got) != 1 || got[0].Interface != "lo0" {
+		t.Errorf("sockets after drop = %+v; want lo0's", got)
+	}
+	r.Close()
+	if _, err := files[0].Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("remaining device not closed with receiver: read err = %v", err)
+	}
+	if left := r.drop(lo0); left != 0 {
+		t.Errorf("closed receiver has %d devices left", left)
+	}
+}
+
+func TestReceiveDiscoBPFCancel(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	_, _, wantErr := conn.rawDisco4.status()
+
+	// Returns on cancellation, leaving the device open.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	d := &bpfDevice{f: pr, ifName: "en0", buf: make([]byte, 64)}
+	r := &bpfReceiver{devs: bpfDevices{d}}
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		conn.receiveDiscoBPF(ctx, r, d, "ip4")
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiveDiscoBPF didn't return on cancel")
+	}
+	if _, _, err := conn.rawDisco4.status(); err != wantErr {
+		t.Errorf("cancel recorded as failure: %v", err)
+	}
+	if got := r.ifNames(); len(got) != 1 {
+		t.Errorf("after cancel, capturing on %q; want en0 still", got)
+	}
+}
+
+func TestIsBPFDeviceGoneError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&os.PathError{Op: "read", Path: "/dev/bpf", Err: unix.ENXIO}, true},
+		{&os.PathError{Op: "read", Path: "/dev/bpf", Err: unix.EIO}, true},
+		{&os.PathError{Op: "read", Path: "/dev/bpf", Err: unix.ENETDOWN}, true},
+		{&os.PathError{Op: "read", Path: "/dev/bpf", Err: unix.EINVAL}, false},
+		{os.ErrClosed, false},
+	} {
+		if got := isBPFDeviceGoneError(tt.err); got != tt.want {
+			t.Errorf("isBPFDeviceGoneError(%v) = %v; want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -2,16 +2,40 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build !linux
+//go:build !linux && (!darwin || ios) && !freebsd && !windows
 // +build !linux
+// +build !darwin ios
+// +build !freebsd
+// +build !windows
 
 package magicsock
 
 import (
-	"errors"
+	"fmt"
 	"io"
 )
 
-func (c *Conn) listenRawDisco(family string) (io.Closer, error) {
-	return nil, errors.New("raw disco listening not supported on this OS")
+// listenRawDisco and setRawDiscoPort are all Conn needs from a
+// platform's raw disco implementation, and it calls them everywhere,
+// handling ErrRawDiscoUnsupported like any other failure to start. How
+// a platform filters (setBPF on Linux, BPF devices on the BSDs) stays
+// within its own files, so adding one is a matter of replacing these.
+// rawDiscoInterfacesStale only matters where receivers capture per
+// interface, and injectRawDiscoTestPacket is only for CI; both can
+// stay as they are.
+
+func (c *Conn) listenRawDisco(family string, port uint16) (io.Closer, error) {
+	return nil, fmt.Errorf("%w on this OS", ErrRawDiscoUnsupported)
+}
+
+func setRawDiscoPort(rc io.Closer, family string, port uint16) error {
+	return fmt.Errorf("%w on this OS", ErrRawDiscoUnsupported)
+}
+
+func (c *Conn) rawDiscoInterfacesStale(rc io.Closer, family string) bool {
+	return false
+}
+
+func injectRawDiscoTestPacket(family, ifName string) error {
+	return fmt.Errorf("%w on this OS", ErrRawDiscoUnsupported)
 }
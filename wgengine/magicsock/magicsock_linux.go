@@ -6,257 +6,878 @@
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"net"
 	"net/netip"
+	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
 	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 	"tailscale.com/envknob"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netns"
-	"tailscale.com/types/key"
-)
-
-const (
-	udpHeaderSize          = 8
-	ipv6FragmentHeaderSize = 8
-)
-
-// Enable/disable using raw sockets to receive disco traffic.
-var debugDisableRawDisco = envknob.RegisterBool("TS_DEBUG_DISABLE_RAW_DISCO")
-
-// These are our BPF filters that we use for testing packets.
-var (
-	magicsockFilterV4 = []bpf.Instruction{
-		// For raw UDPv4 sockets, BPF receives the entire IP packet to
-		// inspect.
-
-		// Disco packets are so small they should never get
-		// fragmented, and we don't want to handle reassembly.
-		bpf.LoadAbsolute{Off: 6, Size: 2},
-		// More Fragments bit set means this is part of a fragmented packet.
-		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x2000, SkipTrue: 7, SkipFalse: 0},
-		// Non-zero fragment offset with MF=0 means this is the last
-		// fragment of packet.
-		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6, SkipFalse: 0},
-
-		// Load IP header length into X register.
-		bpf.LoadMemShift{Off: 0},
-
-		// Get the first 4 bytes of the UDP packet, compare with our magic number
-		bpf.LoadIndirect{Off: udpHeaderSize, Size: 4},
-		bpf.JumpIf{Cond: bpf.JumpEqual, Val: discoMagic1, SkipTrue: 0, SkipFalse: 3},
-
-		// Compare the next 2 bytes
-		bpf.LoadIndirect{Off: udpHeaderSize + 4, Size: 2},
-		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(discoMagic2), SkipTrue: 0, SkipFalse: 1},
-
-		// Accept the whole packet
-		bpf.RetConstant{Val: 0xFFFFFFFF},
-
-		// Skip the packet
-		bpf.RetConstant{Val: 0x0},
-	}
-
-	// IPv6 is more complicated to filter, since we can have 0-to-N
-	// extension headers following the IPv6 header. Since BPF can't
-	// loop, we can't really parse these in a general way; instead, we
-	// simply handle the case where we have no extension headers; any
-	// packets with headers will be skipped. IPv6 extension headers
-	// are sufficiently uncommon that we're willing to accept false
-	// negatives here.
-	//
-	// The "proper" way to handle this would be to do minimal parsing in
-	// BPF and more in-depth parsing of all IPv6 packets in userspace, but
-	// on systems with a high volume of UDP that would be unacceptably slow
-	// and thus we'd rather be conservative here and possibly not receive
-	// disco packets rather than slow down the system.
-	magicsockFilterV6 = []bpf.Instruction{
-		// For raw UDPv6 sockets, BPF receives _only_ the UDP header onwards, not an entire IP packet.
-		//
-		//    https://stackoverflow.com/questions/24514333/using-bpf-with-sock-dgram-on-linux-machine
-		//    https://blog.cloudflare.com/epbf_sockets_hop_distance/
-		//
-		// This is especially confusing because this *isn't* true for
-		// IPv4; see the following code from the 'ping' utility that
-		// corroborates this:
-		//
-		//    https://github.com/iputils/iputils/blob/1ab5fa/ping/ping.c#L1667-L1676
-		//    https://github.com/iputils/iputils/blob/1ab5fa/ping/ping6_common.c#L933-L941
-
-		// Compare with our magic number. Start by loading and
-		// comparing the first 4 bytes of the UDP payload.
-		bpf.LoadAbsolute{Off: udpHeaderSize, Size: 4},
-		bpf.JumpIf{Cond: bpf.JumpEqual, Val: discoMagic1, SkipTrue: 0, SkipFalse: 3},
-
-		// Compare the next 2 bytes
-		bpf.LoadAbsolute{Off: udpHeaderSize + 4, Size: 2},
-		bpf.JumpIf{Cond: bpf.JumpEqual, Val: discoMagic2, SkipTrue: 0, SkipFalse: 1},
-
-		// Accept the whole packet
-		bpf.RetConstant{Val: 0xFFFFFFFF},
-
-		// Skip the packet
-		bpf.RetConstant{Val: 0x0},
-	}
-
-	testDiscoPacket = []byte{
-		// Disco magic
-		0x54, 0x53, 0xf0, 0x9f, 0x92, 0xac,
-		// Sender key
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		// Nonce
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-	}
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/endian"
 )
 
 // listenRawDisco starts listening for disco packets on the given
 // address family, which must be "ip4" or "ip6", using a raw socket
 // and BPF filter.
 // https://github.com/tailscale/tailscale/issues/3824
-func (c *Conn) listenRawDisco(family string) (io.Closer, error) {
-	if debugDisableRawDisco() {
-		return nil, errors.New("raw disco listening disabled by debug flag")
+func (c *Conn) listenRawDisco(family string, port uint16) (_ io.Closer, err error) {
+	if rawDiscoDisabled(family) {
+		return nil, ErrRawDiscoDisabled
 	}
 
 	// https://github.com/tailscale/tailscale/issues/5607
+	//
+	// The raw socket itself is never marked, nor could a custom mark
+	// help it: a socket's mark only applies to packets it sends, which
+	// is what fwmark policy routing and mark-matching firewall rules
+	// see, and this one only receives. Inbound packets go through
+	// netfilter before delivery to any socket, raw or not, whatever
+	// its mark. What this checks is that the host supports the marking
+	// our regular sockets rely on.
 	if !netns.UseSocketMark() {
-		return nil, errors.New("raw disco listening disabled, SO_MARK unavailable")
+		return nil, fmt.Errorf("%w: SO_MARK unavailable", ErrRawDiscoUnsupported)
 	}
 
-	var (
-		network  string
-		addr     string
-		testAddr string
-		prog     []bpf.Instruction
-	)
+	var network, addr string
 	switch family {
 	case "ip4":
 		network = "ip4:17"
 		addr = "0.0.0.0"
-		testAddr = "127.0.0.1:1"
-		prog = magicsockFilterV4
 	case "ip6":
 		network = "ip6:17"
 		addr = "::"
-		testAddr = "[::1]:1"
-		prog = magicsockFilterV6
 	default:
-		return nil, fmt.Errorf("unsupported address family %q", family)
+		return nil, fmt.Errorf("%w: address family %q", ErrRawDiscoUnsupported, family)
 	}
 
-	asm, err := bpf.Assemble(prog)
+	prog, custom, err := rawDiscoFilter(family, port)
 	if err != nil {
-		return nil, fmt.Errorf("assembling filter: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrRawDiscoBPFInstall, err)
+	}
+	if custom {
+		c.logf("disco raw: using custom %v filter of %d instructions", family, len(prog))
+	}
+	asm, err := assembleBPF(prog)
+	if err != nil {
+		return nil, fmt.Errorf("%w: assembling filter: %v", ErrRawDiscoBPFInstall, err)
 	}
 
-	pc, err := net.ListenPacket(network, addr)
+	var lc net.ListenConfig
+	if c.rawDiscoIface != "" {
+		lc.Control = bindToDevice(c.rawDiscoIface)
+	}
+	pc, err := listenRawDiscoPacket(&lc, network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("creating packet conn: %w", err)
 	}
+	defer closeOnError(pc, &err)
 
 	if err := setBPF(pc, asm); err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("installing BPF filter: %w", err)
+		return nil, bpfInstallError(err)
+	}
+	// Check the kernel kept the filter as given. Kernels too old for
+	// SO_GET_FILTER get the benefit of the doubt (the self-test still
+	// has a say).
+	if n, err := attachedBPFLen(pc); err != nil {
+		c.logf("[v1] disco raw: can't verify %v filter: %v", family, err)
+	} else if n != len(asm) {
+		return nil, fmt.Errorf("%w: kernel has a %d instruction filter attached, not our %d", ErrRawDiscoBPFInstall, n, len(asm))
+	} else {
+		c.rawDiscoState(family).noteFilterLen(n)
+	}
+	c.setRawDiscoReadBuffer(pc, family)
+	if err := enableRawDiscoTimestamps(pc); err != nil {
+		c.logf("[v1] disco raw: no %v receive timestamps: %v", family, err)
+	}
+	if debugRawDiscoHWTimestamps() {
+		if err := enableRawDiscoHWTimestamps(pc); err != nil {
+			c.logf("disco raw: no %v hardware receive timestamps: %v", family, err)
+		}
+	}
+	if err := enableRawDiscoDropCounts(pc); err != nil {
+		c.logf("[v1] disco raw: no %v kernel drop counts: %v", family, err)
+	}
+	if err := enableRawDiscoPktInfo(pc, family == "ip6"); err != nil {
+		c.logf("[v1] disco raw: no %v arrival interfaces: %v", family, err)
+	}
+	if family == "ip6" {
+		if err := enableRawDiscoFlowInfo(pc); err != nil {
+			c.logf("[v1] disco raw: no IPv6 flow labels: %v", err)
+		}
 	}
 
 	// If all the above succeeds, we should be ready to receive. Just
 	// out of paranoia, check that we do receive a well-formed disco
-	// packet.
-	tc, err := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+	// packet, unless we can't.
+	if why := c.rawDiscoSkipSelfTest(); why == "" {
+		rtt, err := rawDiscoSelfTest(pc, family)
+		c.noteRawDiscoSelfTest(family, rtt, err)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.logf("disco raw: skipping %v self-test: %s", family, why)
+	}
+
+	for i, n := 0, rawDiscoReaders(); i < n; i++ {
+		i := i
+		c.goRawDiscoReader(func() { c.receiveDisco(c.connCtx, pc, family, i) })
+	}
+	return pc, nil
+}
+
+// bindToDevice returns a net.ListenConfig.Control func that binds the
+// socket to the interface ifName with SO_BINDTODEVICE, so that it only
+// receives packets arriving on it.
+func bindToDevice(ifName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("setting SO_BINDTODEVICE to %s: %w", ifName, sockErr)
+		}
+		return nil
+	}
+}
+
+// maxRawDiscoReaders bounds TS_DEBUG_RAW_DISCO_READERS.
+const maxRawDiscoReaders = 16
+
+// rawDiscoReaders returns how many receiveDisco goroutines read from
+// each raw disco socket: 1, unless TS_DEBUG_RAW_DISCO_READERS
+// overrides it for hosts with very high disco volume.
+//
+// They all read from the one socket, the kernel handing each datagram
+// to just one of them. Opening several sockets with SO_REUSEPORT
+// instead wouldn't spread the load: that balances sockets bound to a
+// port, while every raw socket gets its own copy of each packet its
+// filter accepts.
+//
+// Nor is there a PACKET_FANOUT group, which would spread packets over
+// sockets by flow, keeping each peer's on one reader: that's only for
+// AF_PACKET sockets, which capture packets on the link ahead of the
+// firewall, and which this deliberately doesn't use when a raw socket,
+// which netfilter's INPUT chain comes before, will do (see
+// rawDiscoState). Nothing here needs a peer's packets on one reader
+// anyway, as handleDiscoMessage serializes on Conn.mu.
+func rawDiscoReaders() int {
+	if n, ok := envknob.LookupInt("TS_DEBUG_RAW_DISCO_READERS"); ok && n >= 1 && n <= maxRawDiscoReaders {
+		return n
+	}
+	return 1
+}
+
+// defaultRawDiscoReadBuffer is the SO_RCVBUF size requested for raw
+// disco sockets, so that bursts of disco in large tailnets aren't
+// dropped by the kernel before receiveDisco gets to them.
+const defaultRawDiscoReadBuffer = 1 << 20
+
+// rawDiscoReadBuffer returns the SO_RCVBUF size to request for raw
+// disco sockets: defaultRawDiscoReadBuffer, unless
+// TS_DEBUG_RAW_DISCO_RCVBUF overrides it.
+func rawDiscoReadBuffer() int {
+	if n, ok := envknob.LookupInt("TS_DEBUG_RAW_DISCO_RCVBUF"); ok && n > 0 {
+		return n
+	}
+	return defaultRawDiscoReadBuffer
+}
+
+// setRawDiscoReadBuffer sets the receive buffer of pc, a raw disco
+// socket for family, to rawDiscoReadBuffer, logging what the kernel
+// granted: Linux doubles the request for its bookkeeping, and caps it
+// at net.core.rmem_max. Failing to is no reason not to use pc.
+func (c *Conn) setRawDiscoReadBuffer(pc net.PacketConn, family string) {
+	ipc, ok := pc.(*net.IPConn)
+	if !ok {
+		return
+	}
+	want := rawDiscoReadBuffer()
+	if err := ipc.SetReadBuffer(want); err != nil {
+		c.logf("disco raw: setting %v receive buffer to %d: %v", family, want, err)
+		return
+	}
+	rc, err := ipc.SyscallConn()
+	if err != nil {
+		return
+	}
+	var got int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		got, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil || sockErr != nil {
+		return
+	}
+	c.logf("[v1] disco raw: %v receive buffer is %d bytes (asked for %d)", family, got, want)
+}
+
+// setRawDiscoSockopt sets the integer socket option opt at level to val
+// on pc, a raw socket from listenRawDisco.
+func setRawDiscoSockopt(pc net.PacketConn, level, opt, val int) error {
+	ipc, ok := pc.(*net.IPConn)
+	if !ok {
+		return fmt.Errorf("unsupported conn type %T", pc)
+	}
+	rc, err := ipc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, val)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// enableRawDiscoTimestamps turns on SO_TIMESTAMPNS on pc, so that the
+// kernel reports when each datagram arrived, for disco latencies
+// unaffected by how soon receiveDisco gets scheduled. These are
+// software timestamps; hardware ones would need the NIC configured
+// for them too, for little more precision than disco needs.
+func enableRawDiscoTimestamps(pc net.PacketConn) error {
+	return setRawDiscoSockopt(pc, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+}
+
+// debugRawDiscoHWTimestamps makes the raw disco receivers ask for
+// hardware receive timestamps, for analyzing path latency and clock
+// skew more precisely than software ones allow. See
+// enableRawDiscoHWTimestamps.
+var debugRawDiscoHWTimestamps = envknob.RegisterBool("TS_DEBUG_RAW_DISCO_HW_TIMESTAMPS")
+
+// enableRawDiscoHWTimestamps asks with SO_TIMESTAMPING for pc's
+// datagrams to come with the time the NIC they arrived on received
+// them, by its hardware clock.
+//
+// The NIC only timestamps them if its driver can and it's been told
+// to, by SIOCSHWTSTAMP. That's for whoever runs the NIC's clock, such
+// as ptp4l, to do, as it applies to all of the NIC's traffic; here
+// only the timestamps already being taken are picked up. Datagrams
+// without one fall back to the software timestamp (see
+// enableRawDiscoTimestamps) or the read time, as before.
+func enableRawDiscoHWTimestamps(pc net.PacketConn) error {
+	return setRawDiscoSockopt(pc, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, unix.SOF_TIMESTAMPING_RX_HARDWARE|unix.SOF_TIMESTAMPING_RAW_HARDWARE)
+}
+
+// enableRawDiscoDropCounts turns on SO_RXQ_OVFL on pc, so that each
+// datagram read comes with the number of datagrams the kernel has
+// dropped for want of room in pc's receive buffer. Those the filter
+// rejected aren't counted, so there's no telling from this how much
+// the filter is saving us; only that we're falling behind.
+func enableRawDiscoDropCounts(pc net.PacketConn) error {
+	return setRawDiscoSockopt(pc, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+}
+
+// enableRawDiscoPktInfo turns on IP_PKTINFO, or IPV6_RECVPKTINFO if
+// isIPv6, on pc, so that each datagram read comes with the index of
+// the interface it arrived on.
+func enableRawDiscoPktInfo(pc net.PacketConn, isIPv6 bool) error {
+	if isIPv6 {
+		return setRawDiscoSockopt(pc, unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+	}
+	return setRawDiscoSockopt(pc, unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+}
+
+// ipv6FlowInfo is IPV6_FLOWINFO, from linux/in6.h, which
+// golang.org/x/sys/unix doesn't have. Set, it turns on the control
+// message of the same type.
+const ipv6FlowInfo = 11
+
+// enableRawDiscoFlowInfo turns on IPV6_FLOWINFO on pc, an IPv6 raw
+// socket, so that each datagram read comes with the flow information
+// from its IPv6 header, which the socket otherwise strips along with
+// the rest of it.
+func enableRawDiscoFlowInfo(pc net.PacketConn) error {
+	return setRawDiscoSockopt(pc, unix.IPPROTO_IPV6, ipv6FlowInfo, 1)
+}
+
+// attachedBPFLen returns the number of instructions in the BPF filter
+// attached to pc, as reported by SO_GET_FILTER, or 0 if none is.
+func attachedBPFLen(pc net.PacketConn) (int, error) {
+	ipc, ok := pc.(*net.IPConn)
+	if !ok {
+		return 0, fmt.Errorf("unsupported conn type %T", pc)
+	}
+	rc, err := ipc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	// With a zero length, SO_GET_FILTER returns the filter's length
+	// in instructions in place of the filter.
+	var n uint32
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_SOCKET, unix.SO_GET_FILTER, 0, uintptr(unsafe.Pointer(&n)), 0)
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// setRawDiscoPort replaces the BPF filter of rc, a receiver for family
+// returned by listenRawDisco, with one accepting disco for port. The
+// kernel swaps filters atomically, so no packets are lost meanwhile.
+func setRawDiscoPort(rc io.Closer, family string, port uint16) error {
+	pc, ok := rc.(net.PacketConn)
+	if !ok {
+		return fmt.Errorf("unexpected raw disco receiver %T", rc)
+	}
+	prog, custom, err := rawDiscoFilter(family, port)
 	if err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("creating disco test socket: %w", err)
+		return fmt.Errorf("%w: %v", ErrRawDiscoBPFInstall, err)
+	}
+	if custom {
+		// It's not for any port in particular, so stays put.
+		return nil
+	}
+	asm, err := assembleBPF(prog)
+	if err != nil {
+		return fmt.Errorf("%w: assembling filter: %v", ErrRawDiscoBPFInstall, err)
+	}
+	if err := setBPF(pc, asm); err != nil {
+		return bpfInstallError(err)
+	}
+	return nil
+}
+
+// rawDiscoInterfacesStale reports false: a raw socket receives from
+// every interface, including ones that come up after it's opened.
+func (c *Conn) rawDiscoInterfacesStale(rc io.Closer, family string) bool {
+	return false
+}
+
+// bpfInstallErrno classifies err, from setBPF, by its errno, for
+// metricRawDiscoBPFInstallFail: "eperm" (or EACCES) for a missing
+// capability or a seccomp or LSM policy against it, "enosys" (or
+// ENOPROTOOPT) for a kernel without socket filters, "einval" for a
+// program the kernel rejected, "enomem" for one over its optmem limit,
+// and "other" for anything else, including failures without an errno.
+func bpfInstallErrno(err error) string {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return "other"
 	}
-	defer tc.Close()
-	if _, err := tc.(*net.UDPConn).WriteToUDPAddrPort(testDiscoPacket, netip.MustParseAddrPort(testAddr)); err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("writing disco test packet: %w", err)
+	switch errno {
+	case unix.EPERM, unix.EACCES:
+		return "eperm"
+	case unix.ENOSYS, unix.ENOPROTOOPT:
+		return "enosys"
+	case unix.EINVAL:
+		return "einval"
+	case unix.ENOMEM:
+		return "enomem"
 	}
-	pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-	var buf [1500]byte
+	return "other"
+}
+
+// bpfInstallError counts err, from setBPF, by its errno, and returns it
+// as an ErrRawDiscoBPFInstall saying which it was counted as, for
+// whoever logs it.
+func bpfInstallError(err error) error {
+	class := bpfInstallErrno(err)
+	metricRawDiscoBPFInstallFail[class].Add(1)
+	return fmt.Errorf("%w: %v (%s)", ErrRawDiscoBPFInstall, err, class)
+}
+
+// rawDiscoSelfTest checks that a disco packet sent to loopback is
+// received on pc, returning how long that took. Whatever the outcome,
+// it leaves pc without a read deadline, for receiveDisco.
+func rawDiscoSelfTest(pc net.PacketConn, family string) (time.Duration, error) {
+	start := time.Now()
+	if err := writeRawDiscoTestPacket(family); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrRawDiscoSelfTestWrite, err)
+	}
+	pc.SetReadDeadline(time.Now().Add(rawDiscoSelfTestTimeout()))
+	defer pc.SetReadDeadline(time.Time{})
+	pool := rawDiscoBufPoolFor(family == "ip6")
+	bufp := pool.Get().(*[]byte)
+	defer pool.Put(bufp)
+	buf := *bufp
 	for {
-		n, _, err := pc.ReadFrom(buf[:])
+		n, _, err := pc.ReadFrom(buf)
 		if err != nil {
-			pc.Close()
-			return nil, fmt.Errorf("reading during raw disco self-test: %w", err)
+			return 0, fmt.Errorf("%w: %v", ErrRawDiscoSelfTestTimeout, err)
 		}
 		if n < udpHeaderSize {
+			metricRecvDiscoRawShort.Add(1)
 			continue
 		}
-		if !bytes.Equal(buf[udpHeaderSize:n], testDiscoPacket) {
-			continue
+		if bytes.Equal(buf[udpHeaderSize:n], testDiscoPacket) {
+			return time.Since(start), nil
 		}
-		break
 	}
-	pc.SetReadDeadline(time.Time{})
+}
 
-	go c.receiveDisco(pc, family == "ip6")
-	return pc, nil
+// injectRawDiscoTestPacket sends testDiscoPacket over family out of
+// the interface ifName, for TS_DEBUG_RAW_DISCO_TEST_INTERFACE. It's
+// for CI with one end of a veth pair given to it and the raw disco
+// receivers bound to the other with TS_DEBUG_RAW_DISCO_INTERFACE: the
+// packet then arrives from a real link, through the framing and
+// offsets that loopback skips.
+//
+// It's written with an AF_PACKET socket, to the broadcast (IPv4) or
+// all-nodes (IPv6) address from the unspecified one, which the far end
+// delivers locally without knowing its addresses, and without the
+// reverse path or martian checks a spoofed unicast source is subject
+// to. Nothing listens on rawDiscoTestPort, so only the raw sockets
+// take it.
+func injectRawDiscoTestPacket(family, ifName string) error {
+	ifc, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("disco test interface: %w", err)
+	}
+	var (
+		pkt   []byte
+		proto uint16
+		dst   [8]byte
+	)
+	switch family {
+	case "ip4":
+		pkt = packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: netip.IPv4Unspecified(), Dst: netip.AddrFrom4([4]byte{255, 255, 255, 255})},
+			SrcPort:   rawDiscoTestPort,
+			DstPort:   rawDiscoTestPort,
+		}, testDiscoPacket)
+		proto = unix.ETH_P_IP
+		dst = [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	case "ip6":
+		pkt = packet.Generate(packet.UDP6Header{
+			IP6Header: packet.IP6Header{Src: netip.IPv6Unspecified(), Dst: netip.IPv6LinkLocalAllNodes()},
+			SrcPort:   rawDiscoTestPort,
+			DstPort:   rawDiscoTestPort,
+		}, testDiscoPacket)
+		proto = unix.ETH_P_IPV6
+		dst = [8]byte{0x33, 0x33, 0, 0, 0, 1}
+	default:
+		return fmt.Errorf("%w: address family %q", ErrRawDiscoUnsupported, family)
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(proto)))
+	if err != nil {
+		return fmt.Errorf("creating disco test socket: %w", err)
+	}
+	defer unix.Close(fd)
+	sa := &unix.SockaddrLinklayer{Protocol: htons(proto), Ifindex: ifc.Index, Halen: 6, Addr: dst}
+	if err := unix.Sendto(fd, pkt, 0, sa); err != nil {
+		return fmt.Errorf("writing disco test packet to %s: %w", ifName, err)
+	}
+	return nil
 }
 
-func (c *Conn) receiveDisco(pc net.PacketConn, isIPV6 bool) {
-	var buf [1500]byte
-	for {
-		n, src, err := pc.ReadFrom(buf[:])
-		if errors.Is(err, net.ErrClosed) {
-			return
-		} else if err != nil {
-			c.logf("disco raw reader failed: %v", err)
+// htons converts v to network byte order.
+func htons(v uint16) uint16 {
+	if endian.Big {
+		return v
+	}
+	return bits.ReverseBytes16(v)
+}
+
+// rawDiscoBatchSize is the maximum number of datagrams receiveDisco
+// reads per recvmmsg call.
+const rawDiscoBatchSize = 8
+
+var (
+	rawDiscoBufSizeOnce sync.Once
+	rawDiscoBufSizeVal  int
+)
+
+// rawDiscoBufSize returns the size of the largest raw disco datagram,
+// from its UDP header onwards, that the self-test and receiveDisco
+// read in full. It's the largest MTU of any non-loopback interface, so
+// that jumbo frames aren't truncated, but at least 1500.
+// TS_DEBUG_RAW_DISCO_BUF_SIZE overrides it.
+//
+// It's computed once; buffers in rawDiscoBufPool4 and rawDiscoBufPool6
+// have this size plus rawDiscoHeadroom.
+func rawDiscoBufSize() int {
+	rawDiscoBufSizeOnce.Do(func() {
+		if n, ok := envknob.LookupInt("TS_DEBUG_RAW_DISCO_BUF_SIZE"); ok && n >= udpHeaderSize+len(testDiscoPacket) && n <= 1<<16 {
+			rawDiscoBufSizeVal = n
 			return
 		}
-		if n < udpHeaderSize {
-			// Too small to be a valid UDP datagram, drop.
-			continue
+		rawDiscoBufSizeVal = 1500
+		interfaces.ForeachInterface(func(i interfaces.Interface, _ []netip.Prefix) {
+			if !i.IsLoopback() && i.MTU > rawDiscoBufSizeVal {
+				rawDiscoBufSizeVal = i.MTU
+			}
+		})
+		if rawDiscoBufSizeVal > 1<<16 {
+			rawDiscoBufSizeVal = 1 << 16
 		}
+	})
+	return rawDiscoBufSizeVal
+}
 
-		dstPort := binary.BigEndian.Uint16(buf[2:4])
-		if dstPort == 0 {
-			c.logf("[unexpected] disco raw: received packet for port 0")
-		}
+// rawDiscoIPv4Headroom is the most room the IP header a raw IPv4
+// socket reads in front of each UDP header can take: ipv4.HeaderLen,
+// plus 40 bytes of options. recvmmsg leaves it there, and net.IPConn's
+// ReadFrom reads it into the buffer before stripping it, so both need
+// the room. A raw IPv6 socket reads from the UDP header on.
+const rawDiscoIPv4Headroom = 60
+
+// rawDiscoHeadroom returns how many bytes beyond rawDiscoBufSize
+// buffers for a raw socket of the family isIPv6 says need.
+func rawDiscoHeadroom(isIPv6 bool) int {
+	if isIPv6 {
+		return 0
+	}
+	return rawDiscoIPv4Headroom
+}
+
+// rawDiscoBufPool4 and rawDiscoBufPool6 hold *[]byte buffers of length
+// rawDiscoBufSize() plus rawDiscoHeadroom for IPv4 and IPv6, shared by
+// all raw disco readers so that running more of them (or restarting
+// them) doesn't cost fresh allocations each time.
+var (
+	rawDiscoBufPool4 = newRawDiscoBufPool(false)
+	rawDiscoBufPool6 = newRawDiscoBufPool(true)
+)
+
+func newRawDiscoBufPool(isIPv6 bool) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			b := make([]byte, rawDiscoBufSize()+rawDiscoHeadroom(isIPv6))
+			return &b
+		},
+	}
+}
+
+// rawDiscoBufPoolFor returns rawDiscoBufPool6 if isIPv6, and otherwise
+// rawDiscoBufPool4.
+func rawDiscoBufPoolFor(isIPv6 bool) *sync.Pool {
+	if isIPv6 {
+		return rawDiscoBufPool6
+	}
+	return rawDiscoBufPool4
+}
+
+// rawDiscoReader reads datagrams from a raw disco socket, using
+// recvmmsg to read up to rawDiscoBatchSize of them per syscall where
+// the kernel supports it.
+type rawDiscoReader struct {
+	pc     net.PacketConn
+	isIPv6 bool
+
+	// br reads batches of datagrams with recvmmsg. It's nil once
+	// recvmmsg has turned out to be unsupported, after which reads
+	// fall back to one ReadFrom per datagram.
+	br interface {
+		ReadBatch([]ipv4.Message, int) (int, error)
+	}
+	msgs []ipv4.Message // ipv4.Message and ipv6.Message are the same type
+	bufs []*[]byte      // from pool, backing msgs[i].Buffers[0]
+	pool *sync.Pool     // rawDiscoBufPoolFor(isIPv6)
+
+	// readAt and readWall are when the last read returned, on the
+	// monotonic and wall clocks, for converting the kernel's
+	// timestamps (see enableRawDiscoTimestamps) to mono.Time.
+	readAt   mono.Time
+	readWall time.Time
+}
 
-		var acceptPort uint16
-		if isIPV6 {
-			acceptPort = c.pconn6.Port()
-		} else {
-			acceptPort = c.pconn4.Port()
+// rawDiscoOOBSize is the size of the control message buffer for each
+// datagram read by rawDiscoReader, which only needs room for its
+// SO_TIMESTAMPNS timestamp, SO_TIMESTAMPING ones, SO_RXQ_OVFL drop
+// count, packet info, the IPv6 form of which is the larger, and IPv6
+// flow information.
+var rawDiscoOOBSize = unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))) + unix.CmsgSpace(int(unsafe.Sizeof(unix.ScmTimestamping{}))) + unix.CmsgSpace(4) + unix.CmsgSpace(unix.SizeofInet6Pktinfo) + unix.CmsgSpace(4)
+
+func newRawDiscoReader(pc net.PacketConn, isIPv6 bool) *rawDiscoReader {
+	r := &rawDiscoReader{
+		pc:     pc,
+		isIPv6: isIPv6,
+		msgs:   make([]ipv4.Message, rawDiscoBatchSize),
+		bufs:   make([]*[]byte, rawDiscoBatchSize),
+		pool:   rawDiscoBufPoolFor(isIPv6),
+	}
+	if isIPv6 {
+		r.br = ipv6.NewPacketConn(pc)
+	} else {
+		r.br = ipv4.NewPacketConn(pc)
+	}
+	for i := range r.msgs {
+		r.bufs[i] = r.pool.Get().(*[]byte)
+		r.msgs[i].Buffers = [][]byte{*r.bufs[i]}
+		r.msgs[i].OOB = make([]byte, rawDiscoOOBSize)
+	}
+	return r
+}
+
+// release returns r's buffers to their pool. r must not be used
+// afterwards.
+func (r *rawDiscoReader) release() {
+	for i, b := range r.bufs {
+		r.pool.Put(b)
+		r.bufs[i] = nil
+		r.msgs[i].Buffers = nil
+	}
+}
+
+// read blocks until it reads one or more datagrams, and reports how
+// many. They can then be fetched with datagram.
+func (r *rawDiscoReader) read() (int, error) {
+	defer func() {
+		r.readAt = mono.Now()
+		r.readWall = time.Now()
+	}()
+	if r.br != nil {
+		n, err := r.br.ReadBatch(r.msgs, 0)
+		if !errors.Is(err, unix.ENOSYS) {
+			return n, err
 		}
-		if acceptPort == 0 {
-			// This should only typically happen if the receiving address family
-			// was recently disabled.
-			c.dlogf("[v1] disco raw: dropping packet for port %d as acceptPort=0", dstPort)
+		r.br = nil
+	}
+	// On a raw IPv4 socket, ReadFrom (that is, net.IPConn) strips
+	// the IP header, options included, itself.
+	m := &r.msgs[0]
+	n, src, err := r.pc.ReadFrom(m.Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	m.N, m.Addr = n, src
+	return 1, nil
+}
+
+// datagram returns the ith datagram from the last call to read, from
+// its UDP header onwards, and its source address. The returned slice
+// aliases r's buffers and is only valid until the next call to read
+// (or release), so anything processing it asynchronously must copy it.
+//
+// truncated reports whether the datagram didn't fit in the buffer (or,
+// when falling back to ReadFrom, which doesn't say, might not have, as
+// it's at least rawDiscoBufSize long).
+func (r *rawDiscoReader) datagram(i int) (b []byte, src net.Addr, truncated bool) {
+	m := &r.msgs[i]
+	b = m.Buffers[0][:m.N]
+	if r.br != nil {
+		truncated = m.Flags&unix.MSG_TRUNC != 0
+	} else {
+		truncated = m.N >= len(m.Buffers[0])-rawDiscoHeadroom(r.isIPv6)
+	}
+	if r.br != nil && !r.isIPv6 {
+		// Unlike ReadFrom, ReadBatch on a raw IPv4 socket leaves the
+		// IP header (and any options) in front of the UDP header.
+		b = stripIPv4Header(b)
+	}
+	return b, m.Addr, truncated
+}
+
+// receivedAt returns when the ith datagram from the last call to read
+// arrived, going by its kernel timestamp if it has one, or else when
+// read returned. The ReadFrom fallback gets no timestamps.
+func (r *rawDiscoReader) receivedAt(i int) mono.Time {
+	m := &r.msgs[i]
+	if r.br == nil || m.NN == 0 {
+		return r.readAt
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return r.readAt
+	}
+	for _, cm := range cmsgs {
+		if cm.Header.Level != unix.SOL_SOCKET || cm.Header.Type != unix.SCM_TIMESTAMPNS || len(cm.Data) < int(unsafe.Sizeof(unix.Timespec{})) {
 			continue
 		}
+		ts := (*unix.Timespec)(unsafe.Pointer(&cm.Data[0]))
+		// The timestamp is on the wall clock. Should it have been
+		// stepped meanwhile, making the datagram seem to arrive
+		// after it was read, or implausibly long before, go with
+		// the read time instead.
+		delay := r.readWall.Sub(time.Unix(ts.Unix()))
+		if delay < 0 || delay > time.Second {
+			return r.readAt
+		}
+		return r.readAt.Add(-delay)
+	}
+	return r.readAt
+}
 
-		if dstPort != acceptPort {
-			c.dlogf("[v1] disco raw: dropping packet for port %d", dstPort)
+// hwTime returns the hardware timestamp of the ith datagram from the
+// last call to read (see enableRawDiscoHWTimestamps), or zero if it
+// has none.
+func (r *rawDiscoReader) hwTime(i int) time.Time {
+	m := &r.msgs[i]
+	if r.br == nil || m.NN == 0 {
+		return time.Time{}
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return time.Time{}
+	}
+	for _, cm := range cmsgs {
+		if cm.Header.Level != unix.SOL_SOCKET || cm.Header.Type != unix.SCM_TIMESTAMPING || len(cm.Data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
 			continue
 		}
+		// Of the three timestamps, the first is the software one,
+		// when asked for, and the last the raw hardware one.
+		ts := (*unix.ScmTimestamping)(unsafe.Pointer(&cm.Data[0])).Ts[2]
+		if ts.Sec == 0 && ts.Nsec == 0 {
+			return time.Time{}
+		}
+		return time.Unix(ts.Unix())
+	}
+	return time.Time{}
+}
 
-		srcIP, ok := netip.AddrFromSlice(src.(*net.IPAddr).IP)
-		if !ok {
-			c.logf("[unexpected] PacketConn.ReadFrom returned not-an-IP %v in from", src)
-			continue
+// kernelDrops returns the kernel's count of datagrams dropped by r's
+// socket, as of the ith datagram from the last call to read (see
+// enableRawDiscoDropCounts). The kernel only says once it's nonzero,
+// and the ReadFrom fallback doesn't hear it at all, so it may be 0
+// regardless.
+func (r *rawDiscoReader) kernelDrops(i int) uint32 {
+	m := &r.msgs[i]
+	if r.br == nil || m.NN == 0 {
+		return 0
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cmsgs {
+		if cm.Header.Level == unix.SOL_SOCKET && cm.Header.Type == unix.SO_RXQ_OVFL && len(cm.Data) >= 4 {
+			return *(*uint32)(unsafe.Pointer(&cm.Data[0]))
+		}
+	}
+	return 0
+}
+
+// ifIndex returns the index of the interface the ith datagram from the
+// last call to read arrived on (see enableRawDiscoPktInfo), or 0 if
+// unknown, as with the ReadFrom fallback.
+func (r *rawDiscoReader) ifIndex(i int) int {
+	m := &r.msgs[i]
+	if r.br == nil || m.NN == 0 {
+		return 0
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cmsgs {
+		switch {
+		case cm.Header.Level == unix.IPPROTO_IP && cm.Header.Type == unix.IP_PKTINFO && len(cm.Data) >= unix.SizeofInet4Pktinfo:
+			return int((*unix.Inet4Pktinfo)(unsafe.Pointer(&cm.Data[0])).Ifindex)
+		case cm.Header.Level == unix.IPPROTO_IPV6 && cm.Header.Type == unix.IPV6_PKTINFO && len(cm.Data) >= unix.SizeofInet6Pktinfo:
+			return int((*unix.Inet6Pktinfo)(unsafe.Pointer(&cm.Data[0])).Ifindex)
 		}
-		srcPort := binary.BigEndian.Uint16(buf[:2])
+	}
+	return 0
+}
 
-		if srcIP.Is4() {
-			metricRecvDiscoPacketIPv4.Add(1)
-		} else {
-			metricRecvDiscoPacketIPv6.Add(1)
+// flowLabel returns the IPv6 flow label of the ith datagram from the
+// last call to read (see enableRawDiscoFlowInfo), or zero if it had
+// none or r isn't reading IPv6.
+func (r *rawDiscoReader) flowLabel(i int) uint32 {
+	m := &r.msgs[i]
+	if r.br == nil || !r.isIPv6 || m.NN == 0 {
+		return 0
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cmsgs {
+		if cm.Header.Level == unix.IPPROTO_IPV6 && cm.Header.Type == ipv6FlowInfo && len(cm.Data) >= 4 {
+			// The traffic class and flow label, as in the header.
+			return binary.BigEndian.Uint32(cm.Data) & ipv6FlowLabelMask
+		}
+	}
+	return 0
+}
+
+// receiveDisco reads and handles the datagrams from pc, a raw disco
+// socket for family, until ctx is done or pc is closed. id tells its
+// log lines apart from those of the socket's other readers (see
+// rawDiscoReaders). The metrics don't: clientmetrics have no labels,
+// and a reader's share of its socket's packets isn't worth a metric
+// per reader. What it reads is counted in its own rawDiscoCounts,
+// only flushed to them and its rawDiscoState every
+// rawDiscoCountsFlushInterval.
+//
+// Ending with ctx leaves pc with a read deadline in the past, which
+// also applies to any other readers of it; closing pc is still up to
+// its owner.
+func (c *Conn) receiveDisco(ctx context.Context, pc net.PacketConn, family string, id int) {
+	counts := c.newRawDiscoCounts(family)
+	readDone := make(chan struct{})
+	defer close(readDone)
+	go func() {
+		t := time.NewTicker(rawDiscoCountsFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// Unblock the read in progress.
+				pc.SetReadDeadline(time.Unix(1, 0))
+				return
+			case <-readDone:
+				return
+			case <-t.C:
+				counts.flush()
+			}
 		}
+	}()
+	defer counts.flush()
 
-		c.handleDiscoMessage(buf[udpHeaderSize:n], netip.AddrPortFrom(srcIP, srcPort), key.NodePublic{})
+	r := newRawDiscoReader(pc, family == "ip6")
+	defer r.release()
+	transientErrs := 0
+	for {
+		n, err := r.read()
+		if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+			return
+		} else if err != nil && isTransientRawDiscoErr(err) && transientErrs < rawDiscoMaxTransientErrs {
+			transientErrs++
+			metricRecvDiscoRawRecvErrors.Add(1)
+			c.rawDiscoErrLogf(family)("disco raw %v reader %d: %v; continuing", family, id, err)
+			continue
+		} else if err != nil {
+			c.rawDiscoErrLogf(family)("disco raw %v reader %d failed: %v", family, id, err)
+			c.rawDiscoState(family).stopped(err)
+			c.logRawDiscoEvent(family, "fallback", err)
+			return
+		}
+		transientErrs = 0
+		if n == 0 {
+			// ReadBatch can return nothing without an error.
+			continue
+		}
+		if drops := r.kernelDrops(n - 1); drops > 0 {
+			c.rawDiscoState(family).noteKernelDrops(drops)
+		}
+		for i := 0; i < n; i++ {
+			buf, src, truncated := r.datagram(i)
+			if truncated {
+				// Cut short by the buffer size, so it won't
+				// authenticate; drop it, but keep count in case
+				// rawDiscoBufSize needs raising.
+				metricRecvDiscoRawTruncated.Add(1)
+				continue
+			}
+			c.handleRawDiscoDatagram(buf, src, family, rawDiscoRx{at: r.receivedAt(i), ifIndex: r.ifIndex(i), hwTime: r.hwTime(i), flowLabel: r.flowLabel(i), counts: counts})
+		}
 	}
 }
 
@@ -267,8 +888,18 @@ func (c *Conn) receiveDisco(pc net.PacketConn, isIPV6 bool) {
 // we might as well use it on both and get to use a net.PacketConn
 // directly for both families instead of being stuck with
 // different types.
+//
+// BSDs have no equivalent for sockets; there, filters are attached to
+// BPF devices instead, with setFilter.
 func setBPF(conn net.PacketConn, filter []bpf.RawInstruction) error {
-	sc, err := conn.(*net.IPConn).SyscallConn()
+	ipc, ok := conn.(*net.IPConn)
+	if !ok {
+		return fmt.Errorf("setBPF: unsupported conn type %T", conn)
+	}
+	if len(filter) == 0 {
+		return errors.New("setBPF: empty filter")
+	}
+	sc, err := ipc.SyscallConn()
 	if err != nil {
 		return err
 	}
@@ -284,7 +915,7 @@ func setBPF(conn net.PacketConn, filter []bpf.RawInstruction) error {
 		return err
 	}
 	if setErr != nil {
-		return err
+		return fmt.Errorf("SO_ATTACH_FILTER: %w", setErr)
 	}
 	return nil
 }
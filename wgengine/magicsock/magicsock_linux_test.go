@@ -0,0 +1,1683 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"tailscale.com/envknob"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/clientmetric"
+)
+
+// listenRawDiscoForTest opens a raw socket for network ("ip4:17" or
+// "ip6:17") with prog installed, skipping the test if raw sockets
+// aren't available.
+func listenRawDiscoForTest(t *testing.T, network, addr string, prog []bpf.Instruction) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	asm, err := bpf.Assemble(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setBPF(pc, asm); err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func TestRawDiscoIPv6ExtensionHeaders(t *testing.T) {
+	// PadN options padding each header out to 8 bytes. The kernel
+	// fills in the Next Header and length fields.
+	opts := string([]byte{0, 0, 1, 4, 0, 0, 0, 0})
+
+	tests := []struct {
+		name    string
+		sockopt []int
+	}{
+		{"none", nil},
+		{"hop-by-hop", []int{unix.IPV6_HOPOPTS}},
+		{"hop-by-hop+dstopts", []int{unix.IPV6_HOPOPTS, unix.IPV6_DSTOPTS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := listenRawDiscoForTest(t, "ip6:17", "::", magicsockFilterV6(rawDiscoMagics, 0))
+
+			uc, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+			if err != nil {
+				t.Skipf("no IPv6 loopback: %v", err)
+			}
+			defer uc.Close()
+			sc, err := uc.SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, opt := range tt.sockopt {
+				var setErr error
+				if err := sc.Control(func(fd uintptr) {
+					setErr = unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, opt, opts)
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if setErr != nil {
+					t.Fatalf("setting extension header %d: %v", opt, setErr)
+				}
+			}
+
+			dst := netip.AddrPortFrom(netip.IPv6Loopback(), 1)
+			if _, err := uc.WriteToUDPAddrPort(testDiscoPacket, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			var buf [1500]byte
+			for {
+				n, _, err := pc.ReadFrom(buf[:])
+				if err != nil {
+					t.Fatalf("disco packet not received: %v", err)
+				}
+				if n >= udpHeaderSize && bytes.Equal(buf[udpHeaderSize:n], testDiscoPacket) {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestRawDiscoIPv4Fragments(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer unix.Close(fd)
+
+	udp := make([]byte, udpHeaderSize+len(testDiscoPacket))
+	binary.BigEndian.PutUint16(udp[0:2], 1234) // src port
+	binary.BigEndian.PutUint16(udp[2:4], 1)    // dst port
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[udpHeaderSize:], testDiscoPacket)
+
+	// fragment returns an IPv4 packet to 127.0.0.1 carrying
+	// udp[off:off+len(data)]. Fragment offsets are in 8 byte units.
+	fragment := func(off int, data []byte, more bool) []byte {
+		h := make([]byte, 20, 20+len(data))
+		h[0] = 0x45 // version 4, IHL 5
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(h)+len(data)))
+		binary.BigEndian.PutUint16(h[4:6], 0x4242) // ID
+		frag := uint16(off / 8)
+		if more {
+			frag |= 0x2000
+		}
+		binary.BigEndian.PutUint16(h[6:8], frag)
+		h[8] = 64 // TTL
+		h[9] = unix.IPPROTO_UDP
+		copy(h[12:16], []byte{127, 0, 0, 1})
+		copy(h[16:20], []byte{127, 0, 0, 1})
+		return append(h, data...)
+	}
+	const split = 32
+	dst := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}
+	if err := unix.Sendto(fd, fragment(0, udp[:split], true), 0, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Sendto(fd, fragment(split, udp[split:], false), 0, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1500]byte
+	for {
+		n, _, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatalf("reassembled disco packet not received: %v", err)
+		}
+		if n >= udpHeaderSize && bytes.Equal(buf[udpHeaderSize:n], testDiscoPacket) {
+			return
+		}
+	}
+}
+
+// TestRawDiscoReaderIPv4Options checks that both ways of reading a raw
+// IPv4 socket return datagrams from the UDP header onwards, even when
+// the IP header carries options, up to the most it can, in front of a
+// datagram as large as rawDiscoBufSize allows.
+func TestRawDiscoReaderIPv4Options(t *testing.T) {
+	maxOpts := bytes.Repeat([]byte{1}, 40) // NOPs filling the largest IHL
+	big := make([]byte, rawDiscoBufSize()-udpHeaderSize)
+	copy(big, testDiscoPacket)
+	acceptAll := []bpf.Instruction{bpf.RetConstant{Val: 1<<16 - 1}} // the usual filter drops big
+	tests := []struct {
+		name    string
+		opts    []byte
+		payload []byte
+		filter  []bpf.Instruction
+	}{
+		{"options", []byte{1, 1, 1, 0}, testDiscoPacket, magicsockFilterV4(rawDiscoMagics, 0)}, // NOP, NOP, NOP, End of Options
+		{"max-options", maxOpts, testDiscoPacket, magicsockFilterV4(rawDiscoMagics, 0)},
+		{"max-options/max-size", maxOpts, big, acceptAll},
+	}
+	for _, tt := range tests {
+		pkt := ipv4Packet(tt.payload, tt.opts...)
+		if len(pkt) > 1<<16-1 {
+			t.Logf("%s: skipping, rawDiscoBufSize %d too large for one IPv4 packet", tt.name, rawDiscoBufSize())
+			continue
+		}
+		want := udpDatagram(1, tt.payload)
+		for _, batched := range []bool{true, false} {
+			pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", tt.filter)
+			fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+			if err != nil {
+				t.Skipf("raw sockets unavailable: %v", err)
+			}
+			defer unix.Close(fd)
+			if err := unix.Sendto(fd, pkt, 0, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			r := newRawDiscoReader(pc, false)
+			defer r.release()
+			if !batched {
+				r.br = nil
+			}
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			for found := false; !found; {
+				n, err := r.read()
+				if err != nil {
+					t.Fatalf("%s: batched=%v: %v", tt.name, batched, err)
+				}
+				for i := 0; i < n; i++ {
+					b, _, truncated := r.datagram(i)
+					if !bytes.Equal(b, want) {
+						continue
+					}
+					found = true
+					if truncated && batched {
+						t.Errorf("%s: reported truncated", tt.name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRawDiscoReaderBufSize(t *testing.T) {
+	for _, isIPv6 := range []bool{false, true} {
+		r := newRawDiscoReader(failingPacketConn{}, isIPv6)
+		want := rawDiscoBufSize()
+		if !isIPv6 {
+			want += rawDiscoIPv4Headroom
+		}
+		for i, m := range r.msgs {
+			if got := len(m.Buffers[0]); got != want {
+				t.Errorf("isIPv6=%v: buffer %d is %d bytes; want %d", isIPv6, i, got, want)
+			}
+		}
+
+		// Without recvmmsg, a datagram filling what's left of the
+		// buffer after any IP header might have been cut short.
+		r.br = nil
+		r.msgs[0].N = rawDiscoBufSize() - 1
+		if _, _, truncated := r.datagram(0); truncated {
+			t.Errorf("isIPv6=%v: datagram shorter than rawDiscoBufSize reported truncated", isIPv6)
+		}
+		r.msgs[0].N = rawDiscoBufSize()
+		if _, _, truncated := r.datagram(0); !truncated {
+			t.Errorf("isIPv6=%v: datagram of rawDiscoBufSize not reported as maybe truncated", isIPv6)
+		}
+		r.release()
+	}
+}
+
+func TestDiscoFilterMagics(t *testing.T) {
+	oldMagic := rawDiscoMagic{hi: discoMagic1, lo: discoMagic2, version: 1}
+	newMagic := rawDiscoMagic{hi: 0x01020304, lo: 0x0506, version: 2}
+	packetWithMagic := func(m rawDiscoMagic) []byte {
+		b := make([]byte, 6, len(testDiscoPacket))
+		binary.BigEndian.PutUint32(b[0:4], m.hi)
+		binary.BigEndian.PutUint16(b[4:6], m.lo)
+		return append(b, testDiscoPacket[6:]...)
+	}
+	bogus := packetWithMagic(rawDiscoMagic{hi: discoMagic1, lo: 0xffff})
+	stunResponse := stun.Response(stun.NewTxID(), netip.MustParseAddrPort("192.0.2.1:1234"))
+	stunRequest := stun.Request(stun.NewTxID())
+	encapMagic := oldMagic
+	encapMagic.offset = 8
+	encapPacket := append(make([]byte, 8), testDiscoPacket...)
+
+	tests := []struct {
+		name   string
+		magics []rawDiscoMagic
+		pkt    []byte
+		want   bool
+	}{
+		{"old-only/old", []rawDiscoMagic{oldMagic}, testDiscoPacket, true},
+		{"old-only/new", []rawDiscoMagic{oldMagic}, packetWithMagic(newMagic), false},
+		{"both/old", []rawDiscoMagic{oldMagic, newMagic}, testDiscoPacket, true},
+		{"both/new", []rawDiscoMagic{oldMagic, newMagic}, packetWithMagic(newMagic), true},
+		{"both/bogus", []rawDiscoMagic{oldMagic, newMagic}, bogus, false},
+		{"new-first/old", []rawDiscoMagic{newMagic, oldMagic}, testDiscoPacket, true},
+		{"new-first/bogus", []rawDiscoMagic{newMagic, oldMagic}, bogus, false},
+		{"stun/response", []rawDiscoMagic{oldMagic, rawDiscoSTUNMatch}, stunResponse, true},
+		{"stun/request", []rawDiscoMagic{oldMagic, rawDiscoSTUNMatch}, stunRequest, false},
+		{"stun/old", []rawDiscoMagic{oldMagic, rawDiscoSTUNMatch}, testDiscoPacket, true},
+		{"stun/bogus", []rawDiscoMagic{oldMagic, rawDiscoSTUNMatch}, bogus, false},
+		{"stun-first/old", []rawDiscoMagic{rawDiscoSTUNMatch, oldMagic}, testDiscoPacket, true},
+		{"old-only/stun", []rawDiscoMagic{oldMagic}, stunResponse, false},
+		{"encap/encap", []rawDiscoMagic{oldMagic, encapMagic}, encapPacket, true},
+		{"encap/old", []rawDiscoMagic{oldMagic, encapMagic}, testDiscoPacket, true},
+		{"encap/short", []rawDiscoMagic{oldMagic, encapMagic}, encapPacket[:10], false},
+		{"old-only/encap", []rawDiscoMagic{oldMagic}, encapPacket, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, f := range []struct {
+				family string
+				prog   []bpf.Instruction
+				pkt    []byte
+			}{
+				{"ip4", magicsockFilterV4(tt.magics, 1), ipv4Packet(tt.pkt)},
+				{"ip6", magicsockFilterV6(tt.magics, 1), udpDatagram(1, tt.pkt)},
+			} {
+				vm, err := bpf.NewVM(f.prog)
+				if err != nil {
+					t.Fatalf("%s: %v", f.family, err)
+				}
+				n, err := vm.Run(f.pkt)
+				if err != nil {
+					t.Fatalf("%s: %v", f.family, err)
+				}
+				if got := n > 0; got != tt.want {
+					t.Errorf("%s: accepted = %v; want %v", f.family, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoFilterMaxSize(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_RAW_DISCO_MAX_SIZE")
+	defer envknob.Setenv("TS_DEBUG_RAW_DISCO_MAX_SIZE", old)
+
+	sized := func(n int) []byte {
+		b := make([]byte, n)
+		copy(b, testDiscoPacket)
+		return b
+	}
+	tests := []struct {
+		name string
+		knob string
+		size int
+		want bool
+	}{
+		{"default/max", "", defaultRawDiscoMaxSize, true},
+		{"default/over", "", defaultRawDiscoMaxSize + 1, false},
+		{"knob/max", "100", 100, true},
+		{"knob/over", "100", 101, false},
+		{"knob-too-small/over", "10", defaultRawDiscoMaxSize + 1, false},
+		{"knob-too-small/test", "10", len(testDiscoPacket), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_MAX_SIZE", tt.knob)
+			for _, port := range []uint16{0, 1} {
+				for _, f := range []struct {
+					family string
+					prog   []bpf.Instruction
+					pkt    []byte
+				}{
+					{"ip4", magicsockFilterV4(rawDiscoMagics, port), ipv4Packet(sized(tt.size))},
+					{"ip6", magicsockFilterV6(rawDiscoMagics, port), udpDatagram(1, sized(tt.size))},
+				} {
+					vm, err := bpf.NewVM(f.prog)
+					if err != nil {
+						t.Fatalf("%s: %v", f.family, err)
+					}
+					n, err := vm.Run(f.pkt)
+					if err != nil {
+						t.Fatalf("%s: %v", f.family, err)
+					}
+					if got := n > 0; got != tt.want {
+						t.Errorf("%s, port %d: accepted = %v; want %v", f.family, port, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRawDiscoReader(t *testing.T) {
+	for _, tt := range []struct {
+		family string
+		addr   string
+		prog   []bpf.Instruction
+		dst    netip.AddrPort
+	}{
+		{"ip4", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0), netip.MustParseAddrPort("127.0.0.1:1")},
+		{"ip6", "::", magicsockFilterV6(rawDiscoMagics, 0), netip.MustParseAddrPort("[::1]:1")},
+	} {
+		for _, batched := range []bool{true, false} {
+			name := tt.family + "/readfrom"
+			if batched {
+				name = tt.family + "/recvmmsg"
+			}
+			t.Run(name, func(t *testing.T) {
+				pc := listenRawDiscoForTest(t, tt.family+":17", tt.addr, tt.prog)
+				r := newRawDiscoReader(pc, tt.family == "ip6")
+				if !batched {
+					r.br = nil
+				}
+
+				uc, err := net.ListenUDP("udp", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer uc.Close()
+				srcPort := uint16(uc.LocalAddr().(*net.UDPAddr).Port)
+				const numPackets = 3
+				for i := 0; i < numPackets; i++ {
+					if _, err := uc.WriteToUDPAddrPort(testDiscoPacket, tt.dst); err != nil {
+						t.Skipf("can't send to %v: %v", tt.dst, err)
+					}
+				}
+
+				pc.SetReadDeadline(time.Now().Add(time.Second))
+				got := 0
+				for got < numPackets {
+					n, err := r.read()
+					if err != nil {
+						t.Fatalf("after %d datagrams: %v", got, err)
+					}
+					for i := 0; i < n; i++ {
+						b, src, truncated := r.datagram(i)
+						if truncated {
+							t.Errorf("datagram %d truncated", i)
+						}
+						if len(b) < udpHeaderSize || binary.BigEndian.Uint16(b[:2]) != srcPort {
+							continue // someone else's disco-looking traffic
+						}
+						if dst := binary.BigEndian.Uint16(b[2:4]); dst != tt.dst.Port() {
+							t.Errorf("dst port = %d; want %d", dst, tt.dst.Port())
+						}
+						if !bytes.Equal(b[udpHeaderSize:], testDiscoPacket) {
+							t.Errorf("payload = % x; want % x", b[udpHeaderSize:], testDiscoPacket)
+						}
+						if ip, ok := src.(*net.IPAddr); !ok || !ip.IP.Equal(tt.dst.Addr().AsSlice()) {
+							t.Errorf("src = %v; want %v", src, tt.dst.Addr())
+						}
+						got++
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRawDiscoHealthCheck(t *testing.T) {
+	selfTestsOK := metricRawDiscoSelfTestOKIPv4.Value()
+	conn := newTestConn(t)
+	defer conn.Close()
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Skipf("raw disco unavailable: %v", st.V4Err)
+	}
+	if got := metricRawDiscoSelfTestOKIPv4.Value() - selfTestsOK; got != 1 {
+		t.Errorf("self-test successes counted = %d; want 1", got)
+	}
+	if rtt := conn.RawDiscoStatus().V4SelfTestRTT; rtt <= 0 || rtt > rawDiscoSelfTestTimeout() {
+		t.Errorf("self-test RTT = %v; want in (0, %v]", rtt, rawDiscoSelfTestTimeout())
+	}
+
+	conn.checkRawDiscoHealth("ip4")
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Fatalf("healthy receiver stopped: %v", st.V4Err)
+	}
+
+	// Swap in a filter that drops everything, as if it had been
+	// detached or a firewall were eating the traffic.
+	conn.rawDisco4.mu.Lock()
+	pc := conn.rawDisco4.closer.(net.PacketConn)
+	conn.rawDisco4.mu.Unlock()
+	asm, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setBPF(pc, asm); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.checkRawDiscoHealth("ip4")
+	if st := conn.RawDiscoStatus(); st.V4Active || st.V4Err == nil {
+		t.Fatalf("status = %+v; want inactive with error", st)
+	}
+}
+
+func TestSetRawDiscoReadBuffer(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	var logs []string
+	c := &Conn{logf: func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }}
+
+	getBuf := func() int {
+		t.Helper()
+		rc, err := pc.(*net.IPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		var sockErr error
+		if err := rc.Control(func(fd uintptr) {
+			n, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		}); err != nil || sockErr != nil {
+			t.Fatal(err, sockErr)
+		}
+		return n
+	}
+	before := getBuf()
+
+	t.Setenv("TS_DEBUG_RAW_DISCO_RCVBUF", strconv.Itoa(before)) // at most rmem_max, whatever it is here
+	c.setRawDiscoReadBuffer(pc, "ip4")
+	if got := getBuf(); got < before {
+		t.Errorf("receive buffer = %d after asking for %d; want at least that", got, before)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "receive buffer is") {
+		t.Errorf("logs = %q; want one reporting the size", logs)
+	}
+}
+
+func TestReceiveDiscoCancel(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	_, _, wantErr := conn.rawDisco4.status()
+
+	// Returns on cancellation, leaving the socket open.
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		conn.receiveDisco(ctx, pc, "ip4", 0)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiveDisco didn't return on cancel")
+	}
+	if _, _, err := conn.rawDisco4.status(); err != wantErr {
+		t.Errorf("cancel recorded as failure: %v", err)
+	}
+
+	// And still on close.
+	pc = listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	done = make(chan bool)
+	go func() {
+		conn.receiveDisco(context.Background(), pc, "ip4", 0)
+		close(done)
+	}()
+	pc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiveDisco didn't return on close")
+	}
+}
+
+// failingPacketConn is a net.PacketConn whose reads fail with err. It's
+// a net.Conn too, as ipv4 and ipv6.NewPacketConn require, but not a
+// syscall.Conn, so batch reads of it fail as well.
+type failingPacketConn struct {
+	net.Conn // nil; only the methods below are called
+	err      error
+}
+
+func (c failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) { return 0, nil, c.err }
+func (c failingPacketConn) WriteTo([]byte, net.Addr) (int, error)  { return 0, c.err }
+func (c failingPacketConn) SetReadDeadline(time.Time) error        { return nil }
+
+func TestReceiveDiscoReaderID(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	c.receiveDisco(context.Background(), failingPacketConn{err: errors.New("boom")}, "ip6", 2)
+	if len(logs) == 0 || !strings.Contains(logs[0], "ip6 reader 2 failed") {
+		t.Errorf("logs = %q; want the failure of reader 2 first", logs)
+	}
+}
+
+func TestRawDiscoReaderTimestamps(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	if err := enableRawDiscoTimestamps(pc); err != nil {
+		t.Fatal(err)
+	}
+	r := newRawDiscoReader(pc, false)
+	defer r.release()
+
+	sent := mono.Now()
+	time.Sleep(10 * time.Millisecond) // so a stamp taken at read time shows
+	if err := writeRawDiscoTestPacket("ip4"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := r.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if r.msgs[i].NN == 0 {
+			t.Fatalf("datagram %d has no control messages", i)
+		}
+		got := r.receivedAt(i)
+		if got.Before(sent) || !got.Before(r.readAt.Add(-5*time.Millisecond)) {
+			t.Errorf("received at sent+%v, read at sent+%v; want the kernel's timestamp, well before the read", got.Sub(sent), r.readAt.Sub(sent))
+		}
+	}
+}
+
+func TestRawDiscoReaderHWTime(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	r := newRawDiscoReader(pc, false)
+	defer r.release()
+
+	// Stand in for the kernel, which only fills in the hardware
+	// timestamp given a NIC set up to take them.
+	stamp := func(ts [3]unix.Timespec) {
+		var st unix.ScmTimestamping
+		st.Ts = ts
+		data := unsafe.Slice((*byte)(unsafe.Pointer(&st)), unsafe.Sizeof(st))
+		m := &r.msgs[0]
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&m.OOB[0]))
+		h.Level = unix.SOL_SOCKET
+		h.Type = unix.SCM_TIMESTAMPING
+		h.SetLen(unix.CmsgLen(len(data)))
+		copy(m.OOB[unix.CmsgLen(0):], data)
+		m.NN = unix.CmsgSpace(len(data))
+	}
+	if got := r.hwTime(0); !got.IsZero() {
+		t.Errorf("with no control messages, got %v; want zero", got)
+	}
+	stamp([3]unix.Timespec{{Sec: 1}})
+	if got := r.hwTime(0); !got.IsZero() {
+		t.Errorf("with only a software timestamp, got %v; want zero", got)
+	}
+	stamp([3]unix.Timespec{{Sec: 1}, {}, {Sec: 2, Nsec: 3}})
+	if got, want := r.hwTime(0), time.Unix(2, 3); !got.Equal(want) {
+		t.Errorf("got %v; want the raw hardware timestamp, %v", got, want)
+	}
+}
+
+func TestRawDiscoReaderFlowLabel(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip6:17", "::", magicsockFilterV6(rawDiscoMagics, 0))
+	if err := enableRawDiscoFlowInfo(pc); err != nil {
+		t.Fatal(err)
+	}
+	r := newRawDiscoReader(pc, true)
+	defer r.release()
+	if err := writeRawDiscoTestPacket("ip6"); err != nil {
+		t.Skipf("no loopback for ip6: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := r.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Linux labels the test packet's flow itself unless told not to.
+	b, _ := os.ReadFile("/proc/sys/net/ipv6/auto_flowlabels")
+	if auto := strings.TrimSpace(string(b)); auto == "1" || auto == "2" {
+		for i := 0; i < n; i++ {
+			if got := r.flowLabel(i); got == 0 {
+				t.Errorf("datagram %d has no flow label; want the kernel's", i)
+			}
+		}
+	}
+
+	// Stand in for the kernel with a label of our choosing, under a
+	// traffic class to be masked off.
+	m := &r.msgs[0]
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&m.OOB[0]))
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = ipv6FlowInfo
+	h.SetLen(unix.CmsgLen(4))
+	binary.BigEndian.PutUint32(m.OOB[unix.CmsgLen(0):], 0x0ab12345)
+	m.NN = unix.CmsgSpace(4)
+	if got, want := r.flowLabel(0), uint32(0x12345); got != want {
+		t.Errorf("flow label = %#x; want %#x", got, want)
+	}
+	m.NN = 0
+	if got := r.flowLabel(0); got != 0 {
+		t.Errorf("with no control messages, flow label = %#x; want 0", got)
+	}
+}
+
+func TestRawDiscoReaderIfIndex(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tt := range []struct {
+		family  string
+		network string
+		addr    string
+		prog    []bpf.Instruction
+	}{
+		{"ip4", "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0)},
+		{"ip6", "ip6:17", "::", magicsockFilterV6(rawDiscoMagics, 0)},
+	} {
+		t.Run(tt.family, func(t *testing.T) {
+			pc := listenRawDiscoForTest(t, tt.network, tt.addr, tt.prog)
+			if err := enableRawDiscoPktInfo(pc, tt.family == "ip6"); err != nil {
+				t.Fatal(err)
+			}
+			r := newRawDiscoReader(pc, tt.family == "ip6")
+			defer r.release()
+			if err := writeRawDiscoTestPacket(tt.family); err != nil {
+				t.Skipf("no loopback for %s: %v", tt.family, err)
+			}
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := r.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				if got := r.ifIndex(i); got != lo.Index {
+					t.Errorf("datagram %d arrived on interface %d; want lo, %d", i, got, lo.Index)
+				}
+			}
+		})
+	}
+}
+
+func TestRawDiscoKernelStats(t *testing.T) {
+	prog := magicsockFilterV4(rawDiscoMagics, 0)
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", prog)
+	if n, err := attachedBPFLen(pc); err != nil {
+		t.Skipf("SO_GET_FILTER unsupported: %v", err)
+	} else if n != len(prog) {
+		t.Errorf("attached filter length = %d; want %d", n, len(prog))
+	}
+
+	if err := enableRawDiscoDropCounts(pc); err != nil {
+		t.Fatal(err)
+	}
+	r := newRawDiscoReader(pc, false)
+	defer r.release()
+	if err := writeRawDiscoTestPacket("ip4"); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := r.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drops := r.kernelDrops(n - 1); drops != 0 {
+		t.Errorf("kernelDrops = %d; want 0", drops)
+	}
+}
+
+func TestRawDiscoSelfTestClearsDeadline(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	setFilter := func(prog []bpf.Instruction) {
+		t.Helper()
+		asm, err := bpf.Assemble(prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := setBPF(pc, asm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// received checks that pc, as handed to receiveDisco, can still
+	// read well after any deadline the self-test set would expire.
+	received := func() {
+		t.Helper()
+		time.Sleep(rawDiscoSelfTestTimeout() + 50*time.Millisecond)
+		if err := writeRawDiscoTestPacket("ip4"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			t.Fatalf("read after self-test: %v", err)
+		}
+	}
+
+	if _, err := rawDiscoSelfTest(pc, "ip4"); err != nil {
+		t.Fatal(err)
+	}
+	received()
+
+	// Likewise when the self-test fails.
+	setFilter([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+	if _, err := rawDiscoSelfTest(pc, "ip4"); !errors.Is(err, ErrRawDiscoSelfTestTimeout) {
+		t.Fatalf("self-test with drop-all filter: err = %v; want ErrRawDiscoSelfTestTimeout", err)
+	}
+	setFilter(magicsockFilterV4(rawDiscoMagics, 0))
+	received()
+}
+
+func TestListenRawDiscoErrors(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+
+	c := &Conn{logf: t.Logf}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+	if _, err := c.listenRawDisco("ip5", 0); !errors.Is(err, ErrRawDiscoUnsupported) {
+		t.Errorf("bad family: err = %v; want ErrRawDiscoUnsupported", err)
+	}
+
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "1")
+	if _, err := c.listenRawDisco("ip4", 0); !errors.Is(err, ErrRawDiscoDisabled) {
+		t.Errorf("disabled: err = %v; want ErrRawDiscoDisabled", err)
+	}
+}
+
+// fakeRawDiscoConn is a net.PacketConn standing in for a raw disco
+// socket, for listenRawDiscoPacket to hand out. Its reads return the
+// packets sent to pkts until the read deadline.
+type fakeRawDiscoConn struct {
+	net.PacketConn // nil; only the methods below are called
+	pkts           chan []byte
+	deadline       time.Time
+	closed         bool
+}
+
+func (c *fakeRawDiscoConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if !c.deadline.IsZero() {
+		timeout = time.After(time.Until(c.deadline))
+	}
+	select {
+	case pkt := <-c.pkts:
+		return copy(b, pkt), &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *fakeRawDiscoConn) SetReadDeadline(t time.Time) error { c.deadline = t; return nil }
+func (c *fakeRawDiscoConn) Close() error                      { c.closed = true; return nil }
+
+// fakeDiscoTestConn is a net.PacketConn standing in for
+// writeRawDiscoTestPacket's UDP socket, which passes what's written to
+// it on to raw, behind a UDP header, as loopback would.
+type fakeDiscoTestConn struct {
+	net.PacketConn // nil; only the methods below are called
+	raw            *fakeRawDiscoConn
+}
+
+func (c fakeDiscoTestConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt := udpDatagram(uint16(addr.(*net.UDPAddr).Port), b)
+	select {
+	case c.raw.pkts <- pkt:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c fakeDiscoTestConn) Close() error { return nil }
+
+// setFakeRawDiscoListen makes listenRawDiscoPacket return raw for the
+// raw sockets and a fakeDiscoTestConn writing to it for the UDP one,
+// until the test ends.
+func setFakeRawDiscoListen(t *testing.T, raw *fakeRawDiscoConn) {
+	old := listenRawDiscoPacket
+	t.Cleanup(func() { listenRawDiscoPacket = old })
+	listenRawDiscoPacket = func(lc *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+		if network == "udp" {
+			return fakeDiscoTestConn{raw: raw}, nil
+		}
+		return raw, nil
+	}
+}
+
+func TestRawDiscoSelfTestFake(t *testing.T) {
+	for _, k := range []string{"TS_DEBUG_RAW_DISCO_TEST_INTERFACE", "TS_RAW_DISCO_SELFTEST_TIMEOUT"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_RAW_DISCO_TEST_INTERFACE", "")
+	envknob.Setenv("TS_RAW_DISCO_SELFTEST_TIMEOUT", "50ms")
+
+	raw := &fakeRawDiscoConn{pkts: make(chan []byte, 2)}
+	setFakeRawDiscoListen(t, raw)
+	// Something else first, which the self-test skips over.
+	raw.pkts <- udpDatagram(rawDiscoTestPort, nonTestDiscoPacket())
+	if _, err := rawDiscoSelfTest(raw, "ip4"); err != nil {
+		t.Fatalf("self-test: %v", err)
+	}
+	if !raw.deadline.IsZero() {
+		t.Errorf("read deadline left at %v after self-test", raw.deadline)
+	}
+
+	// With the test packet lost, it times out.
+	raw.pkts = make(chan []byte) // unbuffered and unread, so writes drop
+	if _, err := rawDiscoSelfTest(raw, "ip6"); !errors.Is(err, ErrRawDiscoSelfTestTimeout) {
+		t.Errorf("self-test with packet lost: err = %v; want ErrRawDiscoSelfTestTimeout", err)
+	}
+}
+
+func TestListenRawDiscoFakeListen(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+	if !netns.UseSocketMark() {
+		t.Skip("SO_MARK unavailable")
+	}
+	c := newConn()
+	c.logf = t.Logf
+
+	oldListen := listenRawDiscoPacket
+	t.Cleanup(func() { listenRawDiscoPacket = oldListen })
+	var gotNetwork, gotAddr string
+	listenRawDiscoPacket = func(lc *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+		gotNetwork, gotAddr = network, addr
+		return nil, errors.New("no raw sockets here")
+	}
+	if _, err := c.listenRawDisco("ip6", 0); err == nil || !strings.Contains(err.Error(), "creating packet conn: no raw sockets here") {
+		t.Errorf("failed listen: err = %v", err)
+	}
+	if gotNetwork != "ip6:17" || gotAddr != "::" {
+		t.Errorf("listened on %q %q; want ip6:17 ::", gotNetwork, gotAddr)
+	}
+
+	// A conn the filter can't be attached to is closed again.
+	raw := &fakeRawDiscoConn{pkts: make(chan []byte, 1)}
+	setFakeRawDiscoListen(t, raw)
+	if _, err := c.listenRawDisco("ip4", 0); !errors.Is(err, ErrRawDiscoBPFInstall) {
+		t.Errorf("fake conn: err = %v; want ErrRawDiscoBPFInstall", err)
+	}
+	if !raw.closed {
+		t.Error("fake conn not closed after failing to attach filter")
+	}
+}
+
+func TestListenRawDiscoInterface(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+
+	// Bound to loopback, the self-test still applies and passes.
+	c := newConn()
+	c.logf = t.Logf
+	c.rawDiscoIface = "lo"
+	if !c.rawDiscoSeesLoopback() {
+		t.Fatal("receiver bound to lo doesn't see loopback")
+	}
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	rc.Close()
+
+	c.rawDiscoIface = "nonexistent0"
+	if c.rawDiscoSeesLoopback() {
+		t.Error("receiver bound to nonexistent0 sees loopback")
+	}
+	if rc, err := c.listenRawDisco("ip4", 0); err == nil {
+		rc.Close()
+		t.Error("listening on nonexistent interface succeeded")
+	}
+}
+
+func TestRawDiscoSockets(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+
+	c := newConn()
+	c.logf = t.Logf
+	if got := c.RawDiscoSockets(); len(got) != 0 {
+		t.Errorf("sockets before starting = %+v; want none", got)
+	}
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	c.rawDisco4.started(rc, 0)
+	defer c.rawDisco4.stopped(nil)
+
+	got := c.RawDiscoSockets()
+	if len(got) != 1 {
+		t.Fatalf("sockets = %+v; want one", got)
+	}
+	want := RawDiscoSocket{
+		Family:    "ip4",
+		LocalAddr: "0.0.0.0",
+		FD:        got[0].FD,
+		FilterLen: len(magicsockFilterV4(rawDiscoFilterMagics(), 0)),
+	}
+	if got[0] != want {
+		t.Errorf("socket = %+v; want %+v", got[0], want)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(got[0].FD, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		t.Errorf("fd %d isn't a socket: %v", got[0].FD, err)
+	}
+}
+
+// openRawUDPSockets returns the number of raw UDP sockets this process
+// has open.
+func openRawUDPSockets(t *testing.T) int {
+	t.Helper()
+	inodes := map[string]bool{}
+	for _, f := range []string{"/proc/net/raw", "/proc/net/raw6"} {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Skipf("can't count raw sockets: %v", err)
+		}
+		for _, line := range strings.Split(string(b), "\n")[1:] {
+			// sl local_address ... inode, with the protocol as the
+			// local address's port.
+			fields := strings.Fields(line)
+			if len(fields) > 9 && strings.HasSuffix(fields[1], ":0011") {
+				inodes[fields[9]] = true
+			}
+		}
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't count raw sockets: %v", err)
+	}
+	n := 0
+	for _, fd := range fds {
+		link, _ := os.Readlink("/proc/self/fd/" + fd.Name())
+		if strings.HasPrefix(link, "socket:[") && inodes[strings.TrimSuffix(link[len("socket:["):], "]")] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestListenRawDiscoCleanup(t *testing.T) {
+	for _, k := range []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_DEBUG_RAW_DISCO_BPF_V4"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+
+	c := newConn()
+	c.logf = t.Logf
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	if openRawUDPSockets(t) == 0 {
+		t.Fatal("open raw disco socket not counted")
+	}
+	rc.Close()
+
+	tests := []struct {
+		name   string
+		filter string
+		want   error
+	}{
+		{"bad-filter", "1,6 0 0", ErrRawDiscoBPFInstall}, // before the socket is opened
+		{"kernel-rejects-filter", dddBPF(t, []bpf.Instruction{
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipFalse: 1},
+			bpf.RetConstant{Val: 0xffff},
+			bpf.RetConstant{Val: 0},
+		}, ","), ErrRawDiscoBPFInstall},
+		{"self-test", "1,6 0 0 0", ErrRawDiscoSelfTestTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_BPF_V4", tt.filter)
+			before := openRawUDPSockets(t)
+			rc, err := c.listenRawDisco("ip4", 0)
+			if err == nil {
+				rc.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v; want %v", err, tt.want)
+			}
+			if after := openRawUDPSockets(t); after != before {
+				t.Errorf("%d raw sockets open after failing; want %d", after, before)
+			}
+		})
+	}
+}
+
+func TestListenRawDiscoSelfTestFailures(t *testing.T) {
+	for _, k := range []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_DEBUG_RAW_DISCO_BPF_V4", "TS_DEBUG_RAW_DISCO_TEST_INTERFACE", "TS_RAW_DISCO_SELFTEST_TIMEOUT"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+	envknob.Setenv("TS_RAW_DISCO_SELFTEST_TIMEOUT", "100ms")
+
+	c := newConn()
+	c.logf = t.Logf
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	rc.Close()
+
+	tests := []struct {
+		name         string
+		filter       string
+		ifName       string
+		want         error
+		wantWrites   int64 // write failures counted
+		wantTimeouts int64
+	}{
+		{"write", "", "tsnosuchif0", ErrRawDiscoSelfTestWrite, 1, 0},
+		{"timeout", "1,6 0 0 0", "", ErrRawDiscoSelfTestTimeout, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_BPF_V4", tt.filter)
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_TEST_INTERFACE", tt.ifName)
+			writes, timeouts := metricRawDiscoSelfTestWriteFailIPv4.Value(), metricRawDiscoSelfTestTimeoutIPv4.Value()
+			rc, err := c.listenRawDisco("ip4", 0)
+			if err == nil {
+				rc.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v; want %v", err, tt.want)
+			}
+			gotWrites, gotTimeouts := metricRawDiscoSelfTestWriteFailIPv4.Value()-writes, metricRawDiscoSelfTestTimeoutIPv4.Value()-timeouts
+			if gotWrites != tt.wantWrites || gotTimeouts != tt.wantTimeouts {
+				t.Errorf("counted %d write failures and %d timeouts; want %d and %d", gotWrites, gotTimeouts, tt.wantWrites, tt.wantTimeouts)
+			}
+		})
+	}
+}
+
+func TestProbeRawDisco(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO_V6")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO_V6", old)
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	before := conn.RawDiscoStatus()
+	sockets := openRawUDPSockets(t)
+	conn.mu.Lock()
+	readers := conn.rawDiscoReadersRunning
+	conn.mu.Unlock()
+
+	p := conn.ProbeRawDisco("ip4")
+	if p.Err != nil {
+		t.Skipf("raw disco unavailable: %v", p.Err)
+	}
+	if want := len(magicsockFilterV4(rawDiscoFilterMagics(), conn.pconn4.Port())); p.FilterLen != want {
+		t.Errorf("filter length = %d; want %d", p.FilterLen, want)
+	}
+	if p.SelfTestRTT <= 0 {
+		t.Errorf("self-test RTT = %v; want it run", p.SelfTestRTT)
+	}
+
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO_V6", "1")
+	if p := conn.ProbeRawDisco("ip6"); !errors.Is(p.Err, ErrRawDiscoDisabled) || p.Family != "ip6" {
+		t.Errorf("disabled: got %+v; want ErrRawDiscoDisabled for ip6", p)
+	}
+
+	if n := openRawUDPSockets(t); n != sockets {
+		t.Errorf("%d raw sockets open after probing; want %d", n, sockets)
+	}
+	conn.mu.Lock()
+	if conn.rawDiscoReadersRunning != readers {
+		t.Errorf("%d raw disco readers running after probing; want %d", conn.rawDiscoReadersRunning, readers)
+	}
+	conn.mu.Unlock()
+	if after := conn.RawDiscoStatus(); after.V4Active != before.V4Active || after.V6Active != before.V6Active || after.V6Err != before.V6Err {
+		t.Errorf("status after probing = %+v; want %+v", after, before)
+	}
+}
+
+func TestListenRawDiscoCustomFilter(t *testing.T) {
+	for _, k := range []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_DEBUG_RAW_DISCO_BPF_V4"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+
+	c := newConn()
+	c.logf = t.Logf
+	envknob.Setenv("TS_DEBUG_RAW_DISCO_BPF_V4", dddBPF(t, magicsockFilterV4(rawDiscoMagics, 0), ","))
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	if err := setRawDiscoPort(rc, "ip4", 41641); err != nil {
+		t.Errorf("setRawDiscoPort with custom filter: %v", err)
+	}
+	rc.Close()
+
+	// One that drops everything fails the self-test.
+	envknob.Setenv("TS_DEBUG_RAW_DISCO_BPF_V4", "1,6 0 0 0")
+	if rc, err := c.listenRawDisco("ip4", 0); !errors.Is(err, ErrRawDiscoSelfTestTimeout) {
+		if err == nil {
+			rc.Close()
+		}
+		t.Errorf("drop-all filter: err = %v; want %v", err, ErrRawDiscoSelfTestTimeout)
+	}
+	envknob.Setenv("TS_DEBUG_RAW_DISCO_BPF_V4", "1,6 0 0 1")
+	if rc, err := c.listenRawDisco("ip4", 0); !errors.Is(err, ErrRawDiscoBPFInstall) {
+		if err == nil {
+			rc.Close()
+		}
+		t.Errorf("accept-all filter: err = %v; want %v", err, ErrRawDiscoBPFInstall)
+	}
+}
+
+func TestListenRawDiscoSkipSelfTest(t *testing.T) {
+	for _, k := range []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_RAW_DISCO_SKIP_SELFTEST"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+	envknob.Setenv("TS_RAW_DISCO_SKIP_SELFTEST", "1")
+
+	c := newConn()
+	c.logf = t.Logf
+	if why := c.rawDiscoSkipSelfTest(); !strings.Contains(why, "TS_RAW_DISCO_SKIP_SELFTEST") {
+		t.Errorf("rawDiscoSkipSelfTest = %q; want it to name the knob", why)
+	}
+	ok, fail := metricRawDiscoSelfTestOKIPv4.Value(), metricRawDiscoSelfTestFailIPv4.Value()
+	rc, err := c.listenRawDisco("ip4", 0)
+	if err != nil {
+		t.Skipf("raw disco unavailable: %v", err)
+	}
+	defer rc.Close()
+	if metricRawDiscoSelfTestOKIPv4.Value() != ok || metricRawDiscoSelfTestFailIPv4.Value() != fail {
+		t.Error("self-test ran anyway")
+	}
+}
+
+func TestSetBPFErrors(t *testing.T) {
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	asm, err := bpf.Assemble(magicsockFilterV4(rawDiscoMagics, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setBPF(uc, asm); err == nil {
+		t.Error("setBPF on a UDPConn succeeded")
+	}
+
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	if err := setBPF(pc, nil); err == nil {
+		t.Error("setBPF with an empty filter succeeded")
+	}
+	// Too long for the kernel, which must be reported rather than
+	// silently leaving the old filter in place.
+	long := make([]bpf.RawInstruction, 1<<16-1)
+	for i := range long {
+		long[i] = bpf.RawInstruction{Op: 0x06} // ret #0
+	}
+	if err := setBPF(pc, long); err == nil {
+		t.Error("setBPF with an overlong filter succeeded")
+	} else if got := bpfInstallErrno(err); got != "einval" {
+		t.Errorf("overlong filter counted as %q, want einval: %v", got, err)
+	}
+}
+
+func TestBPFInstallErrno(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("SO_ATTACH_FILTER: %w", unix.EPERM), "eperm"},
+		{unix.EACCES, "eperm"},
+		{unix.ENOSYS, "enosys"},
+		{unix.ENOPROTOOPT, "enosys"},
+		{unix.EINVAL, "einval"},
+		{unix.ENOMEM, "enomem"},
+		{unix.EBADF, "other"},
+		{errors.New("not a raw socket"), "other"},
+	} {
+		if got := bpfInstallErrno(tt.err); got != tt.want {
+			t.Errorf("bpfInstallErrno(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	// Each is counted, and says what it was counted as.
+	m := metricRawDiscoBPFInstallFail["enomem"]
+	before := m.Value()
+	err := bpfInstallError(fmt.Errorf("SO_ATTACH_FILTER: %w", unix.ENOMEM))
+	if !errors.Is(err, ErrRawDiscoBPFInstall) {
+		t.Errorf("bpfInstallError = %v, want an ErrRawDiscoBPFInstall", err)
+	}
+	if !strings.Contains(err.Error(), "(enomem)") {
+		t.Errorf("bpfInstallError = %v, want it to say enomem", err)
+	}
+	if got := m.Value() - before; got != 1 {
+		t.Errorf("enomem count went up by %d, want 1", got)
+	}
+}
+
+func TestRawDiscoMultipleReaders(t *testing.T) {
+	pc := listenRawDiscoForTest(t, "ip4:17", "0.0.0.0", magicsockFilterV4(rawDiscoMagics, 0))
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	srcPort := uint16(uc.LocalAddr().(*net.UDPAddr).Port)
+
+	// Each datagram must go to exactly one of the readers sharing the
+	// socket.
+	const numReaders, numPackets = 3, 30
+	got := make(chan int, numReaders)
+	for i := 0; i < numReaders; i++ {
+		go func() {
+			r := newRawDiscoReader(pc, false)
+			defer r.release()
+			n := 0
+			defer func() { got <- n }()
+			for {
+				m, err := r.read()
+				if err != nil {
+					return
+				}
+				for j := 0; j < m; j++ {
+					if b, _, _ := r.datagram(j); len(b) >= udpHeaderSize && binary.BigEndian.Uint16(b[:2]) == srcPort {
+						n++
+					}
+				}
+			}
+		}()
+	}
+	dst := netip.MustParseAddrPort("127.0.0.1:1")
+	for i := 0; i < numPackets; i++ {
+		if _, err := uc.WriteToUDPAddrPort(testDiscoPacket, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	pc.SetReadDeadline(time.Now())
+	total := 0
+	for i := 0; i < numReaders; i++ {
+		total += <-got
+	}
+	if total != numPackets {
+		t.Errorf("readers got %d datagrams in total; want %d", total, numPackets)
+	}
+}
+
+func TestDiscoFilterPort(t *testing.T) {
+	withDstPort := func(b []byte, udpOff int, port uint16) []byte {
+		binary.BigEndian.PutUint16(b[udpOff+2:], port)
+		return b
+	}
+	tests := []struct {
+		name    string
+		port    uint16 // filter's
+		dstPort uint16 // packet's
+		want    bool
+	}{
+		{"match", 4242, 4242, true},
+		{"mismatch", 4242, 4243, false},
+		{"test-port", 4242, rawDiscoTestPort, true},
+		{"any", 0, 4243, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, f := range []struct {
+				family string
+				prog   []bpf.Instruction
+				pkt    []byte
+			}{
+				{"ip4", magicsockFilterV4(rawDiscoMagics, tt.port), withDstPort(ipv4Packet(testDiscoPacket), 20, tt.dstPort)},
+				{"ip6", magicsockFilterV6(rawDiscoMagics, tt.port), withDstPort(udpDatagram(1, testDiscoPacket), 0, tt.dstPort)},
+			} {
+				vm, err := bpf.NewVM(f.prog)
+				if err != nil {
+					t.Fatalf("%s: %v", f.family, err)
+				}
+				n, err := vm.Run(f.pkt)
+				if err != nil {
+					t.Fatalf("%s: %v", f.family, err)
+				}
+				if got := n > 0; got != tt.want {
+					t.Errorf("%s: accepted = %v; want %v", f.family, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestRawDiscoFiltersLoopback checks, against the kernel rather than
+// bpf.NewVM, that the filters listenRawDisco installs let in disco for
+// our port and nothing else. The self-test only ever sends what they
+// should accept, so misplaced offsets rejecting too little get past it.
+func TestRawDiscoCountsFlushedOnClose(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Skipf("raw disco unavailable: %v", st.V4Err)
+	}
+	observed := make(chan bool, rawDiscoObserverQueueLen)
+	conn.SetRawDiscoObserver(func(netip.AddrPort, int, string) {
+		observed <- true
+	})
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	disco := nonTestDiscoPacket()
+	disco[len(disco)-1] ^= 0x5a // unlike other tests' packets, so it's not a dup
+	before := metricRecvDiscoPacketIPv4.Value()
+	if _, err := uc.WriteToUDP(disco, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(conn.discoPort("ip4"))}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-observed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disco not observed")
+	}
+	// Counted by its reader, which need not have flushed yet, but
+	// must have once it's stopped.
+	conn.Close()
+	if got := metricRecvDiscoPacketIPv4.Value() - before; got != 1 {
+		t.Errorf("counted %d packets after close; want 1", got)
+	}
+}
+
+func TestRawDiscoFiltersLoopback(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+
+	type observation struct {
+		payloadLen int
+		family     string
+	}
+	got := make(chan observation, rawDiscoObserverQueueLen)
+	conn.SetRawDiscoObserver(func(_ netip.AddrPort, payloadLen int, family string) {
+		got <- observation{payloadLen, family}
+	})
+	st := conn.RawDiscoStatus()
+	for _, tt := range []struct {
+		family   string
+		active   bool
+		err      error
+		addr     netip.Addr
+		mismatch *clientmetric.Metric
+	}{
+		{"ip4", st.V4Active, st.V4Err, netip.AddrFrom4([4]byte{127, 0, 0, 1}), metricRecvDiscoRawPortMismatchIPv4},
+		{"ip6", st.V6Active, st.V6Err, netip.IPv6Loopback(), metricRecvDiscoRawPortMismatchIPv6},
+	} {
+		t.Run(tt.family, func(t *testing.T) {
+			if !tt.active {
+				t.Skipf("raw disco unavailable: %v", tt.err)
+			}
+			uc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(tt.addr, 0)))
+			if err != nil {
+				t.Skipf("no loopback for %s: %v", tt.family, err)
+			}
+			defer uc.Close()
+			port := conn.discoPort(tt.family)
+			disco := nonTestDiscoPacket()
+			mismatched := tt.mismatch.Value()
+
+			// The lone reader handles them in the order sent, so by
+			// the time the disco is observed, either of the others
+			// accepted would have been too.
+			for _, p := range []struct {
+				port    uint16
+				payload []byte
+			}{
+				{port, []byte("not disco, but for our port")},
+				{port + 1, disco},
+				{port, disco},
+			} {
+				if _, err := uc.WriteToUDPAddrPort(p.payload, netip.AddrPortFrom(tt.addr, p.port)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case ob := <-got:
+				if want := (observation{len(disco), tt.family}); ob != want {
+					t.Errorf("observed %+v first; want the disco, %+v", ob, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("disco not observed")
+			}
+			if n := tt.mismatch.Value() - mismatched; n != 0 {
+				t.Errorf("%d packets for the wrong port got past the filter", n)
+			}
+		})
+	}
+}
+
+func TestUpdateRawDiscoPort(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Skipf("raw disco unavailable: %v", st.V4Err)
+	}
+	got := make(chan netip.AddrPort, rawDiscoObserverQueueLen)
+	conn.SetRawDiscoObserver(func(src netip.AddrPort, _ int, _ string) {
+		got <- src
+	})
+	// Disco to the old port is sent from one socket and to the new
+	// one from another, to tell them apart.
+	lo := netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	var ucs [2]*net.UDPConn
+	for i := range ucs {
+		uc, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(lo, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		ucs[i] = uc
+	}
+	oldSender, newSender := ucs[0], ucs[1]
+	send := func(uc *net.UDPConn, port uint16) {
+		t.Helper()
+		if _, err := uc.WriteToUDPAddrPort(nonTestDiscoPacket(), netip.AddrPortFrom(lo, port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// firstObserved returns the source of the first disco observed.
+	firstObserved := func() netip.AddrPort {
+		t.Helper()
+		select {
+		case src := <-got:
+			return src
+		case <-time.After(5 * time.Second):
+			t.Fatal("disco not observed")
+		}
+		return netip.AddrPort{}
+	}
+
+	oldPort := conn.pconn4.Port()
+	conn.port.Store(0) // don't ask for the same port again
+	if err := conn.rebind(dropCurrentPort); err != nil {
+		t.Fatal(err)
+	}
+	newPort := conn.pconn4.Port()
+	if newPort == oldPort {
+		t.Skipf("rebind kept port %d", oldPort)
+	}
+	conn.rawDisco4.mu.Lock()
+	filterPort := conn.rawDisco4.port
+	conn.rawDisco4.mu.Unlock()
+	if filterPort != newPort {
+		t.Errorf("filter port = %d; want %d", filterPort, newPort)
+	}
+	if got := conn.rawDisco4.retiredPort(); got != oldPort {
+		t.Errorf("retired port = %d; want %d, still accepted for a while", got, oldPort)
+	}
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Fatalf("raw disco stopped on rebind: %v", st.V4Err)
+	}
+
+	// The filter was widened to let disco for the old port through.
+	send(oldSender, oldPort)
+	if src := firstObserved(); src.Port() != uint16(oldSender.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("observed disco from %v first; want the one to the retired port", src)
+	}
+
+	// Once narrowed, it doesn't, though the port is still accepted
+	// if it gets past. The lone reader handles packets in the order
+	// sent, so by the time the one for the new port is observed, the
+	// other would have been too.
+	conn.rawDisco4.mu.Lock()
+	timer := conn.rawDisco4.narrowTimer
+	conn.rawDisco4.mu.Unlock()
+	if timer == nil {
+		t.Fatal("no timer to narrow the filter")
+	}
+	timer.Stop()
+	conn.narrowRawDiscoFilter("ip4", timer)
+	send(oldSender, oldPort)
+	send(newSender, newPort)
+	if src := firstObserved(); src.Port() != uint16(newSender.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("observed disco from %v first; want the one to the new port, the narrowed filter dropping the other", src)
+	}
+}
+
+func TestStartRawDiscoRebind(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	if st := conn.RawDiscoStatus(); !st.V4Active {
+		t.Skipf("raw disco unavailable: %v", st.V4Err)
+	}
+	conn.rawDisco4.stopped(nil)
+	got := make(chan netip.AddrPort, rawDiscoObserverQueueLen)
+	conn.SetRawDiscoObserver(func(src netip.AddrPort, _ int, _ string) {
+		got <- src
+	})
+
+	// Rebind while the receiver is being opened, before it's been
+	// recorded as running, so bindSocket leaves its filter be.
+	oldPort := conn.pconn4.Port()
+	conn.port.Store(0) // don't ask for the same port again
+	oldListen := listenRawDiscoPacket
+	t.Cleanup(func() { listenRawDiscoPacket = oldListen })
+	rebound := false
+	listenRawDiscoPacket = func(lc *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+		if network == "ip4:17" && !rebound {
+			rebound = true
+			if err := conn.rebind(dropCurrentPort); err != nil {
+				t.Error(err)
+			}
+		}
+		return oldListen(lc, network, addr)
+	}
+	if err := conn.tryStartRawDisco("ip4"); err != nil {
+		t.Fatal(err)
+	}
+	newPort := conn.pconn4.Port()
+	if !rebound || newPort == oldPort {
+		t.Skipf("rebind kept port %d", oldPort)
+	}
+	conn.rawDisco4.mu.Lock()
+	filterPort := conn.rawDisco4.port
+	conn.rawDisco4.mu.Unlock()
+	if filterPort != newPort {
+		t.Errorf("filter port = %d; want %d", filterPort, newPort)
+	}
+	if got := conn.rawDisco4.retiredPort(); got != 0 {
+		t.Errorf("retired port = %d; want none, the receiver not having been active on it", got)
+	}
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if _, err := uc.WriteToUDPAddrPort(nonTestDiscoPacket(), netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), newPort)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disco for the new port not observed")
+	}
+}
+
+func TestListenRawDiscoTestInterface(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root, for a network namespace with a veth pair")
+	}
+	for _, k := range []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_DEBUG_RAW_DISCO_TEST_INTERFACE"} {
+		old := os.Getenv(k)
+		defer envknob.Setenv(k, old)
+	}
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "")
+
+	// Everything that looks up interfaces or opens sockets has to run
+	// on the thread in the new network namespace. It's never unlocked,
+	// so it goes away with the goroutine.
+	skip := make(chan string, 1)
+	go func() {
+		defer close(skip)
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- fmt.Sprintf("can't create a network namespace: %v", err)
+			return
+		}
+		for _, args := range [][]string{
+			{"link", "add", "tsveth0", "type", "veth", "peer", "name", "tsveth1"},
+			{"link", "set", "lo", "up"},
+			{"link", "set", "tsveth0", "up"},
+			{"link", "set", "tsveth1", "up"},
+		} {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				skip <- fmt.Sprintf("ip %s: %v, %s", strings.Join(args, " "), err, out)
+				return
+			}
+		}
+
+		c := newConn()
+		c.logf = t.Logf
+		c.rawDiscoIface = "tsveth0"
+		for _, family := range []string{"ip4", "ip6"} {
+			// Over loopback, the packet doesn't arrive on tsveth0.
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_TEST_INTERFACE", "lo")
+			if rc, err := c.listenRawDisco(family, 0); !errors.Is(err, ErrRawDiscoSelfTestTimeout) {
+				if err == nil {
+					rc.Close()
+				}
+				t.Errorf("%v: injected on lo: err = %v; want %v", family, err, ErrRawDiscoSelfTestTimeout)
+			}
+
+			envknob.Setenv("TS_DEBUG_RAW_DISCO_TEST_INTERFACE", "tsveth1")
+			rc, err := c.listenRawDisco(family, 0)
+			if err != nil {
+				t.Errorf("%v: injected on tsveth1: %v", family, err)
+				continue
+			}
+			rc.Close()
+			if _, rtt, _ := c.rawDiscoState(family).status(); rtt == 0 {
+				t.Errorf("%v: no self-test recorded", family)
+			}
+		}
+	}()
+	if why, ok := <-skip; ok {
+		t.Skip(why)
+	}
+}
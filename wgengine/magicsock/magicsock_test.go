@@ -19,32 +19,43 @@
 	"net/http/httptest"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
 
 	"go4.org/mem"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/bpf"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netaddr"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/natlab"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
 	"tailscale.com/util/cibuild"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/racebuild"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/wgcfg"
@@ -1818,3 +1829,1901 @@ func TestDiscoMagicMatches(t *testing.T) {
 		t.Errorf("last 2 bytes of disco magic don't match, got %v want %v", discoMagic2, m2)
 	}
 }
+
+func TestRawDiscoDisabled(t *testing.T) {
+	knobs := []string{"TS_DEBUG_DISABLE_RAW_DISCO", "TS_DEBUG_DISABLE_RAW_DISCO_V4", "TS_DEBUG_DISABLE_RAW_DISCO_V6"}
+	for _, k := range knobs {
+		old := os.Getenv(k)
+		t.Cleanup(func() { envknob.Setenv(k, old) })
+	}
+	tests := []struct {
+		all, v4, v6  string
+		want4, want6 bool
+	}{
+		{"", "", "", false, false},
+		{"1", "", "", true, true},
+		{"", "1", "", true, false},
+		{"", "", "1", false, true},
+		{"", "1", "1", true, true},
+	}
+	for _, tt := range tests {
+		envknob.Setenv(knobs[0], tt.all)
+		envknob.Setenv(knobs[1], tt.v4)
+		envknob.Setenv(knobs[2], tt.v6)
+		if got := rawDiscoDisabled("ip4"); got != tt.want4 {
+			t.Errorf("all=%q v4=%q v6=%q: ip4 disabled = %v; want %v", tt.all, tt.v4, tt.v6, got, tt.want4)
+		}
+		if got := rawDiscoDisabled("ip6"); got != tt.want6 {
+			t.Errorf("all=%q v4=%q v6=%q: ip6 disabled = %v; want %v", tt.all, tt.v4, tt.v6, got, tt.want6)
+		}
+	}
+}
+
+func TestIsPermanentRawDiscoError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrRawDiscoUnsupported, true},
+		{fmt.Errorf("%w: SO_MARK unavailable", ErrRawDiscoUnsupported), true},
+		{ErrRawDiscoDisabled, true},
+		{fmt.Errorf("%w: setsockopt: operation not permitted", ErrRawDiscoBPFInstall), false},
+		{fmt.Errorf("%w: i/o timeout", ErrRawDiscoSelfTestTimeout), false},
+		{errors.New("creating packet conn: permission denied"), false},
+	}
+	for _, tt := range tests {
+		if got := isPermanentRawDiscoError(tt.err); got != tt.want {
+			t.Errorf("isPermanentRawDiscoError(%v) = %v; want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRawDiscoSelfTestTimeout(t *testing.T) {
+	const knob = "TS_RAW_DISCO_SELFTEST_TIMEOUT"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	tests := []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", defaultRawDiscoSelfTestTimeout},
+		{"500ms", 500 * time.Millisecond},
+		{"2s", 2 * time.Second},
+		{"bogus", defaultRawDiscoSelfTestTimeout},
+		{"0", defaultRawDiscoSelfTestTimeout},
+		{"-1s", defaultRawDiscoSelfTestTimeout},
+		{"1h", defaultRawDiscoSelfTestTimeout},
+	}
+	for _, tt := range tests {
+		envknob.Setenv(knob, tt.v)
+		if got := rawDiscoSelfTestTimeout(); got != tt.want {
+			t.Errorf("%s=%q: got %v; want %v", knob, tt.v, got, tt.want)
+		}
+	}
+}
+
+// udpDatagram returns a UDP datagram from port 1234 to dstPort carrying
+// payload, as delivered by a raw UDPv6 socket.
+func udpDatagram(dstPort uint16, payload []byte) []byte {
+	b := make([]byte, udpHeaderSize, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], 1234)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(udpHeaderSize+len(payload)))
+	return append(b, payload...)
+}
+
+// nonTestDiscoPacket returns testDiscoPacket with a nonzero sender key,
+// which handleRawDiscoDatagram passes on to handleDiscoMessage rather
+// than dropping as test traffic.
+func nonTestDiscoPacket() []byte {
+	b := append([]byte(nil), testDiscoPacket...)
+	b[len(disco.Magic)] = 1
+	return b
+}
+
+func TestHandleRawDiscoDatagram(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	port4, port6 := conn.pconn4.Port(), conn.pconn6.Port()
+
+	// Unlike testDiscoPacket, which is taken as a health check echo,
+	// this one is passed on to handleDiscoMessage.
+	disco := nonTestDiscoPacket()
+	zeroKey := append([]byte(nil), testDiscoPacket...)
+	zeroKey[len(zeroKey)-1] = 1 // differs from testDiscoPacket in its nonce
+
+	src4 := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	src6 := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	metrics := []*clientmetric.Metric{
+		metricRecvDiscoPacketIPv4,
+		metricRecvDiscoPacketIPv6,
+		metricRecvDiscoRawPortMismatchIPv4,
+		metricRecvDiscoRawPortMismatchIPv6,
+		metricRecvDiscoRawPortZero,
+		metricRecvDiscoRawShort,
+		metricRecvDiscoRawBadSrc,
+		metricRecvDiscoRawUndecryptable,
+		metricRecvDiscoRawZeroKey,
+	}
+	tests := []struct {
+		name   string
+		b      []byte
+		src    net.Addr
+		family string
+		want   *clientmetric.Metric // incremented, or nil for none
+	}{
+		{"ok/ip4", udpDatagram(port4, disco), src4, "ip4", metricRecvDiscoPacketIPv4},
+		{"ok/ip6", udpDatagram(port6, disco), src6, "ip6", metricRecvDiscoPacketIPv6},
+		{"short", udpDatagram(port4, nil)[:udpHeaderSize-1], src4, "ip4", metricRecvDiscoRawShort},
+		{"short/4-bytes", udpDatagram(port4, nil)[:4], src4, "ip4", metricRecvDiscoRawShort},
+		{"port-mismatch/ip4", udpDatagram(port4+1, disco), src4, "ip4", metricRecvDiscoRawPortMismatchIPv4},
+		{"port-mismatch/ip6", udpDatagram(port6+1, disco), src6, "ip6", metricRecvDiscoRawPortMismatchIPv6},
+		{"port-zero", udpDatagram(0, disco), src4, "ip4", metricRecvDiscoRawPortZero},
+		{"port-zero/ip6", udpDatagram(0, disco), src6, "ip6", metricRecvDiscoRawPortZero},
+		{"src-not-ip", udpDatagram(port4, disco), &net.UDPAddr{IP: src4.IP, Port: 1234}, "ip4", metricRecvDiscoRawBadSrc},
+		{"src-bad-ip", udpDatagram(port4, disco), &net.IPAddr{IP: net.IP{1, 2, 3}}, "ip4", metricRecvDiscoRawBadSrc},
+		{"src-nil", udpDatagram(port4, disco), nil, "ip4", metricRecvDiscoRawBadSrc},
+		{"health-check-echo", udpDatagram(rawDiscoTestPort, testDiscoPacket), src4, "ip4", nil},
+		{"zero-key", udpDatagram(port4, zeroKey), src4, "ip4", metricRecvDiscoRawZeroKey},
+		{"test-packet-to-our-port", udpDatagram(port4, testDiscoPacket), src4, "ip4", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.family == "ip6" && port6 == 0 {
+				t.Skip("no IPv6 socket")
+			}
+			before := make([]int64, len(metrics))
+			for i, m := range metrics {
+				before[i] = m.Value()
+			}
+			conn.handleRawDiscoDatagram(tt.b, tt.src, tt.family, rawDiscoRx{at: mono.Now()})
+			for i, m := range metrics {
+				want := int64(0)
+				if m == tt.want {
+					want = 1
+				}
+				if got := m.Value() - before[i]; got != want {
+					t.Errorf("%s incremented by %d; want %d", m.Name(), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRawDiscoDatagramUnbound(t *testing.T) {
+	src4 := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	src6 := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	check := func(t *testing.T, c *Conn, src net.Addr, family string) {
+		t.Helper()
+		noPort, panics := metricRecvDiscoRawNoPort.Value(), metricRecvDiscoRawPanics.Value()
+		c.handleRawDiscoDatagram(udpDatagram(1234, nonTestDiscoPacket()), src, family, rawDiscoRx{at: mono.Now()})
+		if n := metricRecvDiscoRawPanics.Value() - panics; n != 0 {
+			t.Fatalf("%s: handler panicked", family)
+		}
+		if n := metricRecvDiscoRawNoPort.Value() - noPort; n != 1 {
+			t.Errorf("%s: %d packets dropped for want of a port; want 1", family, n)
+		}
+	}
+
+	t.Run("never-bound", func(t *testing.T) {
+		c := newConn()
+		c.logf = t.Logf
+		check(t, c, src4, "ip4")
+		check(t, c, src6, "ip6")
+	})
+	t.Run("closed", func(t *testing.T) {
+		conn := newTestConn(t)
+		defer conn.Close()
+		conn.pconn4.Close()
+		conn.pconn6.Close()
+		check(t, conn, src4, "ip4")
+		check(t, conn, src6, "ip6")
+	})
+}
+
+func TestHandleRawDiscoDatagramZone(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	ourDisco := conn.DiscoPublicKey()
+	peerDisco := key.NewDisco()
+	conn.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{
+			Key:      key.NewNode().Public(),
+			DiscoKey: peerDisco.Public(),
+		}},
+	})
+	conn.SetPrivateKey(key.NewNode())
+	port6 := conn.pconn6.Port()
+	if port6 == 0 {
+		t.Skip("no IPv6 socket")
+	}
+
+	ping := &disco.Ping{TxID: [12]byte{1}}
+	msg := peerDisco.Public().AppendTo([]byte(disco.Magic))
+	msg = append(msg, peerDisco.Shared(ourDisco).Seal(ping.AppendMarshal(nil))...)
+	src := &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}
+	conn.handleRawDiscoDatagram(udpDatagram(port6, msg), src, "ip6", rawDiscoRx{at: mono.Now()})
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	got := conn.discoInfoLocked(peerDisco.Public()).lastPingFrom
+	if want := netip.MustParseAddrPort("[fe80::1%eth0]:1234"); got != want {
+		t.Errorf("ping handled from %v; want %v", got, want)
+	}
+}
+
+func TestHandleRawDiscoDatagramUndecryptable(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	conn.DiscoPublicKey() // generates our disco key
+	sendConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+	_, discoKey := addTestEndpoint(t, conn, sendConn)
+	port := conn.pconn4.Port()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	// Disco from sender, with a box that doesn't open.
+	discoFrom := func(sender key.DiscoPublic) []byte {
+		b := sender.AppendTo([]byte(disco.Magic))
+		return append(b, make([]byte, disco.NonceLen+16)...)
+	}
+	unknownKey := key.NewDisco().Public()
+	for _, sender := range []key.DiscoPublic{unknownKey, discoKey} {
+		before := metricRecvDiscoRawUndecryptable.Value()
+		conn.handleRawDiscoDatagram(udpDatagram(port, discoFrom(sender)), src, "ip4", rawDiscoRx{at: mono.Now()})
+		if got := metricRecvDiscoRawUndecryptable.Value() - before; got != 1 {
+			t.Errorf("from %v: undecryptable incremented by %d; want 1", sender.ShortString(), got)
+		}
+	}
+}
+
+func TestRawDiscoActiveGauge(t *testing.T) {
+	c := newConn()
+	for _, family := range []string{"ip4", "ip6"} {
+		s := c.rawDiscoState(family)
+		var closer testCloser
+		s.started(&closer, 41641)
+		if got := s.activeGauge.Value(); got != 1 {
+			t.Errorf("%v: gauge = %d after starting; want 1", family, got)
+		}
+		s.stopped(ErrRawDiscoSelfTestTimeout)
+		if got := s.activeGauge.Value(); got != 0 {
+			t.Errorf("%v: gauge = %d after failing; want 0", family, got)
+		}
+		if closer.closed != 1 {
+			t.Errorf("%v: receiver closed %d times; want 1", family, closer.closed)
+		}
+	}
+	if c.rawDisco4.activeGauge == c.rawDisco6.activeGauge {
+		t.Error("families share a gauge")
+	}
+}
+
+func TestCheckRawDiscoSilence(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	s := &c.rawDisco4
+	start := mono.Now()
+	s.active.Store(true)
+	s.lastRecv.Store(int64(start))
+	later := start.Add(rawDiscoSilenceWindow + time.Minute)
+
+	if c.checkRawDiscoSilence("ip4", later) {
+		t.Error("silent with no disco on the regular socket either")
+	}
+	s.lastSocketDisco.Store(int64(start.Add(rawDiscoSilenceWindow)))
+	if c.checkRawDiscoSilence("ip4", start.Add(time.Minute)) {
+		t.Error("silent within the window")
+	}
+	if !c.checkRawDiscoSilence("ip4", later) {
+		t.Error("not silent after the window")
+	}
+	if len(logs) != 1 {
+		t.Errorf("logs = %q; want one warning", logs)
+	}
+	if !c.checkRawDiscoSilence("ip4", later.Add(time.Minute)) || len(logs) != 1 {
+		t.Errorf("logs = %q; want no repeat warning so soon", logs)
+	}
+
+	// Disco arriving on the raw path again ends it.
+	s.lastRecv.Store(int64(later))
+	if c.checkRawDiscoSilence("ip4", later.Add(time.Minute)) {
+		t.Error("silent after receiving")
+	}
+
+	// As does pausing, or stopping.
+	s.lastRecv.Store(int64(start))
+	c.PauseRawDisco()
+	if c.checkRawDiscoSilence("ip4", later) {
+		t.Error("silent while paused")
+	}
+	c.ResumeRawDisco()
+	s.active.Store(false)
+	if c.checkRawDiscoSilence("ip4", later) {
+		t.Error("silent while stopped")
+	}
+
+	// The regular socket notes the disco it ignores.
+	s.lastSocketDisco.Store(0)
+	c.receiveIP(testDiscoPacket, netip.MustParseAddrPort("192.0.2.1:1234"), &ippEndpointCache{}, false)
+	if s.lastSocketDisco.Load() == 0 {
+		t.Error("ignored disco on the regular socket not noted")
+	}
+}
+
+func TestRawDiscoStarvedWindow(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_RAW_DISCO_STARVED_WINDOW")
+	defer envknob.Setenv("TS_DEBUG_RAW_DISCO_STARVED_WINDOW", old)
+	for _, tt := range []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", defaultRawDiscoStarvedWindow},
+		{"1h", time.Hour},
+		{"1m", time.Minute},
+		{"30s", defaultRawDiscoStarvedWindow}, // shorter than the checks
+		{"soon", defaultRawDiscoStarvedWindow},
+	} {
+		envknob.Setenv("TS_DEBUG_RAW_DISCO_STARVED_WINDOW", tt.v)
+		if got := rawDiscoStarvedWindow(); got != tt.want {
+			t.Errorf("rawDiscoStarvedWindow() with %q = %v; want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRawDiscoStarved(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+
+	c := newConn()
+	c.logf = t.Logf
+	s := &c.rawDisco4
+	var closer testCloser
+	s.started(&closer, 41641)
+	window := rawDiscoStarvedWindow()
+	start := mono.Now()
+
+	// The first check only starts the window.
+	s.socketDiscoCount.Add(100)
+	c.checkRawDiscoStarved("ip4", start)
+	s.socketDiscoCount.Add(100)
+	c.checkRawDiscoStarved("ip4", start.Add(window-time.Minute))
+	if !s.active.Load() {
+		t.Fatal("shut down before the window was up")
+	}
+
+	// A healthy share, or too little disco to tell, leaves it be.
+	s.recvCount.Add(95)
+	c.checkRawDiscoStarved("ip4", start.Add(window))
+	if !s.active.Load() {
+		t.Fatal("shut down while getting its share")
+	}
+	if got := metricRawDiscoShareIPv4.Value(); got != 95 {
+		t.Errorf("share = %d%%; want 95%%", got)
+	}
+	s.socketDiscoCount.Add(rawDiscoStarvedMinSocket - 1)
+	c.checkRawDiscoStarved("ip4", start.Add(2*window))
+	if !s.active.Load() {
+		t.Fatal("shut down on too little disco to compare")
+	}
+
+	// Nothing from plenty, while paused, is the socket's doing.
+	s.socketDiscoCount.Add(100)
+	c.PauseRawDisco()
+	c.checkRawDiscoStarved("ip4", start.Add(3*window))
+	c.ResumeRawDisco()
+	c.checkRawDiscoStarved("ip4", start.Add(3*window))
+	if !s.active.Load() {
+		t.Fatal("shut down over disco from while paused")
+	}
+
+	before := metricRawDiscoStarved.Value()
+	s.socketDiscoCount.Add(200)
+	at := start.Add(4 * window)
+	c.checkRawDiscoStarved("ip4", at)
+	if s.active.Load() || closer.closed != 1 {
+		t.Fatalf("active = %v, closed %d times, starved; want shut down", s.active.Load(), closer.closed)
+	}
+	if _, _, err := s.status(); !errors.Is(err, ErrRawDiscoStarved) {
+		t.Errorf("err = %v; want ErrRawDiscoStarved", err)
+	}
+	if got := metricRawDiscoStarved.Value() - before; got != 1 {
+		t.Errorf("starved metric incremented by %d; want 1", got)
+	}
+
+	// It's retried, but not right away.
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "1")
+	c.reprobeRawDisco("ip4", at.Add(time.Minute))
+	if _, _, err := s.status(); !errors.Is(err, ErrRawDiscoStarved) {
+		t.Errorf("retried too soon: err = %v", err)
+	}
+	c.reprobeRawDisco("ip4", at.Add(rawDiscoReprobeInterval))
+	if _, _, err := s.status(); !errors.Is(err, ErrRawDiscoDisabled) {
+		t.Errorf("after retrying: err = %v; want ErrRawDiscoDisabled", err)
+	}
+
+	// Both paths count what they see.
+	s.started(&closer, 41641)
+	socket := s.socketDiscoCount.Load()
+	c.receiveIP(testDiscoPacket, netip.MustParseAddrPort("192.0.2.1:1234"), &ippEndpointCache{}, false)
+	if got := s.socketDiscoCount.Load() - socket; got != 1 {
+		t.Errorf("ignored disco on the regular socket counted %d times; want 1", got)
+	}
+	conn := newTestConn(t)
+	defer conn.Close()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), nonTestDiscoPacket()), &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := conn.rawDisco4.recvCount.Load(); got != 1 {
+		t.Errorf("raw disco counted %d times; want 1", got)
+	}
+}
+
+func TestDumpRawDisco(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	src := netip.MustParseAddrPort("192.0.2.1:1234")
+
+	c.dumpRawDisco("ip4", []byte("TS\n"), src)
+	big := bytes.Repeat([]byte{0xab}, rawDiscoDumpMax+1)
+	c.dumpRawDisco("ip4", big, src)
+	want := []string{
+		"disco raw: rejected 3 byte ip4 packet from 192.0.2.1:1234: 54530a",
+		fmt.Sprintf("disco raw: rejected %d byte ip4 packet from 192.0.2.1:1234: %s...", len(big), strings.Repeat("ab", rawDiscoDumpMax)),
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("logs = %q; want %q", logs, want)
+	}
+
+	// Rate limited.
+	for i := 0; i < 100; i++ {
+		c.dumpRawDisco("ip4", big, src)
+	}
+	if len(logs) > 10 {
+		t.Errorf("%d packets logged; want rate limiting", len(logs))
+	}
+}
+
+func TestHandleRawDiscoDatagramDump(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_DUMP"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	conn.DiscoPublicKey() // generates our disco key
+	sendConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+	addTestEndpoint(t, conn, sendConn)
+	var dumped []string
+	conn.rawDisco4.mu.Lock()
+	conn.rawDisco4.dumpLogf = func(format string, args ...any) { dumped = append(dumped, fmt.Sprintf(format, args...)) }
+	conn.rawDisco4.mu.Unlock()
+	port := conn.pconn4.Port()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	// From an unknown disco key.
+	pkt := append(key.NewDisco().Public().AppendTo([]byte(disco.Magic)), make([]byte, disco.NonceLen+16)...)
+
+	envknob.Setenv(knob, "")
+	conn.handleRawDiscoDatagram(udpDatagram(port, pkt), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if len(dumped) != 0 {
+		t.Errorf("dumped without %s: %q", knob, dumped)
+	}
+	envknob.Setenv(knob, "1")
+	pkt[len(pkt)-1] = 1 // a new nonce, or it's dropped as a copy of the first
+	conn.handleRawDiscoDatagram(udpDatagram(port, pkt), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if len(dumped) != 1 || !strings.Contains(dumped[0], fmt.Sprintf("%x", pkt[:rawDiscoDumpMax])) {
+		t.Errorf("dumped %q; want one dump of the packet", dumped)
+	}
+}
+
+// ipv4Packet returns an IPv4 packet from 127.0.0.1 to 127.0.0.1
+// carrying udpDatagram(1, payload), as seen by the BPF filter on a raw
+// UDPv4 socket. opts, whose length must be a multiple of 4, are
+// appended to the header as IP options.
+func ipv4Packet(payload []byte, opts ...byte) []byte {
+	udp := udpDatagram(1, payload)
+	h := make([]byte, 20, 20+len(opts)+len(udp))
+	h[0] = 0x40 | byte(5+len(opts)/4) // version 4, IHL
+	binary.BigEndian.PutUint16(h[2:4], uint16(cap(h)))
+	h[8] = 64 // TTL
+	h[9] = 17 // UDP
+	copy(h[12:16], []byte{127, 0, 0, 1})
+	copy(h[16:20], []byte{127, 0, 0, 1})
+	h = append(h, opts...)
+	return append(h, udp...)
+}
+
+func TestStripIPv4Header(t *testing.T) {
+	udp := udpDatagram(1, testDiscoPacket)
+	withIHL := func(pkt []byte, ihl byte) []byte {
+		pkt[0] = 0x40 | ihl
+		return pkt
+	}
+	tests := []struct {
+		name string
+		pkt  []byte
+		want []byte
+	}{
+		{"no-options", ipv4Packet(testDiscoPacket), udp},
+		{"options", ipv4Packet(testDiscoPacket, 1, 1, 1, 0), udp},
+		{"many-options", ipv4Packet(testDiscoPacket, make([]byte, 40)...), udp},
+		{"ihl-too-small", withIHL(ipv4Packet(testDiscoPacket), 4), nil},
+		{"ihl-past-end", withIHL(ipv4Packet(nil)[:22], 6), nil},
+		{"short", ipv4Packet(nil)[:19], nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := stripIPv4Header(tt.pkt); !bytes.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("%s: got % x; want % x", tt.name, got, tt.want)
+		}
+	}
+
+	// And the result is ready for handleRawDiscoDatagram.
+	conn := newTestConn(t)
+	defer conn.Close()
+	disco := nonTestDiscoPacket()
+	pkt := ipv4Packet(disco, 1, 1, 1, 0)
+	binary.BigEndian.PutUint16(pkt[24+2:], conn.pconn4.Port())
+	before := metricRecvDiscoPacketIPv4.Value()
+	conn.handleRawDiscoDatagram(stripIPv4Header(pkt), &net.IPAddr{IP: net.IP{127, 0, 0, 1}}, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoPacketIPv4.Value() - before; got != 1 {
+		t.Errorf("disco packets handled = %d; want 1", got)
+	}
+}
+
+func TestRawDiscoErrLogf(t *testing.T) {
+	var logged int
+	c := &Conn{logf: func(format string, args ...any) {
+		if strings.HasPrefix(format, "disco raw reader failed") {
+			logged++
+		}
+	}}
+	fail := func(family string) {
+		c.rawDiscoErrLogf(family)("disco raw reader failed: %v", "oops")
+	}
+	for i := 0; i < 5; i++ {
+		fail("ip4")
+	}
+	if logged != 2 {
+		t.Fatalf("after 5 failures, logged %d; want 2", logged)
+	}
+	fail("ip6")
+	if logged != 3 {
+		t.Fatalf("ip6 failure not logged separately")
+	}
+
+	// Passing a health check resets the limit.
+	c.rawDisco4.echo = make(chan struct{})
+	c.rawDisco4.noteSelfTestEcho()
+	fail("ip4")
+	if logged != 4 {
+		t.Fatalf("failure after passed health check not logged")
+	}
+}
+
+func TestCloseWaitsForRawDiscoReaders(t *testing.T) {
+	conn := newTestConn(t)
+	var done atomic.Bool
+	conn.goRawDiscoReader(func() {
+		<-conn.donec
+		time.Sleep(10 * time.Millisecond)
+		done.Store(true)
+	})
+	conn.Close()
+	if !done.Load() {
+		t.Error("Close returned before raw disco reader")
+	}
+
+	started := make(chan bool, 1)
+	conn.goRawDiscoReader(func() { started <- true })
+	select {
+	case <-started:
+		t.Error("raw disco reader started after Close")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRawDiscoCounters(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	before := conn.RawDiscoCounters()
+	conn.handleRawDiscoDatagram(udpDatagram(0, nil), src, "ip4", rawDiscoRx{at: mono.Now()})
+	conn.handleRawDiscoDatagram(udpDatagram(0, nil)[:udpHeaderSize-1], src, "ip4", rawDiscoRx{at: mono.Now()})
+	disco := nonTestDiscoPacket()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), disco), src, "ip4", rawDiscoRx{at: mono.Now()})
+	conn.receiveIP(testDiscoPacket, netip.MustParseAddrPort("192.0.2.1:1234"), &ippEndpointCache{}, true)
+	conn.receiveIP(testDiscoPacket, netip.MustParseAddrPort("[2001:db8::1]:1234"), &ippEndpointCache{}, false)
+	got := conn.RawDiscoCounters()
+	want := before
+	want.PortZero++
+	want.Short++
+	want.RawIPv4++
+	want.RawBytesIPv4 += int64(len(disco))
+	want.SocketIPv4++
+	want.SocketIgnoredIPv6++
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+type testCloser struct {
+	closed int
+	err    error
+}
+
+func (c *testCloser) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestCloseOnError(t *testing.T) {
+	var err error
+	var c testCloser
+	closeOnError(&c, &err)
+	if c.closed != 0 || err != nil {
+		t.Errorf("on success: closed %d times, err = %v", c.closed, err)
+	}
+
+	failed := errors.New("failed")
+	err = failed
+	closeOnError(&c, &err)
+	if c.closed != 1 || err != failed {
+		t.Errorf("on failure: closed %d times, err = %v; want once, %v", c.closed, err, failed)
+	}
+
+	c = testCloser{err: net.ErrClosed}
+	err = failed
+	closeOnError(&c, &err)
+	if !errors.Is(err, failed) || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("on failure to close: err = %v; want both errors", err)
+	}
+}
+
+func TestRawDiscoDedup(t *testing.T) {
+	var d rawDiscoDedup
+	msg := nonTestDiscoPacket()
+	src := netip.MustParseAddrPort("192.0.2.1:1234")
+	now := mono.Now()
+	if d.recentlyRaw(now) {
+		t.Fatal("recentlyRaw before any raw packet")
+	}
+	if d.dup(msg, src, now, true) {
+		t.Fatal("first packet is a dup")
+	}
+	if !d.recentlyRaw(now) {
+		t.Error("recentlyRaw = false after a raw packet")
+	}
+	if !d.dup(msg, netip.MustParseAddrPort("[::ffff:192.0.2.1]:1234"), now.Add(time.Second), false) {
+		t.Error("copy with a mapped source isn't a dup")
+	}
+	other := append([]byte(nil), msg...)
+	other[len(other)-1]++
+	if d.dup(other, src, now, false) {
+		t.Error("different packet is a dup")
+	}
+	if d.dup(msg, netip.MustParseAddrPort("192.0.2.1:1235"), now, false) {
+		t.Error("different source is a dup")
+	}
+	later := now.Add(rawDiscoDedupTTL)
+	if d.dup(msg, src, later, false) || d.recentlyRaw(later) {
+		t.Error("remembered past rawDiscoDedupTTL")
+	}
+
+	for i := 0; i < 2*rawDiscoDedupMax; i++ {
+		binary.BigEndian.PutUint32(other[len(other)-4:], uint32(i))
+		d.dup(other, src, later, false)
+	}
+	if n := len(d.seen); n > rawDiscoDedupMax {
+		t.Errorf("remembering %d packets; want at most %d", n, rawDiscoDedupMax)
+	}
+	// The oldest were forgotten to make room; the newest weren't.
+	binary.BigEndian.PutUint32(other[len(other)-4:], 0)
+	if d.dup(other, src, later, false) {
+		t.Error("oldest packet still remembered past rawDiscoDedupMax")
+	}
+	binary.BigEndian.PutUint32(other[len(other)-4:], 2*rawDiscoDedupMax-1)
+	if !d.dup(other, src, later, false) {
+		t.Error("newest packet forgotten")
+	}
+}
+
+func TestRawDiscoKeyChanged(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	disco := nonTestDiscoPacket()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	conn.handleRawDiscoDatagram(udpDatagram(port, disco), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := conn.RawDiscoSources(); len(got) != 1 {
+		t.Fatalf("sources = %+v; want one", got)
+	}
+	conn.mu.Lock()
+	conn.rawDiscoKeyChanged()
+	conn.mu.Unlock()
+	if got := conn.RawDiscoSources(); len(got) != 0 {
+		t.Errorf("sources after key change = %+v; want none", got)
+	}
+
+	// A copy still to come across the change is handled again, not
+	// dropped.
+	before := conn.RawDiscoCounters().RawIPv4
+	conn.handleRawDiscoDatagram(udpDatagram(port, disco), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if n := conn.RawDiscoCounters().RawIPv4 - before; n != 1 {
+		t.Errorf("handled %d packets after key change; want 1", n)
+	}
+
+	// Creating the key counts as changing it.
+	c := newConn()
+	c.logf = t.Logf
+	c.rawDiscoSources.add(netip.MustParseAddr("192.0.2.1"), rawDiscoRx{})
+	c.DiscoPublicKey()
+	if got := c.RawDiscoSources(); len(got) != 0 {
+		t.Errorf("sources after creating the key = %+v; want none", got)
+	}
+}
+
+func TestRawDiscoPcap(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_RAW_DISCO_PCAP")
+	defer envknob.Setenv("TS_DEBUG_RAW_DISCO_PCAP", old)
+	path := filepath.Join(t.TempDir(), "disco.pcap")
+	envknob.Setenv("TS_DEBUG_RAW_DISCO_PCAP", path)
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	disco := nonTestDiscoPacket()
+	pkt := udpDatagram(port, disco)
+	recLen := pcapRecordLen + 20 + len(pkt)
+	conn.rawDiscoPcap.maxSize = int64(pcapHeaderLen + 2*recLen) // two packets a file
+	for i := 0; i < 3; i++ {
+		conn.handleRawDiscoDatagram(pkt, &net.IPAddr{IP: net.IPv4(192, 0, 2, byte(i))}, "ip4", rawDiscoRx{at: mono.Now()})
+	}
+	conn.Close()
+	conn.handleRawDiscoDatagram(pkt, &net.IPAddr{IP: net.IPv4(192, 0, 2, 3)}, "ip4", rawDiscoRx{at: mono.Now()})
+
+	// readPcap returns the source addresses of the packets in file,
+	// checking they're as written.
+	readPcap := func(file string) (srcs []netip.Addr) {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) < pcapHeaderLen || binary.LittleEndian.Uint32(b[0:4]) != pcapMagicNanos || binary.LittleEndian.Uint32(b[20:24]) != pcapLinkTypeRaw {
+			t.Fatalf("%s: bad pcap header in % x", file, b)
+		}
+		for b = b[pcapHeaderLen:]; len(b) > 0; b = b[recLen:] {
+			if len(b) < recLen || binary.LittleEndian.Uint32(b[8:12]) != uint32(recLen-pcapRecordLen) {
+				t.Fatalf("%s: bad record % x", file, b)
+			}
+			ip := b[pcapRecordLen:recLen]
+			if ip[0] != 0x45 || ip[9] != 17 || !bytes.Equal(ip[20:], pkt) {
+				t.Fatalf("%s: bad packet % x", file, ip)
+			}
+			srcs = append(srcs, netip.AddrFrom4(*(*[4]byte)(ip[12:16])))
+		}
+		return srcs
+	}
+	want := func(last ...byte) (ret []netip.Addr) {
+		for _, b := range last {
+			ret = append(ret, netip.AddrFrom4([4]byte{192, 0, 2, b}))
+		}
+		return ret
+	}
+	if got := readPcap(path + ".1"); !slices.Equal(got, want(0, 1)) {
+		t.Errorf("rotated file has packets from %v; want %v", got, want(0, 1))
+	}
+	if got := readPcap(path); !slices.Equal(got, want(2)) {
+		t.Errorf("file has packets from %v; want %v, and none after closing", got, want(2))
+	}
+}
+
+func TestRawDiscoCounts(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	msg := nonTestDiscoPacket()
+	msg[len(msg)-1] ^= 0xa5 // unlike other tests' packets, in case they ran recently
+
+	// Counted by the reader, to be flushed later.
+	s := &conn.rawDisco4
+	counts := conn.newRawDiscoCounts("ip4")
+	before := conn.RawDiscoCounters()
+	beforeRecv, beforeSize := s.recvCount.Load(), metricRecvDiscoRawSizeLt128.Value()
+	at := mono.Now().Add(time.Hour) // after anything else sets lastRecv
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: at, counts: counts})
+	if got := conn.RawDiscoCounters(); got != before {
+		t.Errorf("counters before flush = %+v; want unchanged, %+v", got, before)
+	}
+	if got := s.recvCount.Load(); got != beforeRecv {
+		t.Errorf("recvCount before flush = %d; want unchanged, %d", got, beforeRecv)
+	}
+	counts.flush()
+	want := before
+	want.RawIPv4++
+	want.RawBytesIPv4 += int64(len(msg))
+	if got := conn.RawDiscoCounters(); got != want {
+		t.Errorf("counters after flush = %+v; want %+v", got, want)
+	}
+	if got := s.recvCount.Load() - beforeRecv; got != 1 {
+		t.Errorf("recvCount after flush went up %d; want 1", got)
+	}
+	if got := mono.Time(s.lastRecv.Load()); got != at {
+		t.Errorf("lastRecv after flush = %v; want %v", got, at)
+	}
+	if got := metricRecvDiscoRawSizeLt128.Value() - beforeSize; got != 1 {
+		t.Errorf("%s counted %d after flush; want 1", metricRecvDiscoRawSizeLt128.Name(), got)
+	}
+	// Flushed once only.
+	counts.flush()
+	if got := conn.RawDiscoCounters(); got != want {
+		t.Errorf("counters after second flush = %+v; want %+v", got, want)
+	}
+
+	// A reader flushing late doesn't move lastRecv back.
+	s.noteRecv(1, at.Add(-time.Second))
+	if got := mono.Time(s.lastRecv.Load()); got != at {
+		t.Errorf("lastRecv after a late flush = %v; want %v", got, at)
+	}
+
+	// Or, without, straight to the metrics.
+	msg[len(msg)-1] ^= 0xff
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	want.RawIPv4++
+	want.RawBytesIPv4 += int64(len(msg))
+	if got := conn.RawDiscoCounters(); got != want {
+		t.Errorf("counters without a reader's = %+v; want %+v", got, want)
+	}
+}
+
+func TestRawDiscoWorkerCount(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_WORKERS"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	for _, tt := range []struct {
+		v    string
+		want int
+	}{
+		{"", 0},
+		{"1", 1},
+		{"4", 4},
+		{"0", 0},
+		{"-1", 0},
+		{strconv.Itoa(maxRawDiscoWorkers + 1), 0},
+	} {
+		envknob.Setenv(knob, tt.v)
+		if got := rawDiscoWorkerCount(); got != tt.want {
+			t.Errorf("%s=%q: got %d; want %d", knob, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRawDiscoWorkers(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_WORKERS"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	handled := func() int64 {
+		var n int64
+		for _, m := range []*clientmetric.Metric{metricRecvDiscoRawHandleLt100us, metricRecvDiscoRawHandleLt1ms, metricRecvDiscoRawHandleLt10ms, metricRecvDiscoRawHandleSlow} {
+			n += m.Value()
+		}
+		return n
+	}
+
+	// Without, packets are handled by the caller.
+	envknob.Setenv(knob, "")
+	conn := newTestConn(t)
+	defer conn.Close()
+	msg := nonTestDiscoPacket()
+	msg[len(msg)-1] ^= 0x3c // unlike other tests' packets, so it's not a dup
+	before := handled()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := handled() - before; got != 1 {
+		t.Errorf("handled %d packets inline; want 1", got)
+	}
+
+	// With, by the workers.
+	envknob.Setenv(knob, "2")
+	conn = newTestConn(t)
+	defer conn.Close()
+	msg[len(msg)-1] ^= 0xff
+	before = handled()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	for deadline := time.Now().Add(5 * time.Second); handled() == before; {
+		if time.Now().After(deadline) {
+			t.Fatal("packet not handled by a worker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// They get a copy, the reader's buffer being reused, and once
+	// they're behind, packets are dropped rather than waited for.
+	c := newConn()
+	c.logf = t.Logf
+	c.rawDiscoWorkers.once.Do(func() {})
+	c.rawDiscoWorkers.ch = make(chan rawDiscoWork, 1) // and no workers to empty it
+	dropped := metricRecvDiscoRawWorkerDropped.Value()
+	buf := append([]byte(nil), msg...)
+	for i := 0; i < 2; i++ {
+		if !c.queueRawDisco("ip4", buf, netip.MustParseAddrPort("192.0.2.1:1234"), mono.Now()) {
+			t.Fatal("queueRawDisco with workers = false")
+		}
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	if w := <-c.rawDiscoWorkers.ch; !bytes.Equal(w.msg, msg) {
+		t.Errorf("queued %x; want %x", w.msg, msg)
+	}
+	if got := metricRecvDiscoRawWorkerDropped.Value() - dropped; got != 1 {
+		t.Errorf("dropped %d packets; want 1", got)
+	}
+}
+
+func TestRecentRawDisco(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	if got := conn.RecentRawDisco(); len(got) != 0 {
+		t.Fatalf("RecentRawDisco = %+v; want none yet", got)
+	}
+
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	msg := nonTestDiscoPacket()
+	msg[len(msg)-1] ^= 0x69 // unlike other tests' packets, so it's not a dup
+	start := time.Now()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	// Dropped, so not included.
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port()+1, msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	got := conn.RecentRawDisco()
+	if len(got) != 1 {
+		t.Fatalf("RecentRawDisco = %+v; want one", got)
+	}
+	want := RawDiscoPacket{
+		Src:     netip.MustParseAddrPort("192.0.2.1:1234"),
+		Size:    len(msg),
+		Family:  "ip4",
+		At:      got[0].At,
+		Version: 1,
+	}
+	if got[0] != want {
+		t.Errorf("RecentRawDisco = %+v; want %+v", got[0], want)
+	}
+	if at := got[0].At; at.Before(start.Add(-time.Second)) || at.After(time.Now().Add(time.Second)) {
+		t.Errorf("At = %v; want around %v", at, start)
+	}
+
+	// Once full, the oldest are overwritten.
+	for i := 0; i < rawDiscoHistoryLen+2; i++ {
+		conn.rawDiscoHistory.add(rawDiscoHistoryEntry{size: i})
+	}
+	got = conn.RecentRawDisco()
+	if len(got) != rawDiscoHistoryLen {
+		t.Fatalf("len(RecentRawDisco) = %d; want %d", len(got), rawDiscoHistoryLen)
+	}
+	for i, p := range got {
+		if p.Size != i+2 {
+			t.Fatalf("RecentRawDisco()[%d].Size = %d; want %d", i, p.Size, i+2)
+		}
+	}
+}
+
+func TestDiscoMulticastGroup(t *testing.T) {
+	const knob = "TS_DEBUG_DISCO_MULTICAST"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	for _, tt := range []struct {
+		v    string
+		want string // or empty if invalid
+	}{
+		{"", ""},
+		{"239.1.2.3:4567", "239.1.2.3:4567"},
+		{"[ff02::1234]:4567", "[ff02::1234]:4567"},
+		{"[ff02::1234%eth0]:4567", ""},
+		{"192.0.2.1:4567", ""},
+		{"239.1.2.3:0", ""},
+		{"239.1.2.3", ""},
+	} {
+		envknob.Setenv(knob, tt.v)
+		got := ""
+		if group, ok := discoMulticastGroup(); ok {
+			got = group.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s=%q: got %q; want %q", knob, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestHandleDiscoMulticast(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	var got [][]byte
+	c.SetDiscoMulticastFunc(func(pkt []byte, src netip.AddrPort) {
+		got = append(got, append([]byte(nil), pkt...))
+	})
+	src := netip.MustParseAddrPort("192.0.2.1:1234")
+	disco := nonTestDiscoPacket()
+	received, dropped := metricRecvDiscoMulticast.Value(), metricRecvDiscoMulticastDropped.Value()
+	c.handleDiscoMulticast(disco, src)
+	c.handleDiscoMulticast([]byte("not disco"), src)
+	c.handleDiscoMulticast(append(append([]byte(nil), disco...), make([]byte, rawDiscoMaxSize())...), src)
+	if len(got) != 1 || !bytes.Equal(got[0], disco) {
+		t.Errorf("passed %q; want just the disco", got)
+	}
+	if n := metricRecvDiscoMulticast.Value() - received; n != 1 {
+		t.Errorf("received %d; want 1", n)
+	}
+	if n := metricRecvDiscoMulticastDropped.Value() - dropped; n != 2 {
+		t.Errorf("dropped %d; want 2", n)
+	}
+
+	// Without a func, they're just counted.
+	c.SetDiscoMulticastFunc(nil)
+	c.handleDiscoMulticast(disco, src)
+	if len(got) != 1 {
+		t.Errorf("passed %d after removing the func; want none more", len(got)-1)
+	}
+}
+
+func TestDiscoMulticast(t *testing.T) {
+	const knob = "TS_DEBUG_DISCO_MULTICAST"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	group := netip.AddrPortFrom(netip.MustParseAddr("239.255.41.41"), pickPort(t))
+	envknob.Setenv(knob, group.String())
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	conn.mu.Lock()
+	joined := conn.discoMulticastConn != nil
+	conn.mu.Unlock()
+	if !joined {
+		t.Skip("couldn't join the multicast group")
+	}
+	got := make(chan []byte, 1)
+	conn.SetDiscoMulticastFunc(func(pkt []byte, src netip.AddrPort) {
+		select {
+		case got <- append([]byte(nil), pkt...):
+		default:
+		}
+	})
+	uc, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	disco := nonTestDiscoPacket()
+	if _, err := uc.WriteToUDPAddrPort(disco, group); err != nil {
+		t.Skipf("can't send to the multicast group: %v", err)
+	}
+	select {
+	case pkt := <-got:
+		if !bytes.Equal(pkt, disco) {
+			t.Errorf("got % x; want % x", pkt, disco)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("multicast disco not received")
+	}
+}
+
+func TestRawDiscoDedupPaths(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	msg := nonTestDiscoPacket()
+	msg[len(msg)-1] ^= 0xff // unlike other tests' packets, in case they ran recently
+
+	before := conn.RawDiscoCounters()
+	dedupBefore := metricRecvDiscoDedup.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), msg), src, "ip4", rawDiscoRx{at: mono.Now()})
+	conn.receiveIP(msg, netip.MustParseAddrPort("192.0.2.1:1234"), &ippEndpointCache{}, true)
+	got := conn.RawDiscoCounters()
+	want := before
+	want.RawIPv4++
+	want.RawBytesIPv4 += int64(len(msg))
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if n := metricRecvDiscoDedup.Value() - dedupBefore; n != 2 {
+		t.Errorf("dedup hits = %d; want 2", n)
+	}
+}
+
+func TestRawDiscoSources(t *testing.T) {
+	var c Conn
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("2001:db8::1")
+	hw := time.Unix(1e9, 1)
+	c.rawDiscoSources.add(a, rawDiscoRx{})
+	c.rawDiscoSources.add(b, rawDiscoRx{ifIndex: 1})
+	c.rawDiscoSources.add(b, rawDiscoRx{ifIndex: 2, hwTime: hw, flowLabel: 0x12345})
+	got := c.RawDiscoSources()
+	if len(got) != 2 || got[0].Addr != b || got[0].Packets != 2 || got[1].Addr != a || got[1].Packets != 1 {
+		t.Fatalf("got %+v; want %v twice then %v once", got, b, a)
+	}
+	if got[0].IfIndex != 2 || got[1].IfIndex != 0 {
+		t.Errorf("interfaces = %d, %d; want the last seen, 2 and 0", got[0].IfIndex, got[1].IfIndex)
+	}
+	if !got[0].LastHWTime.Equal(hw) || !got[1].LastHWTime.IsZero() {
+		t.Errorf("hardware times = %v, %v; want %v and none", got[0].LastHWTime, got[1].LastHWTime, hw)
+	}
+	if got[0].FlowLabel != 0x12345 || got[1].FlowLabel != 0 {
+		t.Errorf("flow labels = %#x, %#x; want the last seen, 0x12345 and none", got[0].FlowLabel, got[1].FlowLabel)
+	}
+	if prev := c.rawDiscoSources.add(b, rawDiscoRx{flowLabel: 0x54321}); prev != 0x12345 {
+		t.Errorf("add returned previous flow label %#x; want 0x12345", prev)
+	}
+
+	// Seeing rawDiscoSourcesMax more sources forgets b, then a,
+	// whichever was seen least recently first.
+	c.rawDiscoSources.add(a, rawDiscoRx{ifIndex: 0})
+	for i := 0; i < rawDiscoSourcesMax-1; i++ {
+		c.rawDiscoSources.add(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}), rawDiscoRx{})
+	}
+	got = c.RawDiscoSources()
+	if len(got) != rawDiscoSourcesMax {
+		t.Fatalf("got %d sources; want %d", len(got), rawDiscoSourcesMax)
+	}
+	if got[0].Addr != a || got[0].Packets != 2 {
+		t.Errorf("busiest = %+v; want %v with 2 packets", got[0], a)
+	}
+	for _, src := range got {
+		if src.Addr == b {
+			t.Errorf("%v not evicted", b)
+		}
+	}
+}
+
+func TestRawDiscoVersion(t *testing.T) {
+	if got := rawDiscoVersion(testDiscoPacket); got != 1 {
+		t.Errorf("version of testDiscoPacket = %d; want 1", got)
+	}
+	bogus := append([]byte(nil), testDiscoPacket...)
+	bogus[5]++
+	if got := rawDiscoVersion(bogus); got != 0 {
+		t.Errorf("version with bogus magic = %d; want 0", got)
+	}
+	if got := rawDiscoVersion(testDiscoPacket[:5]); got != 0 {
+		t.Errorf("version of short packet = %d; want 0", got)
+	}
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	before := metricRecvDiscoRawVersion[1].Value()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), nonTestDiscoPacket()), &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoRawVersion[1].Value() - before; got != 1 {
+		t.Errorf("v1 packets counted = %d; want 1", got)
+	}
+}
+
+func TestIsTransientRawDiscoErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{os.NewSyscallError("recvmmsg", syscall.ENOBUFS), true},
+		{&net.OpError{Op: "read", Net: "ip4", Err: os.NewSyscallError("recvfrom", syscall.EINTR)}, true},
+		{syscall.EAGAIN, true},
+		{os.NewSyscallError("recvmmsg", syscall.EBADF), false},
+		{net.ErrClosed, false},
+		{errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientRawDiscoErr(tt.err); got != tt.want {
+			t.Errorf("isTransientRawDiscoErr(%v) = %v; want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNoteRawDiscoHandleTime(t *testing.T) {
+	var logs []string
+	c := &Conn{logf: func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }}
+	tests := []struct {
+		d    time.Duration
+		m    *clientmetric.Metric
+		slow bool
+	}{
+		{50 * time.Microsecond, metricRecvDiscoRawHandleLt100us, false},
+		{100 * time.Microsecond, metricRecvDiscoRawHandleLt1ms, false},
+		{5 * time.Millisecond, metricRecvDiscoRawHandleLt10ms, false},
+		{rawDiscoSlowHandle, metricRecvDiscoRawHandleSlow, true},
+	}
+	for _, tt := range tests {
+		logs = nil
+		before := tt.m.Value()
+		c.noteRawDiscoHandleTime("ip4", tt.d)
+		if got := tt.m.Value() - before; got != 1 {
+			t.Errorf("%v: %s counted %d; want 1", tt.d, tt.m.Name(), got)
+		}
+		if got := len(logs) > 0; got != tt.slow {
+			t.Errorf("%v: logged = %v; want %v", tt.d, got, tt.slow)
+		}
+	}
+}
+
+func TestRawDiscoSizeMetric(t *testing.T) {
+	tests := []struct {
+		n int
+		m *clientmetric.Metric
+	}{
+		{0, metricRecvDiscoRawSizeLt128},
+		{127, metricRecvDiscoRawSizeLt128},
+		{128, metricRecvDiscoRawSizeLt256},
+		{511, metricRecvDiscoRawSizeLt512},
+		{1000, metricRecvDiscoRawSizeLt1024},
+		{2047, metricRecvDiscoRawSizeLt2048},
+		{2048, metricRecvDiscoRawSizeLarge},
+		{defaultRawDiscoMaxSize, metricRecvDiscoRawSizeLarge},
+	}
+	for _, tt := range tests {
+		if got := rawDiscoSizeMetric(tt.n); got != tt.m {
+			t.Errorf("%d: counted in %s; want %s", tt.n, got.Name(), tt.m.Name())
+		}
+	}
+
+	// Counted for whatever's accepted, dropped or not, but not the
+	// self-test's own.
+	conn := newTestConn(t)
+	defer conn.Close()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	before := metricRecvDiscoRawSizeLt128.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port()+1, nonTestDiscoPacket()), src, "ip4", rawDiscoRx{at: mono.Now()})
+	conn.handleRawDiscoDatagram(udpDatagram(conn.pconn4.Port(), testDiscoPacket), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoRawSizeLt128.Value() - before; got != 1 {
+		t.Errorf("%s counted %d; want 1", metricRecvDiscoRawSizeLt128.Name(), got)
+	}
+}
+
+func TestNoteKernelDrops(t *testing.T) {
+	var s rawDiscoState
+	before := metricRecvDiscoRawKernelDrops.Value()
+	for _, n := range []uint32{0, 3, 2, 5} { // 2 from a reader behind the others
+		s.noteKernelDrops(n)
+	}
+	if got := metricRecvDiscoRawKernelDrops.Value() - before; got != 5 {
+		t.Errorf("kernel drops counted = %d; want 5", got)
+	}
+	if _, drops := s.kernelStats(); drops != 5 {
+		t.Errorf("kernelStats drops = %d; want 5", drops)
+	}
+	s.stopped(nil)
+	if _, drops := s.kernelStats(); drops != 0 {
+		t.Errorf("kernelStats drops after stopping = %d; want 0", drops)
+	}
+}
+
+func TestHandleRawDiscoDatagramPanic(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		if strings.Contains(msg, "port 0") {
+			panic("boom")
+		}
+		logs = append(logs, msg)
+	}
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	before := metricRecvDiscoRawPanics.Value()
+	for i := 0; i < 2; i++ {
+		c.handleRawDiscoDatagram(udpDatagram(0, nil), src, "ip4", rawDiscoRx{at: mono.Now()})
+	}
+	if got := metricRecvDiscoRawPanics.Value() - before; got != 2 {
+		t.Errorf("panics counted = %d; want 2", got)
+	}
+	if len(logs) == 0 || !strings.Contains(logs[0], "boom") {
+		t.Errorf("logs = %q; want the panic", logs)
+	}
+}
+
+func TestRawDiscoEvents(t *testing.T) {
+	old := os.Getenv("TS_DEBUG_DISABLE_RAW_DISCO")
+	defer envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", old)
+	envknob.Setenv("TS_DEBUG_DISABLE_RAW_DISCO", "1")
+
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	events := func() (ret []string) {
+		for _, l := range logs {
+			if strings.Contains(l, `"rawdisco"`) {
+				ret = append(ret, l)
+			}
+		}
+		return ret
+	}
+
+	c.tryStartRawDisco("ip4")
+	want := "[v\x00JSON]1" + `{"rawdisco":{"Family":"ip4","Event":"disabled","Reason":"raw disco listening disabled by debug flag"}}`
+	if got := events(); len(got) != 1 || got[0] != want {
+		t.Errorf("events = %q; want %q", got, want)
+	}
+
+	// Retries failing again are no news.
+	logs = nil
+	c.rawDisco4.retrying = true
+	c.tryStartRawDisco("ip4")
+	if got := events(); len(got) != 0 {
+		t.Errorf("events on retry = %q; want none", got)
+	}
+}
+
+func TestRawDiscoHealth(t *testing.T) {
+	defer health.SetRawDiscoHealth(nil)
+	c := newConn()
+	c.logf = t.Logf
+	timeout := fmt.Errorf("%w: health check", ErrRawDiscoSelfTestTimeout)
+	install := fmt.Errorf("%w: boom", ErrRawDiscoBPFInstall)
+
+	steps := []struct {
+		family, event string
+		err           error
+		want          []string // in the health error, or none if healthy
+	}{
+		{"ip4", "disabled", ErrRawDiscoUnsupported, nil},
+		{"ip6", "fallback", timeout, []string{"ip6: " + timeout.Error()}},
+		{"ip4", "fallback", install, []string{"ip4: " + install.Error(), "ip6: " + timeout.Error()}},
+		{"ip6", "restarted", nil, []string{"ip4: " + install.Error()}},
+		{"ip4", "started", nil, nil},
+	}
+	for _, st := range steps {
+		c.logRawDiscoEvent(st.family, st.event, st.err)
+		err := health.RawDiscoHealth()
+		if (err == nil) != (len(st.want) == 0) {
+			t.Errorf("after %s %s: health = %v; want %q", st.family, st.event, err, st.want)
+			continue
+		}
+		for _, w := range st.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("after %s %s: health = %q; want it to include %q", st.family, st.event, err, w)
+			}
+		}
+		if len(st.want) == 1 && strings.Contains(err.Error(), "ip4") == strings.Contains(err.Error(), "ip6") {
+			t.Errorf("after %s %s: health = %q; want just %q", st.family, st.event, err, st.want[0])
+		}
+	}
+
+	// Closing clears any failure.
+	c.logRawDiscoEvent("ip6", "fallback", timeout)
+	if err := health.RawDiscoHealth(); !errors.Is(err, ErrRawDiscoSelfTestTimeout) {
+		t.Errorf("health = %v; want an ErrRawDiscoSelfTestTimeout", err)
+	}
+	c.rawDiscoHealth.clear()
+	if err := health.RawDiscoHealth(); err != nil {
+		t.Errorf("health after clear = %v; want nil", err)
+	}
+}
+
+func TestTestDiscoPacket(t *testing.T) {
+	var magic [6]byte
+	binary.BigEndian.PutUint32(magic[:4], discoMagic1)
+	binary.BigEndian.PutUint16(magic[4:], discoMagic2)
+	if !bytes.HasPrefix(testDiscoPacket, magic[:]) {
+		t.Errorf("testDiscoPacket starts % x; want % x", testDiscoPacket[:6], magic)
+	}
+	if !disco.LooksLikeDiscoWrapper(testDiscoPacket) {
+		t.Error("testDiscoPacket doesn't look like disco")
+	}
+}
+
+func FuzzRawDiscoDatagram(f *testing.F) {
+	conn, err := NewConn(Options{
+		Logf:                   logger.Discard,
+		Port:                   pickPort(f),
+		TestOnlyPacketListener: localhostListener{},
+		EndpointsFunc:          func([]tailcfg.Endpoint) {},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer conn.Close()
+	port4, port6 := conn.pconn4.Port(), conn.pconn6.Port()
+
+	disco := nonTestDiscoPacket()
+	v4 := ipv4Packet(disco, 1, 1, 1, 0)
+	binary.BigEndian.PutUint16(v4[24+2:], port4)
+	f.Add(v4, []byte{192, 0, 2, 1}, "", false)
+	f.Add(ipv4Packet(disco)[:25], []byte{192, 0, 2, 1}, "", false)
+	f.Add(udpDatagram(port6, disco), []byte(net.ParseIP("fe80::1")), "eth0", true)
+	f.Add(udpDatagram(port6, nil)[:5], []byte(net.ParseIP("2001:db8::1")), "", true)
+
+	f.Fuzz(func(t *testing.T, pkt, srcIP []byte, zone string, isIPv6 bool) {
+		// Raw IPv6 sockets give us the datagram from its UDP header
+		// on; raw IPv4 ones, with recvmmsg, from the IP header.
+		family, b, port := "ip4", stripIPv4Header(pkt), port4
+		if isIPv6 {
+			family, b, port = "ip6", pkt, port6
+		}
+		before := metricRecvDiscoPacketIPv4.Value() + metricRecvDiscoPacketIPv6.Value()
+		conn.handleRawDiscoDatagram(b, &net.IPAddr{IP: srcIP, Zone: zone}, family, rawDiscoRx{at: mono.Now()})
+		handled := metricRecvDiscoPacketIPv4.Value()+metricRecvDiscoPacketIPv6.Value() > before
+
+		want := len(b) >= udpHeaderSize &&
+			port != 0 && binary.BigEndian.Uint16(b[2:4]) == port &&
+			(len(srcIP) == 4 || len(srcIP) == 16) &&
+			!isZeroDiscoSender(b[udpHeaderSize:])
+		if handled != want {
+			t.Errorf("passed on = %v; want %v", handled, want)
+		}
+	})
+}
+
+func TestRawDiscoFilters(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	v4, v6, err := conn.RawDiscoFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		dump string
+		prog []bpf.Instruction
+	}{
+		{"v4", v4, magicsockFilterV4(rawDiscoMagics, conn.pconn4.Port())},
+		{"v6", v6, magicsockFilterV6(rawDiscoMagics, conn.pconn6.Port())},
+	} {
+		lines := strings.Split(strings.TrimSuffix(tt.dump, "\n"), "\n")
+		if len(lines) != len(tt.prog) {
+			t.Errorf("%s: %d lines; want %d:\n%s", tt.name, len(lines), len(tt.prog), tt.dump)
+			continue
+		}
+		if want := "(000) " + fmt.Sprint(tt.prog[0]); !strings.HasPrefix(lines[0], want) {
+			t.Errorf("%s: first line %q; want prefix %q", tt.name, lines[0], want)
+		}
+	}
+}
+
+func TestAssembleBPF(t *testing.T) {
+	prog := func(port uint16) []bpf.Instruction { return magicsockFilterV4(rawDiscoMagics, port) }
+	a, err := assembleBPF(prog(41641))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := bpf.Assemble(prog(41641))
+	if !reflect.DeepEqual(a, want) {
+		t.Fatalf("assembled %v; want %v", a, want)
+	}
+	if b, _ := assembleBPF(prog(41641)); &b[0] != &a[0] {
+		t.Error("same program assembled again")
+	}
+	if b, _ := assembleBPF(prog(41642)); &b[0] == &a[0] {
+		t.Error("different program given the same assembly")
+	}
+
+	// Older programs are forgotten.
+	for i := 0; i < bpfAsmCacheSize; i++ {
+		assembleBPF(prog(uint16(1000 + i)))
+	}
+	if b, _ := assembleBPF(prog(41641)); &b[0] == &a[0] {
+		t.Error("cache not bounded")
+	}
+
+	bad := []bpf.Instruction{bpf.LoadAbsolute{Off: 0, Size: 3}}
+	for i := 0; i < 2; i++ {
+		if _, err := assembleBPF(bad); err == nil {
+			t.Errorf("attempt %d: assembled an invalid program", i)
+		}
+	}
+}
+
+// TestAssembleRawDiscoFilters checks that the built-in filters
+// assemble with all their options, so that an assembly error shows up
+// here rather than when a receiver restarts.
+func TestAssembleRawDiscoFilters(t *testing.T) {
+	encap := rawDiscoMagics[0]
+	encap.offset = maxRawDiscoEncapOffset
+	for _, magics := range [][]rawDiscoMagic{
+		rawDiscoMagics,
+		append(slices.Clip(rawDiscoMagics), rawDiscoSTUNMatch),
+		append(slices.Clip(rawDiscoMagics), rawDiscoSTUNMatch, encap),
+	} {
+		for _, port := range []uint16{0, 41641} {
+			for name, prog := range map[string][]bpf.Instruction{
+				"v4": magicsockFilterV4(magics, port),
+				"v6": magicsockFilterV6(magics, port),
+			} {
+				if _, err := bpf.Assemble(prog); err != nil {
+					t.Errorf("%s with %d magics, port %d: %v", name, len(magics), port, err)
+				}
+			}
+		}
+	}
+}
+
+// dddBPF formats prog as tcpdump -ddd would, with sep between lines.
+func dddBPF(t *testing.T, prog []bpf.Instruction, sep string) string {
+	t.Helper()
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{strconv.Itoa(len(raw))}
+	for _, r := range raw {
+		lines = append(lines, fmt.Sprintf("%d %d %d %d", r.Op, r.Jt, r.Jf, r.K))
+	}
+	return strings.Join(lines, sep)
+}
+
+func TestParseBPF(t *testing.T) {
+	builtin := magicsockFilterV4(rawDiscoMagics, 0)
+	want, err := bpf.Assemble(builtin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sep := range []string{"\n", ",", "\r\n"} {
+		got, err := parseBPF(dddBPF(t, builtin, sep) + sep)
+		if err != nil {
+			t.Errorf("sep %q: %v", sep, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("sep %q: got %v; want %v", sep, got, want)
+		}
+	}
+	for _, bad := range []string{
+		"",
+		"0",
+		"x\n6 0 0 0",
+		"2\n6 0 0 0",
+		"1\n6 0 0",
+		"1\n6 0 256 0",
+		"1\n6 0 0 -1",
+		strconv.Itoa(maxBPFLen+1) + strings.Repeat(",6 0 0 0", maxBPFLen+1),
+	} {
+		if _, err := parseBPF(bad); err == nil {
+			t.Errorf("parseBPF(%.20q) succeeded", bad)
+		}
+	}
+}
+
+func TestCheckCustomBPF(t *testing.T) {
+	tests := []struct {
+		name string
+		prog []bpf.Instruction
+		ok   bool
+	}{
+		{"builtin-v4", magicsockFilterV4(rawDiscoMagics, 41641), true},
+		{"builtin-v6", magicsockFilterV6(rawDiscoMagics, 0), true},
+		{"ret-a", []bpf.Instruction{bpf.LoadAbsolute{Off: 0, Size: 1}, bpf.RetA{}}, true},
+		{"accept-all", []bpf.Instruction{bpf.RetConstant{Val: 0xffffffff}}, false},
+		{"drop-unreachable", []bpf.Instruction{
+			bpf.Jump{Skip: 1},
+			bpf.RetConstant{Val: 0},
+			bpf.RetConstant{Val: 0xffffffff},
+		}, false},
+		{"jump-past-end", []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 2},
+			bpf.RetConstant{Val: 0},
+		}, false},
+		{"runs-off-end", []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+			bpf.RetConstant{Val: 0},
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+		}, false},
+	}
+	for _, tt := range tests {
+		if err := checkCustomBPF(tt.prog); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRawDiscoFilterOverride(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_BPF_V4"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+
+	envknob.Setenv(knob, "")
+	if prog, custom, err := rawDiscoFilter("ip4", 1); err != nil || custom || !reflect.DeepEqual(prog, magicsockFilterV4(rawDiscoFilterMagics(), 1)) {
+		t.Errorf("without %s: custom=%v, err=%v; want the builtin filter", knob, custom, err)
+	}
+
+	// Only the given family is overridden, for any port. The program
+	// comes back disassembled, so compare it assembled.
+	want := magicsockFilterV4(rawDiscoMagics, 0)
+	sameBPF := func(a, b []bpf.Instruction) bool {
+		ra, err := bpf.Assemble(a)
+		if err != nil {
+			return false
+		}
+		rb, err := bpf.Assemble(b)
+		return err == nil && reflect.DeepEqual(ra, rb)
+	}
+	envknob.Setenv(knob, dddBPF(t, want, ","))
+	if prog, custom, err := rawDiscoFilter("ip4", 1); err != nil || !custom || !sameBPF(prog, want) {
+		t.Errorf("inline: got %v, custom=%v, err=%v; want %v", prog, custom, err, want)
+	}
+	if _, custom, _ := rawDiscoFilter("ip6", 1); custom {
+		t.Error("ip6 filter overridden too")
+	}
+
+	file := filepath.Join(t.TempDir(), "filter")
+	if err := os.WriteFile(file, []byte(dddBPF(t, want, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	envknob.Setenv(knob, "@"+file)
+	if prog, custom, err := rawDiscoFilter("ip4", 1); err != nil || !custom || !sameBPF(prog, want) {
+		t.Errorf("from file: got %v, custom=%v, err=%v; want %v", prog, custom, err, want)
+	}
+
+	envknob.Setenv(knob, "1,6 0 0 4294967295")
+	if _, _, err := rawDiscoFilter("ip4", 1); err == nil {
+		t.Error("accept-all filter accepted")
+	}
+	envknob.Setenv(knob, "@"+file+".missing")
+	if _, _, err := rawDiscoFilter("ip4", 1); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestAppendRawDiscoPorts(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	if got, want := conn.appendRawDiscoPorts(nil, "ip4"), []uint16{conn.pconn4.Port()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ip4 ports = %v; want %v", got, want)
+	}
+
+	c := newConn()
+	if got := c.appendRawDiscoPorts(nil, "ip6"); len(got) != 0 {
+		t.Errorf("unbound ip6 ports = %v; want none", got)
+	}
+
+	// Recently unbound, its port is still accepted, for a while.
+	c.rawDisco6.notePortRetired(41641)
+	if got, want := c.appendRawDiscoPorts(nil, "ip6"), []uint16{41641}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently unbound ip6 ports = %v; want %v", got, want)
+	}
+	c.rawDisco6.oldPortUntil.Store(int64(mono.Now().Add(-time.Second)))
+	if got := c.appendRawDiscoPorts(nil, "ip6"); len(got) != 0 {
+		t.Errorf("ip6 ports after grace = %v; want none", got)
+	}
+
+	// Rebound to another port, both are, and the current one first.
+	conn.rawDisco4.notePortRetired(41641)
+	if got, want := conn.appendRawDiscoPorts(nil, "ip4"), []uint16{conn.pconn4.Port(), 41641}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently rebound ip4 ports = %v; want %v", got, want)
+	}
+}
+
+func TestPauseRawDisco(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	conn.rawDisco4.active.Store(true) // as if running
+	defer conn.rawDisco4.active.Store(false)
+	port := conn.pconn4.Port()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	conn.PauseRawDisco()
+	if conn.rawDiscoHandling("ip4") {
+		t.Error("raw disco still handling after PauseRawDisco")
+	}
+	if !conn.RawDiscoStatus().Paused {
+		t.Error("status not paused")
+	}
+	paused, accepted := metricRecvDiscoRawPaused.Value(), metricRecvDiscoPacketIPv4.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(port, nonTestDiscoPacket()), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoRawPaused.Value() - paused; got != 1 {
+		t.Errorf("paused drops = %d; want 1", got)
+	}
+	if metricRecvDiscoPacketIPv4.Value() != accepted {
+		t.Error("packet handled while paused")
+	}
+
+	conn.ResumeRawDisco()
+	if !conn.rawDiscoHandling("ip4") {
+		t.Error("raw disco not handling after ResumeRawDisco")
+	}
+	conn.handleRawDiscoDatagram(udpDatagram(port, nonTestDiscoPacket()), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoPacketIPv4.Value() - accepted; got != 1 {
+		t.Errorf("packets handled after resuming = %d; want 1", got)
+	}
+}
+
+func TestSetRawDiscoObserver(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	disco := nonTestDiscoPacket()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	type observation struct {
+		src        netip.AddrPort
+		payloadLen int
+		family     string
+	}
+	got := make(chan observation, 1)
+	conn.SetRawDiscoObserver(func(src netip.AddrPort, payloadLen int, family string) {
+		got <- observation{src, payloadLen, family}
+	})
+	conn.handleRawDiscoDatagram(udpDatagram(port, disco), src, "ip4", rawDiscoRx{at: mono.Now()})
+	want := observation{netip.MustParseAddrPort("192.0.2.1:1234"), len(disco), "ip4"}
+	select {
+	case ob := <-got:
+		if ob != want {
+			t.Errorf("observed %+v; want %+v", ob, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not observed")
+	}
+
+	// A stuck observer doesn't hold up the receiver.
+	block := make(chan struct{})
+	defer close(block)
+	conn.SetRawDiscoObserver(func(netip.AddrPort, int, string) { <-block })
+	dropped := metricRecvDiscoRawObserverDropped.Value()
+	for i := 0; i < rawDiscoObserverQueueLen+2; i++ {
+		disco[len(disco)-1] = byte(i + 1) // not a copy of the last; see rawDiscoDedup
+		conn.handleRawDiscoDatagram(udpDatagram(port, disco), src, "ip4", rawDiscoRx{at: mono.Now()})
+	}
+	if metricRecvDiscoRawObserverDropped.Value() == dropped {
+		t.Error("no packets dropped for a stuck observer")
+	}
+
+	conn.SetRawDiscoObserver(nil)
+	if conn.rawDiscoObserver.Load() != nil {
+		t.Error("observer not removed")
+	}
+}
+
+func TestRawDiscoSourceAllowlist(t *testing.T) {
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	disco := nonTestDiscoPacket()
+
+	if err := conn.SetRawDiscoSourceAllowlist([]netip.Prefix{{}}); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+	if err := conn.SetRawDiscoSourceAllowlist([]netip.Prefix{netip.MustParsePrefix("100.64.0.0/10"), netip.MustParsePrefix("fe80::/64")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		src     *net.IPAddr
+		allowed bool
+	}{
+		{&net.IPAddr{IP: net.IPv4(100, 100, 1, 2)}, true},
+		{&net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, false},
+		{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, true},
+		{&net.IPAddr{IP: net.ParseIP("2001:db8::1")}, false},
+	} {
+		denied, accepted := metricRecvDiscoRawSrcDenied.Value(), metricRecvDiscoPacketIPv4.Value()+metricRecvDiscoPacketIPv6.Value()
+		conn.handleRawDiscoDatagram(udpDatagram(port, disco), tt.src, "ip4", rawDiscoRx{at: mono.Now()})
+		gotDenied := metricRecvDiscoRawSrcDenied.Value() - denied
+		gotAccepted := metricRecvDiscoPacketIPv4.Value() + metricRecvDiscoPacketIPv6.Value() - accepted
+		if tt.allowed && (gotDenied != 0 || gotAccepted != 1) || !tt.allowed && (gotDenied != 1 || gotAccepted != 0) {
+			t.Errorf("%v: denied %d, accepted %d; want allowed=%v", tt.src, gotDenied, gotAccepted, tt.allowed)
+		}
+	}
+
+	// Removing the allowlist lets everything in again.
+	if err := conn.SetRawDiscoSourceAllowlist(nil); err != nil {
+		t.Fatal(err)
+	}
+	accepted := metricRecvDiscoPacketIPv4.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(port, disco), &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoPacketIPv4.Value() - accepted; got != 1 {
+		t.Errorf("accepted %d packets without allowlist; want 1", got)
+	}
+}
+
+func TestRawDiscoSTUN(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_STUN"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	envknob.Setenv(knob, "")
+	if slices.Contains(rawDiscoFilterMagics(), rawDiscoSTUNMatch) {
+		t.Errorf("filters match STUN without %s", knob)
+	}
+	envknob.Setenv(knob, "1")
+	if !slices.Contains(rawDiscoFilterMagics(), rawDiscoSTUNMatch) {
+		t.Errorf("filters don't match STUN with %s", knob)
+	}
+	if len(rawDiscoMagics) != 1 || rawDiscoMagics[0].stun {
+		t.Errorf("rawDiscoMagics modified: %+v", rawDiscoMagics)
+	}
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	res := stun.Response(stun.NewTxID(), netip.MustParseAddrPort("198.51.100.1:41641"))
+
+	var gotPkt []byte
+	var gotSrc netip.AddrPort
+	conn.SetRawDiscoSTUNFunc(func(pkt []byte, src netip.AddrPort) {
+		gotPkt, gotSrc = append([]byte(nil), pkt...), src
+	})
+	stunCount, accepted := metricRecvDiscoRawSTUN.Value(), metricRecvDiscoPacketIPv4.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(port, res), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if !bytes.Equal(gotPkt, res) {
+		t.Errorf("STUN func got %x; want %x", gotPkt, res)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.1:1234"); gotSrc != want {
+		t.Errorf("STUN func got src %v; want %v", gotSrc, want)
+	}
+	if got := metricRecvDiscoRawSTUN.Value() - stunCount; got != 1 {
+		t.Errorf("STUN responses counted = %d; want 1", got)
+	}
+	if metricRecvDiscoPacketIPv4.Value() != accepted {
+		t.Error("STUN response handled as disco")
+	}
+
+	conn.SetRawDiscoSTUNFunc(nil)
+	if conn.rawDiscoSTUNFunc.Load() != nil {
+		t.Error("STUN func not removed")
+	}
+	conn.handleRawDiscoDatagram(udpDatagram(port, res), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if got := metricRecvDiscoRawSTUN.Value() - stunCount; got != 2 {
+		t.Errorf("STUN responses counted = %d; want 2", got)
+	}
+}
+
+func TestRawDiscoEncap(t *testing.T) {
+	const knob = "TS_DEBUG_RAW_DISCO_ENCAP_OFFSET"
+	old := os.Getenv(knob)
+	defer envknob.Setenv(knob, old)
+	for _, v := range []string{"", "0", "-1", "x", strconv.Itoa(maxRawDiscoEncapOffset + 1)} {
+		envknob.Setenv(knob, v)
+		if got := rawDiscoFilterMagics(); len(got) != len(rawDiscoMagics) {
+			t.Errorf("%s=%q: filters match %+v; want only rawDiscoMagics", knob, v, got)
+		}
+	}
+	envknob.Setenv(knob, "4")
+	magics := rawDiscoFilterMagics()
+	if last := magics[len(magics)-1]; last.offset != 4 || last.hi != discoMagic1 || last.lo != discoMagic2 {
+		t.Errorf("encap match = %+v; want the disco magic at offset 4", last)
+	}
+	if len(rawDiscoMagics) != 1 || rawDiscoMagics[0].offset != 0 {
+		t.Errorf("rawDiscoMagics modified: %+v", rawDiscoMagics)
+	}
+
+	conn := newTestConn(t)
+	defer conn.Close()
+	port := conn.pconn4.Port()
+	src := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	encap := append([]byte{1, 2, 3, 4}, nonTestDiscoPacket()...)
+
+	var gotPkt []byte
+	var gotSrc netip.AddrPort
+	conn.SetRawDiscoEncapFunc(func(pkt []byte, src netip.AddrPort) {
+		gotPkt, gotSrc = append([]byte(nil), pkt...), src
+	})
+	encapCount, accepted := metricRecvDiscoRawEncap.Value(), metricRecvDiscoPacketIPv4.Value()
+	conn.handleRawDiscoDatagram(udpDatagram(port, encap), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if !bytes.Equal(gotPkt, encap) {
+		t.Errorf("encap func got %x; want %x", gotPkt, encap)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.1:1234"); gotSrc != want {
+		t.Errorf("encap func got src %v; want %v", gotSrc, want)
+	}
+	if got := metricRecvDiscoRawEncap.Value() - encapCount; got != 1 {
+		t.Errorf("encapsulated disco counted = %d; want 1", got)
+	}
+	if metricRecvDiscoPacketIPv4.Value() != accepted {
+		t.Error("encapsulated disco handled as disco")
+	}
+
+	// Plain disco is still disco.
+	gotPkt = nil
+	conn.handleRawDiscoDatagram(udpDatagram(port, nonTestDiscoPacket()), src, "ip4", rawDiscoRx{at: mono.Now()})
+	if gotPkt != nil {
+		t.Error("plain disco passed to the encap func")
+	}
+
+	conn.SetRawDiscoEncapFunc(nil)
+	if conn.rawDiscoEncapFunc.Load() != nil {
+		t.Error("encap func not removed")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"io"
+)
+
+// There is no raw disco receiver on Windows. Winsock raw sockets don't
+// see UDP traffic for ports bound by another socket, and SIO_RCVALL,
+// which does, hands us every packet on the interface with no way to
+// filter in the kernel. WinDivert or a WFP callout could, but both need
+// a signed driver installed alongside tailscaled, which we don't ship.
+// Until we do, disco on Windows only comes in on the regular UDP
+// sockets, which is fine as long as the Windows firewall lets it in.
+
+func (c *Conn) listenRawDisco(family string, port uint16) (io.Closer, error) {
+	return nil, fmt.Errorf("%w on Windows: no capture driver", ErrRawDiscoUnsupported)
+}
+
+func setRawDiscoPort(rc io.Closer, family string, port uint16) error {
+	return fmt.Errorf("%w on Windows: no capture driver", ErrRawDiscoUnsupported)
+}
+
+func (c *Conn) rawDiscoInterfacesStale(rc io.Closer, family string) bool {
+	return false
+}
+
+func injectRawDiscoTestPacket(family, ifName string) error {
+	return fmt.Errorf("%w on Windows: no capture driver", ErrRawDiscoUnsupported)
+}
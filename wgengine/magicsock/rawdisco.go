@@ -0,0 +1,2324 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go4.org/netipx"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/ipv4"
+	"tailscale.com/disco"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/stun"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/multierr"
+)
+
+var (
+	// Enable/disable using raw sockets to receive disco traffic.
+	debugDisableRawDisco = envknob.RegisterBool("TS_DEBUG_DISABLE_RAW_DISCO")
+	// Likewise, for only one address family.
+	debugDisableRawDiscoV4 = envknob.RegisterBool("TS_DEBUG_DISABLE_RAW_DISCO_V4")
+	debugDisableRawDiscoV6 = envknob.RegisterBool("TS_DEBUG_DISABLE_RAW_DISCO_V6")
+)
+
+// Errors returned by listenRawDisco, possibly wrapped, and recorded in
+// RawDiscoStatus.
+var (
+	// ErrRawDiscoUnsupported means raw disco listening can't work on
+	// this platform or host, such as when SO_MARK is unavailable.
+	ErrRawDiscoUnsupported = errors.New("raw disco listening not supported")
+	// ErrRawDiscoDisabled means raw disco listening was turned off
+	// with a debug knob, or, with BPF devices, wasn't opted in to
+	// (see TS_RAW_DISCO_BPF_DEVICES).
+	ErrRawDiscoDisabled = errors.New("raw disco listening disabled by debug flag")
+	// ErrRawDiscoBPFInstall means the BPF filter couldn't be
+	// assembled or attached.
+	ErrRawDiscoBPFInstall = errors.New("installing raw disco BPF filter")
+	// ErrRawDiscoSelfTestTimeout means a disco packet sent over
+	// loopback wasn't received through the BPF filter in time, either
+	// at startup or in a later health check.
+	ErrRawDiscoSelfTestTimeout = errors.New("raw disco self-test packet not received")
+	// ErrRawDiscoSelfTestWrite means the disco packet for the
+	// self-test or a health check couldn't be sent at all, which points
+	// at loopback or egress policy rather than the filter or ingress.
+	ErrRawDiscoSelfTestWrite = errors.New("raw disco self-test packet not sent")
+	// ErrRawDiscoStarved means a running receiver got almost none of
+	// the disco the regular UDP socket did over a while, though it
+	// passed its self-test; see checkRawDiscoStarved.
+	ErrRawDiscoStarved = errors.New("raw disco receiver starved")
+)
+
+// debugRawDiscoSelfTestTimeout, if set to a valid duration, overrides
+// defaultRawDiscoSelfTestTimeout.
+var debugRawDiscoSelfTestTimeout = envknob.RegisterString("TS_RAW_DISCO_SELFTEST_TIMEOUT")
+
+const (
+	// defaultRawDiscoSelfTestTimeout is how long listenRawDisco's
+	// self-test waits for its packet to come back.
+	defaultRawDiscoSelfTestTimeout = 100 * time.Millisecond
+	// maxRawDiscoSelfTestTimeout bounds overrides of it, as it delays
+	// NewConn.
+	maxRawDiscoSelfTestTimeout = 10 * time.Second
+)
+
+// rawDiscoSelfTestTimeout returns how long listenRawDisco's self-test
+// waits for its packet to come back.
+func rawDiscoSelfTestTimeout() time.Duration {
+	v := debugRawDiscoSelfTestTimeout()
+	if v == "" {
+		return defaultRawDiscoSelfTestTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > maxRawDiscoSelfTestTimeout {
+		return defaultRawDiscoSelfTestTimeout
+	}
+	return d
+}
+
+// debugRawDiscoInterface, if set, is the name of the interface the raw
+// disco receivers listen on, instead of all of them.
+var debugRawDiscoInterface = envknob.RegisterString("TS_DEBUG_RAW_DISCO_INTERFACE")
+
+// rawDiscoInterface returns the name of the only interface raw disco
+// packets should be received on, or "" for all interfaces.
+//
+// magicsock's UDP sockets are bound to all interfaces, so by default
+// so are the raw disco receivers. On multi-homed hosts where disco
+// arrives over several of them, this lets it be received on just one.
+func rawDiscoInterface() string {
+	return debugRawDiscoInterface()
+}
+
+// debugRawDiscoTestInterface, if set, is the name of an interface the
+// raw disco self-test and health checks send their packet out of,
+// instead of over loopback. See injectRawDiscoTestPacket.
+var debugRawDiscoTestInterface = envknob.RegisterString("TS_DEBUG_RAW_DISCO_TEST_INTERFACE")
+
+// rawDiscoSeesLoopback reports whether the raw disco receivers get
+// packets sent over loopback, as needed by their self-test and health
+// checks. That's only not the case on Linux when rawDiscoIface names
+// another interface: the BPF devices used elsewhere are opened per
+// interface anyway, and the loopback one is kept regardless.
+func (c *Conn) rawDiscoSeesLoopback() bool {
+	if c.rawDiscoIface == "" || runtime.GOOS != "linux" {
+		return true
+	}
+	ifc, err := net.InterfaceByName(c.rawDiscoIface)
+	return err == nil && ifc.Flags&net.FlagLoopback != 0
+}
+
+// debugRawDiscoSkipSelfTest skips the raw disco self-test and health
+// checks, for sandboxes whose policy blocks the loopback traffic they
+// depend on but not raw receive. Without them, a receiver whose filter
+// doesn't work goes unnoticed, and disco over that family with it.
+var debugRawDiscoSkipSelfTest = envknob.RegisterBool("TS_RAW_DISCO_SKIP_SELFTEST")
+
+// rawDiscoSkipSelfTest returns why the raw disco self-test and health
+// checks should be skipped, or "" if they shouldn't be.
+func (c *Conn) rawDiscoSkipSelfTest() string {
+	if debugRawDiscoSkipSelfTest() {
+		return "TS_RAW_DISCO_SKIP_SELFTEST set; a broken filter will go unnoticed"
+	}
+	if !c.rawDiscoSeesLoopback() && debugRawDiscoTestInterface() == "" {
+		return fmt.Sprintf("bound to %s, which loopback traffic doesn't arrive on", c.rawDiscoIface)
+	}
+	return ""
+}
+
+// rawDiscoDisabled reports whether raw disco listening is disabled by
+// a debug knob for family.
+func rawDiscoDisabled(family string) bool {
+	if debugDisableRawDisco() {
+		return true
+	}
+	switch family {
+	case "ip4":
+		return debugDisableRawDiscoV4()
+	case "ip6":
+		return debugDisableRawDiscoV6()
+	}
+	return false
+}
+
+// rawDiscoState tracks the raw disco receiver (see listenRawDisco) for
+// one address family.
+//
+// There's one receiver per family, rather than one for both, because
+// there's no such thing as a dual-stack raw socket: IPV6_V6ONLY only
+// applies to TCP and UDP, and a raw IPv6 socket never sees IPv4
+// packets. An AF_PACKET socket would, but it sees everything on the
+// link, ahead of the firewall, which on Linux a raw socket doesn't
+// have to be. The BSDs' BPF devices capture ahead of the firewall
+// regardless, so are opt-in (see their listenRawDisco), and could
+// capture both families with one filter, but that would save one idle
+// goroutine per interface at the price of tying both families' ports,
+// filters and fallbacks together.
+type rawDiscoState struct {
+	// active is whether the raw disco receiver is running, in which
+	// case the regular UDP socket of the same family ignores disco
+	// packets. It's read on the receive hot path, hence atomic.
+	active atomic.Bool
+
+	// activeGauge, if non-nil, is the metric mirroring active. It's
+	// per process, so with several Conns says what the last one to
+	// start or stop its receiver did.
+	activeGauge *clientmetric.Metric
+
+	mu     sync.Mutex
+	closer io.Closer     // non-nil while the receiver is running
+	err    error         // why the receiver isn't running; nil if unknown or closed deliberately
+	echo   chan struct{} // if non-nil, closed when the receiver gets testDiscoPacket
+	port   uint16        // UDP port the receiver accepts disco for; see updateRawDiscoPort
+
+	// narrowTimer, if non-nil, is to narrow the receiver's filter from
+	// any port back to port once the retired one's grace is over. See
+	// updateRawDiscoPort.
+	narrowTimer *time.Timer
+
+	retrying bool // whether retryRawDisco is running
+
+	// oldPort and oldPortUntil are the port the receiver's filter last
+	// moved off and until when (a mono.Time) it's still accepted. See
+	// notePortRetired. They're read on the receive path, hence atomic.
+	oldPort      atomic.Uint32
+	oldPortUntil atomic.Int64
+
+	// lastRecv is when (a mono.Time) the receiver last passed on a
+	// disco packet to be handled, or started if it hasn't since, and
+	// lastSocketDisco when the regular UDP socket of the same family
+	// last ignored one for it. See checkRawDiscoSilence. They're
+	// updated on the receive paths, hence atomic.
+	lastRecv        atomic.Int64
+	lastSocketDisco atomic.Int64
+	// recvCount and socketDiscoCount count the packets lastRecv and
+	// lastSocketDisco are updated for. See checkRawDiscoStarved.
+	recvCount        atomic.Int64
+	socketDiscoCount atomic.Int64
+
+	// kernelDrops is the kernel's count of packets dropped by the
+	// receiver's socket, where it keeps one. It's updated by the
+	// receiver's readers, hence atomic.
+	kernelDrops atomic.Uint32
+
+	// filterLen is the number of instructions the kernel reports in
+	// the receiver's filter, or 0 if unknown.
+	filterLen int
+
+	// silenceWarnedAt is when checkRawDiscoSilence last warned about
+	// the receiver, or zero.
+	silenceWarnedAt mono.Time
+
+	// starvedWindowStart is when checkRawDiscoStarved's current window
+	// started, or zero if it hasn't since the receiver started, and
+	// starvedRecv and starvedSocket recvCount and socketDiscoCount
+	// then. starvedAt is when it last shut the receiver down.
+	starvedWindowStart mono.Time
+	starvedRecv        int64
+	starvedSocket      int64
+	starvedAt          mono.Time
+
+	// selfTestRTT is how long the last successful self-test took for
+	// testDiscoPacket to come back, at most rawDiscoSelfTestTimeout.
+	selfTestRTT time.Duration
+
+	// errLogf logs the receiver's failures, rate limited as they can
+	// repeat while it's retried. nil until first used, and reset once
+	// the receiver passes a health check.
+	errLogf logger.Logf
+
+	// slowLogf logs packets from the receiver that took too long to
+	// handle. nil until first used.
+	slowLogf logger.Logf
+
+	// dumpLogf logs packets from the receiver that handleDiscoMessage
+	// rejected, with TS_DEBUG_RAW_DISCO_DUMP. nil until first used.
+	dumpLogf logger.Logf
+}
+
+// started records that the raw disco receiver is running, shut down by
+// closer, with a BPF filter accepting disco for port, and active.
+func (s *rawDiscoState) started(closer io.Closer, port uint16) {
+	s.starting(closer, port)
+	s.activate(closer)
+}
+
+// starting is like started, but leaves the receiver inactive, the
+// regular UDP socket handling disco, until activate. Until then, the
+// receiver's filter can be brought up to date with the socket's port.
+func (s *rawDiscoState) starting(closer io.Closer, port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closer = closer
+	s.port = port
+	s.err = nil
+	s.lastRecv.Store(int64(mono.Now()))
+	s.starvedWindowStart = 0
+}
+
+// activate makes the receiver shut down by closer active, reporting
+// whether it's still running.
+func (s *rawDiscoState) activate(closer io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer != closer {
+		return false
+	}
+	s.setActive(true)
+	return true
+}
+
+// stopped records that the raw disco receiver isn't running, because
+// of err, closing it if it was. A nil err means it was closed
+// deliberately.
+func (s *rawDiscoState) stopped(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stoppedLocked(err)
+}
+
+// stoppedIf is like stopped, but only if the running receiver is the
+// one shut down by closer, reporting whether it was.
+func (s *rawDiscoState) stoppedIf(closer io.Closer, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer != closer {
+		return false
+	}
+	s.stoppedLocked(err)
+	return true
+}
+
+func (s *rawDiscoState) stoppedLocked(err error) {
+	s.setActive(false)
+	if s.closer != nil {
+		s.closer.Close()
+		s.closer = nil
+	}
+	if s.narrowTimer != nil {
+		s.narrowTimer.Stop()
+		s.narrowTimer = nil
+	}
+	s.err = err
+	s.echo = nil
+	s.filterLen = 0
+	s.kernelDrops.Store(0)
+}
+
+// setActive sets s.active and its gauge. s.mu must be held, so the
+// gauge is set in the same order.
+func (s *rawDiscoState) setActive(active bool) {
+	s.active.Store(active)
+	if s.activeGauge == nil {
+		return
+	}
+	if active {
+		s.activeGauge.Set(1)
+	} else {
+		s.activeGauge.Set(0)
+	}
+}
+
+// noteFilterLen records the length of the filter the kernel reports
+// for the starting receiver.
+func (s *rawDiscoState) noteFilterLen(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filterLen = n
+}
+
+// noteKernelDrops records n, the kernel's count of packets dropped by
+// the receiver's socket since it was opened, counting any new ones.
+// Readers sharing the socket may report counts out of order.
+func (s *rawDiscoState) noteKernelDrops(n uint32) {
+	for {
+		old := s.kernelDrops.Load()
+		if n <= old {
+			return
+		}
+		if s.kernelDrops.CompareAndSwap(old, n) {
+			metricRecvDiscoRawKernelDrops.Add(int64(n - old))
+			return
+		}
+	}
+}
+
+// noteSelfTestEcho records that the receiver got testDiscoPacket.
+func (s *rawDiscoState) noteSelfTestEcho() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.echo != nil {
+		close(s.echo)
+		s.echo = nil
+		s.errLogf = nil
+	}
+}
+
+// rawDiscoErrLogf returns the logf for failures of the raw disco
+// receiver for family. Repeated failures are coalesced until it's been
+// seen working again.
+func (c *Conn) rawDiscoErrLogf(family string) logger.Logf {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errLogf == nil {
+		s.errLogf = logger.RateLimitedFn(c.logf, time.Minute, 2, 10)
+	}
+	return s.errLogf
+}
+
+// status returns whether the receiver is running, the round trip
+// time of its last successful self-test, and the error that last
+// stopped it or kept it from starting.
+func (s *rawDiscoState) status() (active bool, selfTestRTT time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Load(), s.selfTestRTT, s.err
+}
+
+// rawDiscoHandling reports whether disco over family is handled from
+// its raw disco receiver, in which case the regular UDP socket ignores
+// it.
+//
+// This is what decides which path is authoritative, for a whole family
+// rather than packet by packet: while the receiver runs, the raw path
+// wins outright, and the regular socket does no more with disco than
+// recognize its magic and count it (see receiveIP), never reaching
+// handleDiscoMessage. PauseRawDisco hands authority back to the
+// socket. The two only both handle a packet while authority changes
+// hands, when rawDiscoDedup, keyed by source and packet (and so
+// nonce), lets whichever got it first win. There's thus no policy to
+// consult per packet, nor redundant work for one to save.
+func (c *Conn) rawDiscoHandling(family string) bool {
+	return c.rawDiscoState(family).active.Load() && !c.rawDiscoPaused.Load()
+}
+
+// PauseRawDisco makes c handle disco from its regular UDP sockets, as
+// if the raw disco receivers weren't running, until ResumeRawDisco is
+// called. The receivers keep running, and keep passing their health
+// checks, but discard the disco they read. It's for comparing the two
+// paths, such as in latency, without a restart.
+//
+// A few packets arriving as it takes effect may not be handled at all,
+// which disco copes with as for any packet loss. Ones that would be
+// handled twice are caught by rawDiscoDedup.
+func (c *Conn) PauseRawDisco() {
+	if !c.rawDiscoPaused.Swap(true) {
+		c.logf("disco raw: paused")
+	}
+}
+
+// ResumeRawDisco undoes PauseRawDisco.
+func (c *Conn) ResumeRawDisco() {
+	if c.rawDiscoPaused.Swap(false) {
+		c.logf("disco raw: resumed")
+	}
+}
+
+// kernelStats returns the receiver's filter length and drop count as
+// reported by the kernel.
+func (s *rawDiscoState) kernelStats() (filterLen int, drops uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filterLen, s.kernelDrops.Load()
+}
+
+// rawDiscoState returns the raw disco receiver state for family, which
+// must be "ip4" or "ip6".
+func (c *Conn) rawDiscoState(family string) *rawDiscoState {
+	if family == "ip6" {
+		return &c.rawDisco6
+	}
+	return &c.rawDisco4
+}
+
+// rawDiscoRetryMaxBackoff caps the delay between attempts to start a
+// raw disco receiver after a transient failure.
+const rawDiscoRetryMaxBackoff = time.Minute
+
+// startRawDisco tries to start the raw disco receiver for family,
+// which must be "ip4" or "ip6", recording the outcome for
+// RawDiscoStatus. If it fails, disco continues to be received on the
+// regular UDP socket, and unless the failure is permanent (see
+// isPermanentRawDiscoError) it's retried in the background.
+func (c *Conn) startRawDisco(family string) {
+	err := c.tryStartRawDisco(family)
+	if err == nil || isPermanentRawDiscoError(err) {
+		return
+	}
+	c.retryRawDiscoLater(family, err)
+}
+
+// retryRawDiscoLater starts retryRawDisco for family, which last failed
+// with err, unless it's already running.
+func (c *Conn) retryRawDiscoLater(family string, err error) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.retrying {
+		s.retrying = true
+		go c.retryRawDisco(family, err)
+	}
+}
+
+// tryStartRawDisco makes one attempt to start the raw disco receiver
+// for family, unless it's already running.
+func (c *Conn) tryStartRawDisco(family string) error {
+	s := c.rawDiscoState(family)
+	if s.active.Load() {
+		return nil
+	}
+	s.mu.Lock()
+	retrying, prevErr := s.retrying, s.err
+	s.mu.Unlock()
+	port := c.discoPort(family)
+	closer, err := c.listenRawDisco(family, port)
+	if err != nil {
+		c.rawDiscoErrLogf(family)("[v1] couldn't create raw %v disco listener, using regular listener instead: %v", family, err)
+		s.stopped(err)
+		if !retrying {
+			// Subsequent attempts failing is no news.
+			if isPermanentRawDiscoError(err) {
+				c.logRawDiscoEvent(family, "disabled", err)
+			} else {
+				c.logRawDiscoEvent(family, "fallback", err)
+			}
+		}
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		// Close ran meanwhile, and so didn't stop this one.
+		c.mu.Unlock()
+		closer.Close()
+		return net.ErrClosed
+	}
+	s.starting(closer, port)
+	c.mu.Unlock()
+	// In case of a rebind since we read port, which didn't update the
+	// filter of a receiver it didn't know about yet. It's brought up
+	// to date before the regular socket starts ignoring disco for it.
+	c.syncRawDiscoPort(family)
+	if !s.activate(closer) {
+		// Closed, or its filter couldn't be updated.
+		if _, _, err := s.status(); err != nil {
+			return err
+		}
+		return net.ErrClosed
+	}
+	c.logf("[v1] using BPF disco receiver for %v", family)
+	if prevErr != nil {
+		c.logRawDiscoEvent(family, "restarted", nil)
+	} else {
+		c.logRawDiscoEvent(family, "started", nil)
+	}
+	return nil
+}
+
+// RawDiscoEvent is a change in how disco is received over one address
+// family, logged as a structured log record of type "rawdisco" so that
+// they can be aggregated across nodes.
+type RawDiscoEvent struct {
+	Family string // "ip4" or "ip6"
+
+	// Event is what happened to the family's raw disco receiver:
+	//
+	//   - "started": it started.
+	//   - "restarted": it started after having failed.
+	//   - "fallback": it failed to start or stopped working, and disco is
+	//     received on the regular UDP socket meanwhile.
+	//   - "disabled": it can't be used at all (ErrRawDiscoUnsupported or
+	//     ErrRawDiscoDisabled), and isn't retried.
+	Event string
+
+	// Reason is the error behind a "fallback" or "disabled" event.
+	Reason string `json:",omitempty"`
+}
+
+// logRawDiscoEvent logs a RawDiscoEvent for family, with reason err if
+// non-nil, and updates the health subsystem to match (see
+// rawDiscoHealth).
+func (c *Conn) logRawDiscoEvent(family, event string, err error) {
+	ev := RawDiscoEvent{Family: family, Event: event}
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	c.logf.JSON(1, "rawdisco", ev)
+	c.rawDiscoHealth.note(family, event, err)
+}
+
+// rawDiscoHealth reports the raw disco receivers' failures to the
+// health subsystem, as health.SysRawDisco, going by the RawDiscoEvents
+// logged for them. Only "fallback" ones count, where the receiver was
+// expected to work, and either didn't start or stopped working, as
+// that can be a sign of broader trouble with sockets or capabilities;
+// disco is received on the regular sockets meanwhile. A "disabled"
+// receiver (ErrRawDiscoUnsupported or ErrRawDiscoDisabled, such as
+// without SO_MARK) was never going to work, so isn't a failure. Either
+// family starting again clears its failure.
+//
+// It's kept apart from rawDiscoState, as receivers can fall back with
+// their state's mu held.
+type rawDiscoHealth struct {
+	mu       sync.Mutex
+	ip4, ip6 error // the reason for the family's fallback, if it's failed
+}
+
+func (h *rawDiscoHealth) note(family, event string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failed := &h.ip4
+	if family == "ip6" {
+		failed = &h.ip6
+	}
+	*failed = nil
+	if event == "fallback" {
+		*failed = err
+	}
+	var errs []error
+	if h.ip4 != nil {
+		errs = append(errs, fmt.Errorf("ip4: %w", h.ip4))
+	}
+	if h.ip6 != nil {
+		errs = append(errs, fmt.Errorf("ip6: %w", h.ip6))
+	}
+	health.SetRawDiscoHealth(multierr.New(errs...))
+}
+
+// clear clears any failures, as Conn.Close shuts the receivers down.
+func (h *rawDiscoHealth) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ip4 == nil && h.ip6 == nil {
+		return
+	}
+	h.ip4, h.ip6 = nil, nil
+	health.SetRawDiscoHealth(nil)
+}
+
+// goRawDiscoReader runs read, a raw disco receiver's (or
+// startDiscoMulticast's) read loop that returns once its socket is
+// closed, in a new goroutine that Close
+// waits for. If c is already closed, or is ProbeRawDisco's, it does
+// nothing.
+func (c *Conn) goRawDiscoReader(read func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.rawDiscoProbing {
+		return
+	}
+	c.rawDiscoReadersRunning++
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.rawDiscoReadersRunning--
+			c.muCond.Broadcast()
+		}()
+		read()
+	}()
+}
+
+// discoPort returns the port of the regular UDP socket for family,
+// which the raw disco receiver accepts disco for, or zero if it's not
+// bound.
+//
+// The sockets are never nil, being part of Conn rather than pointed to
+// by it, so there's no nil check: one that was never bound, or has
+// been closed, has port zero, and its family's disco is dropped (see
+// metricRecvDiscoRawNoPort).
+func (c *Conn) discoPort(family string) uint16 {
+	if family == "ip6" {
+		return c.pconn6.Port()
+	}
+	return c.pconn4.Port()
+}
+
+// appendRawDiscoPorts appends to dst the UDP ports that the raw disco
+// receiver for family accepts disco for, and returns the result. They
+// are those of the regular UDP sockets of that family, so none while
+// they're unbound, plus for rawDiscoPortGrace the one the receiver
+// last moved off (see updateRawDiscoPort), for disco that was already
+// on its way when the socket was rebound or unbound.
+//
+// There's just the one socket per family for now. Should that change,
+// the BPF filters, which match a single port, will need installing
+// with port 0 for good, as they are during the grace period, leaving
+// the choice to handleRawDiscoDatagram.
+func (c *Conn) appendRawDiscoPorts(dst []uint16, family string) []uint16 {
+	port := c.discoPort(family)
+	if port != 0 {
+		dst = append(dst, port)
+	}
+	if old := c.rawDiscoState(family).retiredPort(); old != 0 && old != port {
+		dst = append(dst, old)
+	}
+	return dst
+}
+
+// rawDiscoPortGrace is how long the raw disco receivers keep accepting
+// disco for a port after the regular UDP socket leaves it.
+const rawDiscoPortGrace = 5 * time.Second
+
+// notePortRetired records that the receiver no longer accepts disco
+// for port, which it's to keep accepting for rawDiscoPortGrace.
+func (s *rawDiscoState) notePortRetired(port uint16) {
+	s.oldPortUntil.Store(int64(mono.Now().Add(rawDiscoPortGrace)))
+	s.oldPort.Store(uint32(port))
+}
+
+// retiredPort returns the port last passed to notePortRetired, if
+// it's still within rawDiscoPortGrace, or else 0.
+func (s *rawDiscoState) retiredPort() uint16 {
+	port := s.oldPort.Load()
+	if port == 0 || mono.Now().After(mono.Time(s.oldPortUntil.Load())) {
+		return 0
+	}
+	return uint16(port)
+}
+
+// setRawDiscoFilterPort is called by bindSocket when the regular UDP
+// socket for network ("udp4" or "udp6") is about to be bound to port,
+// before it starts being read from.
+func (c *Conn) setRawDiscoFilterPort(network string, port uint16) {
+	if network == "udp6" {
+		c.updateRawDiscoPort("ip6", port)
+	} else {
+		c.updateRawDiscoPort("ip4", port)
+	}
+}
+
+// syncRawDiscoPort updates the BPF filter of the raw disco receiver for
+// family, if running, to accept disco for the regular UDP socket's
+// current port. It holds the socket's lock meanwhile, as bindSocket
+// does when it calls updateRawDiscoPort, so that a rebind can't slip
+// in between reading the port and updating the filter.
+func (c *Conn) syncRawDiscoPort(family string) {
+	ruc := &c.pconn4
+	if family == "ip6" {
+		ruc = &c.pconn6
+	}
+	ruc.mu.Lock()
+	defer ruc.mu.Unlock()
+	c.updateRawDiscoPort(family, ruc.port)
+}
+
+// updateRawDiscoPort updates the BPF filter of the raw disco receiver
+// for family, if running, to accept disco for port. If the filter
+// can't be updated, the receiver is shut down and disco is received on
+// the regular socket instead.
+//
+// A filter matches a single port, so to keep accepting disco for the
+// port it moves off for rawDiscoPortGrace, it's widened to any port
+// for that long, with handleRawDiscoDatagram dropping what's for
+// neither, and then narrowed by narrowRawDiscoFilter. Moving to port
+// 0 needs no narrowing, that filter already accepting any port.
+func (c *Conn) updateRawDiscoPort(family string, port uint16) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer == nil || s.port == port {
+		return
+	}
+	// Not yet active (see rawDiscoState.starting), the receiver has
+	// left disco for the old port to the regular socket.
+	retire := s.port != 0 && s.active.Load()
+	filterPort := port
+	if retire {
+		filterPort = 0
+	}
+	if err := setRawDiscoPort(s.closer, family, filterPort); err != nil {
+		c.logf("disco raw: updating %v filter to port %d: %v; using regular listener instead", family, filterPort, err)
+		s.stoppedLocked(err)
+		c.logRawDiscoEvent(family, "fallback", err)
+		return
+	}
+	if retire {
+		s.notePortRetired(s.port)
+	}
+	s.port = port
+	if s.narrowTimer != nil {
+		s.narrowTimer.Stop()
+		s.narrowTimer = nil
+	}
+	if filterPort != port {
+		var t *time.Timer
+		t = time.AfterFunc(rawDiscoPortGrace, func() { c.narrowRawDiscoFilter(family, t) })
+		s.narrowTimer = t
+	}
+}
+
+// narrowRawDiscoFilter narrows the BPF filter of the raw disco receiver
+// for family, widened by updateRawDiscoPort, back to its port, unless
+// t is no longer the timer for that.
+func (c *Conn) narrowRawDiscoFilter(family string, t *time.Timer) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.narrowTimer != t || s.closer == nil {
+		return
+	}
+	s.narrowTimer = nil
+	if err := setRawDiscoPort(s.closer, family, s.port); err != nil {
+		c.logf("disco raw: updating %v filter to port %d: %v; using regular listener instead", family, s.port, err)
+		s.stoppedLocked(err)
+		c.logRawDiscoEvent(family, "fallback", err)
+	}
+}
+
+// refreshRawDiscoInterfaces restarts the raw disco receivers missing
+// interfaces they'd capture on if started now, where they capture per
+// interface (see rawDiscoInterfacesStale). Rebind calls it on link
+// changes. While one restarts, the regular UDP socket handles its
+// family's disco.
+func (c *Conn) refreshRawDiscoInterfaces() {
+	for _, family := range []string{"ip4", "ip6"} {
+		s := c.rawDiscoState(family)
+		s.mu.Lock()
+		closer := s.closer
+		s.mu.Unlock()
+		if closer == nil || !c.rawDiscoInterfacesStale(closer, family) {
+			continue
+		}
+		if !s.stoppedIf(closer, nil) {
+			continue
+		}
+		c.logf("disco raw: interfaces changed; restarting %v receiver", family)
+		c.startRawDisco(family)
+	}
+}
+
+// retryRawDisco retries starting the raw disco receiver for family,
+// which last failed with err, until it starts, fails permanently, or
+// c is closed. Only one runs per family at a time.
+func (c *Conn) retryRawDisco(family string, err error) {
+	s := c.rawDiscoState(family)
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.retrying = false
+	}()
+	bo := backoff.NewBackoff("disco-raw-"+family, c.logf, rawDiscoRetryMaxBackoff)
+	for {
+		bo.BackOff(c.connCtx, err)
+		if c.connCtx.Err() != nil {
+			return
+		}
+		err = c.tryStartRawDisco(family)
+		if err == nil || isPermanentRawDiscoError(err) {
+			return
+		}
+	}
+}
+
+// isPermanentRawDiscoError reports whether err, from listenRawDisco,
+// means there's no point trying again.
+func isPermanentRawDiscoError(err error) bool {
+	return errors.Is(err, ErrRawDiscoUnsupported) || errors.Is(err, ErrRawDiscoDisabled)
+}
+
+const (
+	// rawDiscoHealthCheckInterval is how often a running raw disco
+	// receiver is checked to still be receiving, in case the filter
+	// was detached or a firewall started dropping its traffic since
+	// it passed the self-test in listenRawDisco.
+	rawDiscoHealthCheckInterval = 5 * time.Minute
+
+	// rawDiscoEchoTimeout is how long a health check waits for its
+	// test packet. It's more generous than listenRawDisco's, as the
+	// receiver is a busy goroutine rather than a fresh socket.
+	rawDiscoEchoTimeout = time.Second
+
+	// rawDiscoSilenceWindow is how long a running raw disco receiver
+	// can go without disco, while the regular UDP socket sees some,
+	// before checkRawDiscoSilence warns about it.
+	rawDiscoSilenceWindow = 10 * time.Minute
+	// rawDiscoSilenceCheckInterval is how often it checks.
+	rawDiscoSilenceCheckInterval = time.Minute
+
+	// defaultRawDiscoStarvedWindow is how long checkRawDiscoStarved
+	// compares the raw and regular paths over.
+	defaultRawDiscoStarvedWindow = 10 * time.Minute
+	// rawDiscoStarvedMinSocket is how much disco the regular UDP socket
+	// must have seen over the window for it to be compared at all.
+	rawDiscoStarvedMinSocket = 20
+	// rawDiscoReprobeInterval is how long after checkRawDiscoStarved
+	// shuts a receiver down it's started again, in case whatever was
+	// in its way since went away.
+	rawDiscoReprobeInterval = 30 * time.Minute
+)
+
+// debugRawDiscoStarvedWindow, if set to a valid duration of at least
+// rawDiscoSilenceCheckInterval, overrides defaultRawDiscoStarvedWindow.
+var debugRawDiscoStarvedWindow = envknob.RegisterString("TS_DEBUG_RAW_DISCO_STARVED_WINDOW")
+
+// rawDiscoStarvedWindow returns how long checkRawDiscoStarved compares
+// the raw and regular paths over.
+func rawDiscoStarvedWindow() time.Duration {
+	d, err := time.ParseDuration(debugRawDiscoStarvedWindow())
+	if err != nil || d < rawDiscoSilenceCheckInterval {
+		return defaultRawDiscoStarvedWindow
+	}
+	return d
+}
+
+// rawDiscoHealthLoop runs checkRawDiscoHealth every
+// rawDiscoHealthCheckInterval until c is closed.
+func (c *Conn) rawDiscoHealthLoop() {
+	t := time.NewTicker(rawDiscoHealthCheckInterval)
+	defer t.Stop()
+	silence := time.NewTicker(rawDiscoSilenceCheckInterval)
+	defer silence.Stop()
+	for {
+		select {
+		case <-c.donec:
+			return
+		case <-t.C:
+			c.checkRawDiscoHealth("ip4")
+			c.checkRawDiscoHealth("ip6")
+		case <-silence.C:
+			now := mono.Now()
+			for _, family := range []string{"ip4", "ip6"} {
+				if c.checkRawDiscoSilence(family, now) {
+					c.checkRawDiscoHealth(family)
+				}
+				c.checkRawDiscoStarved(family, now)
+				c.reprobeRawDisco(family, now)
+			}
+		}
+	}
+}
+
+// checkRawDiscoSilence reports whether, as of now, the raw disco
+// receiver for family has gone rawDiscoSilenceWindow without passing
+// on any disco while the regular UDP socket, ignoring disco for it, has
+// seen some, warning about it if it hasn't recently. That's a receiver
+// that's enabled but dead in a way its health checks don't catch, so
+// the caller should run one anyway.
+func (c *Conn) checkRawDiscoSilence(family string, now mono.Time) bool {
+	s := c.rawDiscoState(family)
+	if !s.active.Load() || c.rawDiscoPaused.Load() {
+		return false
+	}
+	lastRecv, lastSocket := mono.Time(s.lastRecv.Load()), mono.Time(s.lastSocketDisco.Load())
+	if now.Sub(lastRecv) < rawDiscoSilenceWindow || lastSocket <= lastRecv || now.Sub(lastSocket) >= rawDiscoSilenceWindow {
+		return false
+	}
+	s.mu.Lock()
+	warn := s.silenceWarnedAt == 0 || now.Sub(s.silenceWarnedAt) >= rawDiscoSilenceWindow
+	if warn {
+		s.silenceWarnedAt = now
+	}
+	s.mu.Unlock()
+	if warn {
+		c.logf("[unexpected] disco raw: no %v disco received for %v, though the regular socket is getting some; rechecking receiver", family, now.Sub(lastRecv).Round(time.Second))
+	}
+	return true
+}
+
+// checkRawDiscoStarved, every rawDiscoStarvedWindow, compares the disco
+// the running raw disco receiver for family passed on over the window
+// with what the regular UDP socket ignored for it. They're sent the
+// same packets, so should count about the same. If the receiver got
+// under 1% of what the socket did, something is keeping disco from it
+// that the health checks' loopback packets get past, such as a filter
+// for the wrong offsets or a firewall, and it's shut down, leaving
+// disco to the socket until reprobeRawDisco tries it again.
+func (c *Conn) checkRawDiscoStarved(family string, now mono.Time) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	closer := s.closer
+	if !s.active.Load() || closer == nil || c.rawDiscoPaused.Load() {
+		// Paused, the socket handles disco rather than ignoring it.
+		s.starvedWindowStart = 0
+		s.mu.Unlock()
+		return
+	}
+	recv, socket := s.recvCount.Load(), s.socketDiscoCount.Load()
+	start, prevRecv, prevSocket := s.starvedWindowStart, s.starvedRecv, s.starvedSocket
+	if start != 0 && now.Sub(start) < rawDiscoStarvedWindow() {
+		s.mu.Unlock()
+		return
+	}
+	s.starvedWindowStart, s.starvedRecv, s.starvedSocket = now, recv, socket
+	s.mu.Unlock()
+	if start == 0 {
+		return
+	}
+	recv, socket = recv-prevRecv, socket-prevSocket
+	if socket > 0 {
+		m := metricRawDiscoShareIPv4
+		if family == "ip6" {
+			m = metricRawDiscoShareIPv6
+		}
+		m.Set(recv * 100 / socket)
+	}
+	if socket < rawDiscoStarvedMinSocket || recv*100 >= socket {
+		return
+	}
+	err := fmt.Errorf("%w: got %d disco packets in %v to the regular socket's %d", ErrRawDiscoStarved, recv, now.Sub(start).Round(time.Second), socket)
+	if !s.stoppedIf(closer, err) {
+		return
+	}
+	s.mu.Lock()
+	s.starvedAt = now
+	s.mu.Unlock()
+	metricRawDiscoStarved.Add(1)
+	c.logf("[unexpected] disco raw: %v for %v, using regular listener instead; retrying in %v", err, family, rawDiscoReprobeInterval)
+	c.logRawDiscoEvent(family, "fallback", err)
+}
+
+// reprobeRawDisco starts the raw disco receiver for family again if
+// checkRawDiscoStarved shut it down at least rawDiscoReprobeInterval
+// before now and nothing has tried to since.
+func (c *Conn) reprobeRawDisco(family string, now mono.Time) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	due := errors.Is(s.err, ErrRawDiscoStarved) && !s.retrying && now.Sub(s.starvedAt) >= rawDiscoReprobeInterval
+	s.mu.Unlock()
+	if due {
+		c.logf("disco raw: retrying %v receiver shut down as starved", family)
+		c.startRawDisco(family)
+	}
+}
+
+// checkRawDiscoHealth sends testDiscoPacket over loopback and, if the
+// raw disco receiver for family is running but doesn't get it in time,
+// shuts the receiver down so the regular UDP socket takes over disco.
+// It does nothing if self-tests are skipped; see rawDiscoSkipSelfTest.
+func (c *Conn) checkRawDiscoHealth(family string) {
+	if c.rawDiscoSkipSelfTest() != "" {
+		return
+	}
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	closer := s.closer
+	if !s.active.Load() || closer == nil {
+		s.mu.Unlock()
+		return
+	}
+	echo := make(chan struct{})
+	s.echo = echo
+	s.mu.Unlock()
+
+	if err := writeRawDiscoTestPacket(family); err != nil {
+		// Not the receiver's fault; try again next time.
+		err = fmt.Errorf("%w: health check: %v", ErrRawDiscoSelfTestWrite, err)
+		c.logf("disco raw: %v for %v", err, family)
+		noteRawDiscoSelfTestFailure(family, err)
+		return
+	}
+	t := time.NewTimer(rawDiscoEchoTimeout)
+	defer t.Stop()
+	select {
+	case <-echo:
+		return
+	case <-c.donec:
+		return
+	case <-t.C:
+	}
+	err := fmt.Errorf("%w: health check", ErrRawDiscoSelfTestTimeout)
+	c.logf("disco raw: %v for %v, using regular listener instead", err, family)
+	noteRawDiscoSelfTestFailure(family, err)
+	if s.stoppedIf(closer, err) {
+		c.logRawDiscoEvent(family, "fallback", err)
+	}
+}
+
+// noteRawDiscoSelfTest records the outcome of listenRawDisco's
+// self-test for family, which failed if err is non-nil and otherwise
+// took rtt to see its packet come back.
+func (c *Conn) noteRawDiscoSelfTest(family string, rtt time.Duration, err error) {
+	if err == nil {
+		s := c.rawDiscoState(family)
+		s.mu.Lock()
+		s.selfTestRTT = rtt
+		s.mu.Unlock()
+		if family == "ip6" {
+			metricRawDiscoSelfTestRTTIPv6.Set(rtt.Microseconds())
+		} else {
+			metricRawDiscoSelfTestRTTIPv4.Set(rtt.Microseconds())
+		}
+	}
+	switch {
+	case family == "ip4" && err == nil:
+		metricRawDiscoSelfTestOKIPv4.Add(1)
+	case family == "ip4":
+		metricRawDiscoSelfTestFailIPv4.Add(1)
+	case err == nil:
+		metricRawDiscoSelfTestOKIPv6.Add(1)
+	default:
+		metricRawDiscoSelfTestFailIPv6.Add(1)
+	}
+	if err != nil {
+		noteRawDiscoSelfTestFailure(family, err)
+	}
+}
+
+// noteRawDiscoSelfTestFailure counts err, from the self-test or a
+// health check for family, as a write failure or a timeout if it's
+// either.
+func noteRawDiscoSelfTestFailure(family string, err error) {
+	var m *clientmetric.Metric
+	switch {
+	case errors.Is(err, ErrRawDiscoSelfTestWrite):
+		m = metricRawDiscoSelfTestWriteFailIPv4
+		if family == "ip6" {
+			m = metricRawDiscoSelfTestWriteFailIPv6
+		}
+	case errors.Is(err, ErrRawDiscoSelfTestTimeout):
+		m = metricRawDiscoSelfTestTimeoutIPv4
+		if family == "ip6" {
+			m = metricRawDiscoSelfTestTimeoutIPv6
+		}
+	default:
+		return
+	}
+	m.Add(1)
+}
+
+// closeOnError closes c if *errp is non-nil, adding any error from
+// that to *errp. It's deferred by listenRawDisco implementations once
+// they have something to close, so that each failure after that
+// returns with it closed, and only once something was opened.
+func closeOnError(c io.Closer, errp *error) {
+	if *errp == nil {
+		return
+	}
+	if err := c.Close(); err != nil {
+		*errp = multierr.New(*errp, fmt.Errorf("closing raw disco receiver: %w", err))
+	}
+}
+
+// listenRawDiscoPacket opens the raw disco receivers' sockets, with
+// lc, and the UDP socket writeRawDiscoTestPacket sends from. Tests
+// replace it to hand out fakes, telling the two apart by network.
+var listenRawDiscoPacket = func(lc *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+// rawDiscoTestPort is the UDP port writeRawDiscoTestPacket sends to,
+// which the BPF filters accept alongside our own.
+const rawDiscoTestPort = 1
+
+// writeRawDiscoTestPacket sends testDiscoPacket to rawDiscoTestPort on
+// the loopback address of family, for the raw disco receiver to pick
+// up.
+func writeRawDiscoTestPacket(family string) error {
+	if ifName := debugRawDiscoTestInterface(); ifName != "" {
+		return injectRawDiscoTestPacket(family, ifName)
+	}
+	addr, testAddr := "0.0.0.0:0", netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), rawDiscoTestPort)
+	if family == "ip6" {
+		addr, testAddr = "[::]:0", netip.AddrPortFrom(netip.IPv6Loopback(), rawDiscoTestPort)
+	}
+	tc, err := listenRawDiscoPacket(new(net.ListenConfig), "udp", addr)
+	if err != nil {
+		return fmt.Errorf("creating disco test socket: %w", err)
+	}
+	defer tc.Close()
+	if _, err := tc.WriteTo(testDiscoPacket, net.UDPAddrFromAddrPort(testAddr)); err != nil {
+		return fmt.Errorf("writing disco test packet: %w", err)
+	}
+	return nil
+}
+
+// RawDiscoStatus is the state of the raw disco receivers, which read
+// disco packets from a raw socket with a BPF filter instead of from the
+// regular UDP socket, on platforms that support it.
+type RawDiscoStatus struct {
+	V4Active bool // whether disco over IPv4 is read from a raw socket
+	V6Active bool // whether disco over IPv6 is read from a raw socket
+
+	// V4Err and V6Err are the errors that prevented the raw disco
+	// receiver for that family from starting or that stopped it,
+	// such as SO_MARK being unavailable, the BPF filter failing to
+	// install, or the self-test timing out, and can be matched with
+	// errors.Is against ErrRawDiscoUnsupported and friends. They're
+	// nil while the receiver is active or after it was shut down
+	// deliberately.
+	V4Err, V6Err error
+
+	// V4SelfTestRTT and V6SelfTestRTT are how long the last
+	// successful self-test for that family took to see its packet
+	// come back over loopback, or zero if none has succeeded. A slow
+	// one can be a sign of CPU starvation.
+	V4SelfTestRTT, V6SelfTestRTT time.Duration
+
+	// V4FilterLen and V6FilterLen are the number of instructions in
+	// the receiver's BPF filter according to the kernel, where it can
+	// say, confirming it's attached.
+	V4FilterLen, V6FilterLen int
+
+	// V4KernelDrops and V6KernelDrops are how many packets the kernel
+	// dropped for want of receive buffer space since the receiver
+	// started, where it keeps count.
+	V4KernelDrops, V6KernelDrops uint32
+
+	// Paused is whether disco is being handled from the regular UDP
+	// sockets regardless, after PauseRawDisco.
+	Paused bool
+}
+
+// RawDiscoStatus reports whether disco packets are being received on
+// raw sockets or have fallen back to the regular UDP sockets, and why.
+func (c *Conn) RawDiscoStatus() RawDiscoStatus {
+	var st RawDiscoStatus
+	st.V4Active, st.V4SelfTestRTT, st.V4Err = c.rawDisco4.status()
+	st.V6Active, st.V6SelfTestRTT, st.V6Err = c.rawDisco6.status()
+	st.Paused = c.rawDiscoPaused.Load()
+	st.V4FilterLen, st.V4KernelDrops = c.rawDisco4.kernelStats()
+	st.V6FilterLen, st.V6KernelDrops = c.rawDisco6.kernelStats()
+	return st
+}
+
+// RawDiscoProbe is the outcome of ProbeRawDisco.
+type RawDiscoProbe struct {
+	Family string // "ip4" or "ip6"
+
+	// Err is why a receiver couldn't be started, which can be matched
+	// with errors.Is against ErrRawDiscoUnsupported and friends as
+	// for RawDiscoStatus, or nil if it could.
+	Err error
+
+	SelfTestRTT time.Duration // of its self-test, or zero if skipped or failed
+	FilterLen   int           // instructions in its BPF filter per the kernel, or 0 if unknown
+}
+
+// ProbeRawDisco checks whether a raw disco receiver for family ("ip4"
+// or "ip6") can be started, for preflight checks and tailscale debug.
+// It goes as far as starting one would, opening its socket or devices,
+// attaching the filter for c's current port and running the self-test,
+// then closes it all without starting any readers.
+//
+// c's own receivers and the path its disco takes carry on as they
+// were; only the self-test metrics count the probe's self-test.
+func (c *Conn) ProbeRawDisco(family string) RawDiscoProbe {
+	probe := &Conn{
+		logf:            c.logf,
+		rawDiscoIface:   c.rawDiscoIface,
+		rawDiscoProbing: true,
+	}
+	rc, err := probe.listenRawDisco(family, c.discoPort(family))
+	if err == nil {
+		rc.Close()
+	}
+	s := probe.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RawDiscoProbe{
+		Family:      family,
+		Err:         err,
+		SelfTestRTT: s.selfTestRTT,
+		FilterLen:   s.filterLen,
+	}
+}
+
+// RawDiscoSocket describes a socket, or on the BSDs a BPF device, that
+// a raw disco receiver reads from. See Conn.RawDiscoSockets.
+type RawDiscoSocket struct {
+	Family    string // "ip4" or "ip6"
+	LocalAddr string // address bound to, or for BPF devices the path
+	Interface string // the only interface received from, or "" for all
+	FD        int    // file descriptor, or -1 if unavailable
+	FilterLen int    // instructions in its BPF filter per the kernel, or 0 if unknown
+}
+
+// rawDiscoSocketer is implemented by raw disco receivers, as returned
+// by listenRawDisco, that are more than a single net.PacketConn.
+type rawDiscoSocketer interface {
+	rawDiscoSockets(family string) []RawDiscoSocket
+}
+
+// RawDiscoSockets returns the sockets the running raw disco receivers
+// read from, for matching up with the likes of ss and lsof when
+// debugging. It only looks them up, leaving their readers be.
+func (c *Conn) RawDiscoSockets() []RawDiscoSocket {
+	var ret []RawDiscoSocket
+	for _, family := range []string{"ip4", "ip6"} {
+		s := c.rawDiscoState(family)
+		s.mu.Lock()
+		switch rc := s.closer.(type) {
+		case rawDiscoSocketer:
+			ret = append(ret, rc.rawDiscoSockets(family)...)
+		case net.PacketConn:
+			ret = append(ret, RawDiscoSocket{
+				Family:    family,
+				LocalAddr: rc.LocalAddr().String(),
+				Interface: c.rawDiscoIface,
+				FD:        rawDiscoFD(rc),
+				FilterLen: s.filterLen,
+			})
+		}
+		s.mu.Unlock()
+	}
+	return ret
+}
+
+// rawDiscoFD returns the file descriptor of f, or -1 if unavailable.
+// Unlike os.File.Fd, it leaves the descriptor's blocking mode alone.
+func rawDiscoFD(f any) int {
+	sc, ok := f.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return -1
+	}
+	return fd
+}
+
+// RawDiscoCounters is a snapshot of the counters of disco packets
+// received on the raw and regular paths, for debugging. They count
+// from process start, for all Conns, like the clientmetrics backing
+// them; compare two snapshots for rates.
+type RawDiscoCounters struct {
+	// RawIPv4 and RawIPv6 count the disco packets the raw disco
+	// receivers passed on to be handled.
+	RawIPv4, RawIPv6 int64
+	// RawBytesIPv4 and RawBytesIPv6 are the UDP payload bytes in them.
+	RawBytesIPv4, RawBytesIPv6 int64
+	// SocketIPv4 and SocketIPv6 count the disco packets handled from
+	// the regular UDP sockets.
+	SocketIPv4, SocketIPv6 int64
+	// SocketIgnoredIPv4 and SocketIgnoredIPv6 count the disco packets
+	// the regular UDP sockets got while the raw path was active, and
+	// left to it. Where the raw path covers everything they match
+	// RawIPv4 and RawIPv6; the difference is what it missed.
+	SocketIgnoredIPv4, SocketIgnoredIPv6 int64
+
+	// The rest count the packets the raw disco receivers dropped, by
+	// reason.
+	PortMismatchIPv4, PortMismatchIPv6 int64
+	PortZero                           int64
+	NoPort                             int64 // regular UDP socket unbound
+	Short                              int64 // smaller than a UDP header
+	BadSrc                             int64
+	Truncated                          int64
+	Fragmented, FragmentedIPv6         int64
+	ZeroKey                            int64 // all-zero sender key
+	SrcDenied                          int64 // see SetRawDiscoSourceAllowlist
+	Undecryptable                      int64
+}
+
+// RawDiscoCounters returns a snapshot of the disco receive counters.
+// It reads them without locking, so they may be off from one another
+// by the packets received meanwhile.
+func (c *Conn) RawDiscoCounters() RawDiscoCounters {
+	return RawDiscoCounters{
+		RawIPv4:           metricRecvDiscoPacketIPv4.Value(),
+		RawIPv6:           metricRecvDiscoPacketIPv6.Value(),
+		RawBytesIPv4:      metricRecvDiscoBytesIPv4.Value(),
+		RawBytesIPv6:      metricRecvDiscoBytesIPv6.Value(),
+		SocketIPv4:        metricRecvDiscoSocketIPv4.Value(),
+		SocketIPv6:        metricRecvDiscoSocketIPv6.Value(),
+		SocketIgnoredIPv4: metricRecvDiscoSocketIgnoredIPv4.Value(),
+		SocketIgnoredIPv6: metricRecvDiscoSocketIgnoredIPv6.Value(),
+		PortMismatchIPv4:  metricRecvDiscoRawPortMismatchIPv4.Value(),
+		PortMismatchIPv6:  metricRecvDiscoRawPortMismatchIPv6.Value(),
+		PortZero:          metricRecvDiscoRawPortZero.Value(),
+		NoPort:            metricRecvDiscoRawNoPort.Value(),
+		Short:             metricRecvDiscoRawShort.Value(),
+		BadSrc:            metricRecvDiscoRawBadSrc.Value(),
+		Truncated:         metricRecvDiscoRawTruncated.Value(),
+		Fragmented:        metricRecvDiscoRawFragmented.Value(),
+		FragmentedIPv6:    metricRecvDiscoRawFragmentedIPv6.Value(),
+		ZeroKey:           metricRecvDiscoRawZeroKey.Value(),
+		SrcDenied:         metricRecvDiscoRawSrcDenied.Value(),
+		Undecryptable:     metricRecvDiscoRawUndecryptable.Value(),
+	}
+}
+
+// rawDiscoObserverQueueLen is how many packets a raw disco observer
+// (see SetRawDiscoObserver) can fall behind by before further ones are
+// dropped.
+const rawDiscoObserverQueueLen = 64
+
+// rawDiscoObservation is a packet passed on to a raw disco observer.
+type rawDiscoObservation struct {
+	src        netip.AddrPort
+	payloadLen int
+	family     string
+}
+
+// rawDiscoObserver calls fn for packets sent to it, on its own
+// goroutine.
+type rawDiscoObserver struct {
+	fn   func(src netip.AddrPort, payloadLen int, family string)
+	ch   chan rawDiscoObservation
+	stop chan struct{} // closed when replaced
+}
+
+// observe queues ob for o's fn, unless it's too far behind.
+func (o *rawDiscoObserver) observe(ob rawDiscoObservation) {
+	select {
+	case o.ch <- ob:
+	default:
+		metricRecvDiscoRawObserverDropped.Add(1)
+	}
+}
+
+func (o *rawDiscoObserver) run(donec <-chan struct{}) {
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-donec:
+			return
+		case ob := <-o.ch:
+			o.fn(ob.src, ob.payloadLen, ob.family)
+		}
+	}
+}
+
+// SetRawDiscoObserver sets fn to be called with the source, payload
+// length and address family ("ip4" or "ip6") of each disco packet the
+// raw disco receivers accept, for debugging tools. It replaces any
+// previous fn; a nil fn removes it.
+//
+// fn is called on a goroutine of its own, never concurrently with
+// itself. If it falls behind, packets are dropped instead of waiting
+// for it; disco handling itself is never held up.
+func (c *Conn) SetRawDiscoObserver(fn func(src netip.AddrPort, payloadLen int, family string)) {
+	var o *rawDiscoObserver
+	if fn != nil {
+		o = &rawDiscoObserver{
+			fn:   fn,
+			ch:   make(chan rawDiscoObservation, rawDiscoObserverQueueLen),
+			stop: make(chan struct{}),
+		}
+		go o.run(c.donec)
+	}
+	if old := c.rawDiscoObserver.Swap(o); old != nil {
+		close(old.stop)
+	}
+}
+
+// SetRawDiscoSTUNFunc sets fn to be passed the STUN binding responses
+// the raw disco receivers accept with TS_DEBUG_RAW_DISCO_STUN, and
+// their source, for debugging NAT behavior. It replaces any previous
+// fn; a nil fn removes it. Without the knob, fn is never called.
+//
+// fn is called on the receiver's goroutine, so mustn't block, and
+// mustn't keep pkt after returning. The responses are handled from the
+// regular UDP socket as usual regardless.
+func (c *Conn) SetRawDiscoSTUNFunc(fn func(pkt []byte, src netip.AddrPort)) {
+	if fn == nil {
+		c.rawDiscoSTUNFunc.Store(nil)
+		return
+	}
+	c.rawDiscoSTUNFunc.Store(&fn)
+}
+
+// isEncapDisco reports whether msg, a UDP payload accepted by a raw
+// disco receiver, is encapsulated disco: not disco itself, but with the
+// disco magic at the offset TS_DEBUG_RAW_DISCO_ENCAP_OFFSET sets.
+func isEncapDisco(msg []byte) bool {
+	off, ok := rawDiscoEncapOffset()
+	if !ok || len(msg) < off || disco.LooksLikeDiscoWrapper(msg) {
+		return false
+	}
+	return disco.LooksLikeDiscoWrapper(msg[off:])
+}
+
+// SetRawDiscoEncapFunc sets fn to be called with the packets the raw
+// disco receivers accept as encapsulated disco, and their source, with
+// TS_DEBUG_RAW_DISCO_ENCAP_OFFSET set, for experimenting with carrying
+// disco inside another transport. It replaces any previous fn; a nil
+// fn removes it, and such packets are dropped. Without the knob, fn is
+// never called.
+//
+// fn is called on the receiver's goroutine, so mustn't block, and
+// mustn't keep pkt, the whole UDP payload, after returning.
+func (c *Conn) SetRawDiscoEncapFunc(fn func(pkt []byte, src netip.AddrPort)) {
+	if fn == nil {
+		c.rawDiscoEncapFunc.Store(nil)
+		return
+	}
+	c.rawDiscoEncapFunc.Store(&fn)
+}
+
+// SetRawDiscoSourceAllowlist limits the disco the raw disco receivers
+// accept to that from within srcs, dropping the rest, for deployments
+// where disco should only ever come from known ranges, such as peers'
+// networks. With an empty srcs, the default, disco from anywhere is
+// accepted. It can be changed at any time, taking effect from the next
+// packet.
+//
+// On its own this only narrows who can try spoofing disco: sources are
+// trivially forged, and disco authenticates its senders regardless.
+func (c *Conn) SetRawDiscoSourceAllowlist(srcs []netip.Prefix) error {
+	if len(srcs) == 0 {
+		c.rawDiscoAllowedSrcs.Store(nil)
+		return nil
+	}
+	var b netipx.IPSetBuilder
+	for _, p := range srcs {
+		if !p.IsValid() {
+			return fmt.Errorf("invalid source prefix %v", p)
+		}
+		b.AddPrefix(p.Masked())
+	}
+	set, err := b.IPSet()
+	if err != nil {
+		return err
+	}
+	c.rawDiscoAllowedSrcs.Store(set)
+	return nil
+}
+
+// rawDiscoSourcesMax is how many source IPs rawDiscoSources keeps
+// counts for. Sources are trivially spoofed, so it has to be bounded.
+const rawDiscoSourcesMax = 64
+
+// rawDiscoSources counts the disco packets accepted by the raw disco
+// receivers by source IP, for the rawDiscoSourcesMax most recently
+// seen sources.
+type rawDiscoSources struct {
+	mu sync.Mutex
+	ll *list.List                   // of *RawDiscoSource, most recently seen first
+	m  map[netip.Addr]*list.Element // values in ll
+}
+
+// RawDiscoSource is the number of disco packets received by the raw
+// disco receivers from one source IP. See Conn.RawDiscoSources.
+type RawDiscoSource struct {
+	Addr     netip.Addr
+	Packets  int64
+	LastSeen time.Time
+	IfIndex  int // of the interface the last packet arrived on, or 0 if unknown
+
+	// LastHWTime is when the last packet arrived by the hardware
+	// clock of the NIC it arrived on, with hardware timestamps (see
+	// TS_DEBUG_RAW_DISCO_HW_TIMESTAMPS), or zero. That's only on the
+	// system clock if something, such as phc2sys, keeps it there.
+	LastHWTime time.Time
+
+	// FlowLabel is the IPv6 flow label of the last packet, or zero if
+	// it had none. A source that sets one keeps it for as long as the
+	// flow lasts, so a change can mean its path did, as across ECMP
+	// links.
+	FlowLabel uint32
+}
+
+// add counts a packet from ip, received as rx says, evicting the least
+// recently seen source if there are too many. It returns the flow
+// label of the source's previous packet, or zero if there wasn't one.
+func (s *rawDiscoSources) add(ip netip.Addr, rx rawDiscoRx) (prevFlowLabel uint32) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.m[ip]; ok {
+		src := e.Value.(*RawDiscoSource)
+		src.Packets++
+		src.LastSeen = now
+		src.IfIndex = rx.ifIndex
+		src.LastHWTime = rx.hwTime
+		prevFlowLabel, src.FlowLabel = src.FlowLabel, rx.flowLabel
+		s.ll.MoveToFront(e)
+		return prevFlowLabel
+	}
+	if s.ll == nil {
+		s.ll = list.New()
+		s.m = make(map[netip.Addr]*list.Element)
+	}
+	s.m[ip] = s.ll.PushFront(&RawDiscoSource{Addr: ip, Packets: 1, LastSeen: now, IfIndex: rx.ifIndex, LastHWTime: rx.hwTime, FlowLabel: rx.flowLabel})
+	if s.ll.Len() > rawDiscoSourcesMax {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.m, oldest.Value.(*RawDiscoSource).Addr)
+	}
+	return 0
+}
+
+// reset forgets all sources.
+func (s *rawDiscoSources) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ll = nil
+	s.m = nil
+}
+
+// RawDiscoSources returns the number of disco packets the raw disco
+// receivers accepted from each of the last few dozen source IPs seen,
+// busiest first. Sources are forgotten, counts and all, once enough
+// others have been seen since.
+func (c *Conn) RawDiscoSources() []RawDiscoSource {
+	s := &c.rawDiscoSources
+	s.mu.Lock()
+	ret := make([]RawDiscoSource, 0, len(s.m))
+	for _, e := range s.m {
+		ret = append(ret, *e.Value.(*RawDiscoSource))
+	}
+	s.mu.Unlock()
+	slices.SortFunc(ret, func(a, b RawDiscoSource) bool {
+		if a.Packets != b.Packets {
+			return a.Packets > b.Packets
+		}
+		return a.Addr.Less(b.Addr)
+	})
+	return ret
+}
+
+// rawDiscoHistoryLen is how many packets RecentRawDisco returns, at
+// most.
+const rawDiscoHistoryLen = 256
+
+// RawDiscoPacket is a disco packet the raw disco receivers accepted.
+// See Conn.RecentRawDisco.
+type RawDiscoPacket struct {
+	Src     netip.AddrPort
+	Size    int    // of the UDP payload
+	Family  string // of the receiver: "ip4" or "ip6"
+	At      time.Time
+	Version int // disco protocol version, by its magic; see rawDiscoVersion
+}
+
+// rawDiscoHistory is a ring of the last rawDiscoHistoryLen packets the
+// raw disco receivers accepted, overwriting the oldest. It's fixed in
+// size, and adding to it only holds mu to copy the entry into place.
+type rawDiscoHistory struct {
+	mu   sync.Mutex
+	ring [rawDiscoHistoryLen]rawDiscoHistoryEntry
+	n    int // entries ever added; the next goes at n%rawDiscoHistoryLen
+}
+
+// rawDiscoHistoryEntry is a RawDiscoPacket as rawDiscoHistory keeps
+// it, its time left monotonic until it's asked for.
+type rawDiscoHistoryEntry struct {
+	src     netip.AddrPort
+	size    int
+	family  string
+	at      mono.Time
+	version int
+}
+
+func (h *rawDiscoHistory) add(e rawDiscoHistoryEntry) {
+	h.mu.Lock()
+	h.ring[h.n%rawDiscoHistoryLen] = e
+	h.n++
+	h.mu.Unlock()
+}
+
+// RecentRawDisco returns the last packets the raw disco receivers
+// accepted, up to a few hundred of them, oldest first, for debugging
+// without a packet capture. Only those passed on to handleDiscoMessage
+// are included: not duplicates of ones from the regular UDP sockets,
+// nor those dropped before then, such as while PauseRawDisco has them
+// paused.
+func (c *Conn) RecentRawDisco() []RawDiscoPacket {
+	h := &c.rawDiscoHistory
+	h.mu.Lock()
+	n := h.n
+	if n > rawDiscoHistoryLen {
+		n = rawDiscoHistoryLen
+	}
+	entries := make([]rawDiscoHistoryEntry, 0, n)
+	for i := h.n - n; i < h.n; i++ {
+		entries = append(entries, h.ring[i%rawDiscoHistoryLen])
+	}
+	h.mu.Unlock()
+
+	ret := make([]RawDiscoPacket, len(entries))
+	for i, e := range entries {
+		ret[i] = RawDiscoPacket{
+			Src:     e.src,
+			Size:    e.size,
+			Family:  e.family,
+			At:      e.at.WallTime(),
+			Version: e.version,
+		}
+	}
+	return ret
+}
+
+// rawDiscoDedupTTL is how long rawDiscoDedup remembers a disco packet
+// for. Copies of one packet read from both the raw and regular paths
+// come at most a socket buffer's worth of packets apart.
+const rawDiscoDedupTTL = 2 * time.Second
+
+// rawDiscoDedupMax is how many packets rawDiscoDedup remembers. Anyone
+// can send disco packets, so it has to be bounded; past it, copies may
+// be handled twice, as they would be without it.
+const rawDiscoDedupMax = 256
+
+// rawDiscoDedup remembers the disco packets recently handled from the
+// raw and regular paths, so a packet read from both is handled once.
+// In steady state only one of them handles disco, but around a pause,
+// resume, start or stop of a raw disco receiver, a packet queued on
+// both sockets can be handled from the one, then the other.
+//
+// Each disco packet has its own nonce, so the same bytes from the same
+// source are always copies of one packet, never a new one.
+type rawDiscoDedup struct {
+	// lastRaw is when (a mono.Time) the raw path last handled a
+	// packet. The regular path only checks for copies while the raw
+	// path is active or was recently. It's read on the receive hot
+	// path, hence atomic.
+	lastRaw atomic.Int64
+
+	mu   sync.Mutex
+	seed maphash.Seed
+	seen map[uint64]mono.Time // packet hash => when first handled
+	// order is the packets in seen, oldest first from next, so that
+	// making room for one evicts the oldest without a scan of seen.
+	order []rawDiscoDedupEntry // len rawDiscoDedupMax
+	next  int                  // index into order of the oldest
+}
+
+// rawDiscoDedupEntry is a packet hash and when rawDiscoDedup recorded
+// it.
+type rawDiscoDedupEntry struct {
+	k  uint64
+	at mono.Time
+}
+
+// reset forgets the packets handled so far. Any copy of one of them
+// still to come is then handled again, as it would be without d.
+func (d *rawDiscoDedup) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen = nil
+	d.order = nil
+	d.next = 0
+}
+
+// recentlyRaw reports whether the raw path handled a packet within
+// rawDiscoDedupTTL of now.
+func (d *rawDiscoDedup) recentlyRaw(now mono.Time) bool {
+	return now.Sub(mono.Time(d.lastRaw.Load())) < rawDiscoDedupTTL
+}
+
+// dup reports whether msg from src was handled within rawDiscoDedupTTL
+// of now, and if not records that it is being handled. fromRaw is
+// whether it's the raw path asking.
+func (d *rawDiscoDedup) dup(msg []byte, src netip.AddrPort, now mono.Time, fromRaw bool) bool {
+	if fromRaw {
+		d.lastRaw.Store(int64(now))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seed = maphash.MakeSeed()
+		d.seen = make(map[uint64]mono.Time)
+		d.order = make([]rawDiscoDedupEntry, rawDiscoDedupMax)
+	}
+	var h maphash.Hash
+	h.SetSeed(d.seed)
+	// The paths agree on the address, but not on whether IPv4 ones are
+	// mapped, so hash them unmapped; and not always on IPv6 zones,
+	// which are left out.
+	a := src.Addr().Unmap().As16()
+	h.Write(a[:])
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], src.Port())
+	h.Write(port[:])
+	h.Write(msg)
+	k := h.Sum64()
+
+	if at, ok := d.seen[k]; ok && now.Sub(at) < rawDiscoDedupTTL {
+		metricRecvDiscoDedup.Add(1)
+		return true
+	}
+	// Make room by forgetting the oldest, unless it's since been
+	// recorded again, expired, in a later slot.
+	if old := d.order[d.next]; old.at != 0 && d.seen[old.k] == old.at {
+		delete(d.seen, old.k)
+	}
+	d.order[d.next] = rawDiscoDedupEntry{k, now}
+	d.next = (d.next + 1) % len(d.order)
+	d.seen[k] = now
+	return false
+}
+
+// socketDiscoDup reports whether b, a disco packet from ipp read from
+// the regular UDP socket, is a copy of one already handled from the
+// raw path. It only checks while the raw path might have handled it.
+func (c *Conn) socketDiscoDup(b []byte, ipp netip.AddrPort) bool {
+	family := "ip6"
+	if ipp.Addr().Unmap().Is4() {
+		family = "ip4"
+	}
+	now := mono.Now()
+	if !c.rawDiscoState(family).active.Load() && !c.rawDiscoDedup.recentlyRaw(now) {
+		return false
+	}
+	return c.rawDiscoDedup.dup(b, ipp, now, false)
+}
+
+// rawDiscoRx is how a datagram arrived at a raw disco receiver, as far
+// as it can tell.
+type rawDiscoRx struct {
+	at      mono.Time // when it arrived
+	ifIndex int       // index of the interface it arrived on, or 0 if unknown
+
+	// hwTime is when the NIC timestamped it, by its own clock, or zero.
+	// See TS_DEBUG_RAW_DISCO_HW_TIMESTAMPS.
+	hwTime time.Time
+
+	// flowLabel is the flow label of the IPv6 packet it came in, or
+	// zero if it had none or it's not known.
+	flowLabel uint32
+
+	// counts is the reader's to count it in, or nil to count it
+	// straight to the metrics and the receiver's rawDiscoState.
+	counts *rawDiscoCounts
+}
+
+// rawDiscoCountsFlushInterval is how often a raw disco reader's
+// rawDiscoCounts are flushed, and so how far behind the reader they
+// can be.
+const rawDiscoCountsFlushInterval = time.Second
+
+// rawDiscoCounts is what one raw disco reader has counted since it
+// last flushed: the disco it passed on, for its receiver's lastRecv
+// and recvCount, and the metrics every packet read adds to, such as
+// metricRecvDiscoPacketIPv4 and the size histogram. At high packet
+// rates, the readers sharing a socket updating those directly would
+// contend for their cache lines on every packet; instead each counts
+// in its own and flushes them every rawDiscoCountsFlushInterval, and
+// once more when it stops. checkRawDiscoSilence and
+// checkRawDiscoStarved look over minutes, so don't mind the lag.
+//
+// That's not all the readers share per packet: rawDiscoDedup,
+// rawDiscoSources and rawDiscoHistory each take a lock for every one
+// passed on, as they have to see all the readers' packets as they
+// come.
+//
+// Only the reader counts, and flush runs once a second, so mu is all
+// but uncontended.
+type rawDiscoCounts struct {
+	s *rawDiscoState // the reader's receiver's
+
+	mu       sync.Mutex
+	recv     int64                          // packets passed on, for s.recvCount
+	lastRecv mono.Time                      // when the last was, for s.lastRecv
+	metrics  map[*clientmetric.Metric]int64 // nil until one is counted
+}
+
+// newRawDiscoCounts returns the rawDiscoCounts for a reader of the raw
+// disco receiver for family.
+func (c *Conn) newRawDiscoCounts(family string) *rawDiscoCounts {
+	return &rawDiscoCounts{s: c.rawDiscoState(family)}
+}
+
+// add adds n to m. If rc is nil, it's added straight away.
+func (rc *rawDiscoCounts) add(m *clientmetric.Metric, n int64) {
+	if rc == nil {
+		m.Add(n)
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.metrics == nil {
+		rc.metrics = make(map[*clientmetric.Metric]int64)
+	}
+	rc.metrics[m] += n
+}
+
+// received counts a disco packet, received at at, as passed on to be
+// handled by s, the receiver of the reader rc is for. If rc is nil,
+// it's counted in s straight away.
+func (rc *rawDiscoCounts) received(s *rawDiscoState, at mono.Time) {
+	if rc == nil {
+		s.noteRecv(1, at)
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.recv++
+	if at > rc.lastRecv {
+		rc.lastRecv = at
+	}
+}
+
+// flush adds what's been counted since the last flush to the metrics
+// and the receiver.
+func (rc *rawDiscoCounts) flush() {
+	rc.mu.Lock()
+	recv, lastRecv, metrics := rc.recv, rc.lastRecv, rc.metrics
+	rc.recv, rc.lastRecv, rc.metrics = 0, 0, nil
+	rc.mu.Unlock()
+	if recv != 0 {
+		rc.s.noteRecv(recv, lastRecv)
+	}
+	for m, n := range metrics {
+		m.Add(n)
+	}
+}
+
+// noteRecv records that the receiver passed on n more disco packets,
+// the last at at. Readers flushing late don't move lastRecv back.
+func (s *rawDiscoState) noteRecv(n int64, at mono.Time) {
+	s.recvCount.Add(n)
+	for {
+		old := s.lastRecv.Load()
+		if int64(at) <= old || s.lastRecv.CompareAndSwap(old, int64(at)) {
+			return
+		}
+	}
+}
+
+// handleRawDiscoDatagram handles b, a UDP datagram (from its header
+// onwards) read by the raw disco receiver for family from src and
+// accepted by its BPF filter, passing it on to handleDiscoMessage if
+// it's for our port. rx is how it arrived.
+//
+// The interface is only recorded, in RawDiscoSources. Endpoints are
+// matched by address, and for IPv6 link-local ones, whose addresses
+// alone are ambiguous between interfaces, by zone, which already names
+// it; for other addresses, which interface they arrived on doesn't
+// change which peer they're from.
+func (c *Conn) handleRawDiscoDatagram(b []byte, src net.Addr, family string, rx rawDiscoRx) {
+	defer c.recoverRawDiscoPanic(family)
+	if len(b) < udpHeaderSize {
+		// Too small to be a valid UDP datagram, drop.
+		metricRecvDiscoRawShort.Add(1)
+		return
+	}
+	c.writeRawDiscoPcap(b, src, family, rx)
+	if bytes.Equal(b[udpHeaderSize:], testDiscoPacket) {
+		// Sent by checkRawDiscoHealth (or the self-test, if it
+		// didn't get to read it).
+		c.rawDiscoState(family).noteSelfTestEcho()
+		return
+	}
+	rx.counts.add(rawDiscoSizeMetric(len(b)-udpHeaderSize), 1)
+	if c.rawDiscoPaused.Load() {
+		metricRecvDiscoRawPaused.Add(1)
+		return
+	}
+	if isZeroDiscoSender(b[udpHeaderSize:]) {
+		// Like testDiscoPacket, but not quite. It can't be from any
+		// peer, so don't bother handleDiscoMessage.
+		metricRecvDiscoRawZeroKey.Add(1)
+		return
+	}
+
+	dstPort := binary.BigEndian.Uint16(b[2:4])
+	if dstPort == 0 {
+		// Not a valid UDP destination; a raw socket sees it anyway.
+		c.logf("[unexpected] disco raw: received packet for port 0")
+		metricRecvDiscoRawPortZero.Add(1)
+		return
+	}
+
+	var portsBuf [2]uint16
+	acceptPorts := c.appendRawDiscoPorts(portsBuf[:0], family)
+	if len(acceptPorts) == 0 {
+		// This should only typically happen if the receiving address family
+		// was recently disabled.
+		c.dlogf("[v1] disco raw: dropping packet for port %d as no ports are bound", dstPort)
+		metricRecvDiscoRawNoPort.Add(1)
+		return
+	}
+
+	// The BPF filter only accepts our port too, but it may be a step
+	// behind a rebind.
+	if !slices.Contains(acceptPorts, dstPort) {
+		c.dlogf("[v1] disco raw: dropping packet for port %d", dstPort)
+		if family == "ip6" {
+			metricRecvDiscoRawPortMismatchIPv6.Add(1)
+		} else {
+			metricRecvDiscoRawPortMismatchIPv4.Add(1)
+		}
+		return
+	}
+
+	ipAddr, ok := src.(*net.IPAddr)
+	if !ok {
+		c.logf("[unexpected] disco raw: source %v is a %T, not an IP address", src, src)
+		metricRecvDiscoRawBadSrc.Add(1)
+		return
+	}
+	srcIP, ok := netip.AddrFromSlice(ipAddr.IP)
+	if !ok {
+		c.logf("[unexpected] PacketConn.ReadFrom returned not-an-IP %v in from", src)
+		metricRecvDiscoRawBadSrc.Add(1)
+		return
+	}
+	// IPv4 sources may come in their 16 byte form, depending on the
+	// reader. IPv6 link-local ones come with a zone, which, as for
+	// the regular UDP socket, is kept so they match the right endpoint.
+	srcIP = srcIP.Unmap()
+	if srcIP.Is6() {
+		srcIP = srcIP.WithZone(ipAddr.Zone)
+	}
+	srcPort := binary.BigEndian.Uint16(b[:2])
+
+	if stun.Is(b[udpHeaderSize:]) {
+		// Accepted by rawDiscoSTUNMatch. It's no disco packet, and
+		// the regular UDP socket gets it too, for netcheck.
+		metricRecvDiscoRawSTUN.Add(1)
+		if fn := c.rawDiscoSTUNFunc.Load(); fn != nil {
+			(*fn)(b[udpHeaderSize:], netip.AddrPortFrom(srcIP, srcPort))
+		}
+		return
+	}
+
+	if allowed := c.rawDiscoAllowedSrcs.Load(); allowed != nil && !allowed.Contains(srcIP.WithZone("")) {
+		c.dlogf("[v1] disco raw: dropping packet from %v, not in the source allowlist", srcIP)
+		metricRecvDiscoRawSrcDenied.Add(1)
+		return
+	}
+
+	if isEncapDisco(b[udpHeaderSize:]) {
+		// Accepted by the match TS_DEBUG_RAW_DISCO_ENCAP_OFFSET adds.
+		// Whatever the encapsulation is, it's for its handler to
+		// unwrap, not handleDiscoMessage.
+		metricRecvDiscoRawEncap.Add(1)
+		if fn := c.rawDiscoEncapFunc.Load(); fn != nil {
+			(*fn)(b[udpHeaderSize:], netip.AddrPortFrom(srcIP, srcPort))
+		}
+		return
+	}
+
+	if c.rawDiscoDedup.dup(b[udpHeaderSize:], netip.AddrPortFrom(srcIP, srcPort), rx.at, true) {
+		return
+	}
+
+	rx.counts.received(c.rawDiscoState(family), rx.at)
+	if srcIP.Is4() {
+		rx.counts.add(metricRecvDiscoPacketIPv4, 1)
+		rx.counts.add(metricRecvDiscoBytesIPv4, int64(len(b)-udpHeaderSize))
+	} else {
+		rx.counts.add(metricRecvDiscoPacketIPv6, 1)
+		rx.counts.add(metricRecvDiscoBytesIPv6, int64(len(b)-udpHeaderSize))
+	}
+	if prev := c.rawDiscoSources.add(srcIP, rx); rx.flowLabel != prev && rx.flowLabel != 0 {
+		c.dlogf("[v1] disco raw: %v sending with IPv6 flow label %#05x, was %#05x", srcIP, rx.flowLabel, prev)
+	}
+	version := rawDiscoVersion(b[udpHeaderSize:])
+	if m := metricRecvDiscoRawVersion[version]; m != nil {
+		rx.counts.add(m, 1)
+	}
+	c.rawDiscoHistory.add(rawDiscoHistoryEntry{netip.AddrPortFrom(srcIP, srcPort), len(b) - udpHeaderSize, family, rx.at, version})
+
+	if o := c.rawDiscoObserver.Load(); o != nil {
+		o.observe(rawDiscoObservation{netip.AddrPortFrom(srcIP, srcPort), len(b) - udpHeaderSize, family})
+	}
+
+	if c.queueRawDisco(family, b[udpHeaderSize:], netip.AddrPortFrom(srcIP, srcPort), rx.at) {
+		return
+	}
+	c.handleRawDisco(family, b[udpHeaderSize:], netip.AddrPortFrom(srcIP, srcPort), rx.at)
+}
+
+// handleRawDisco passes msg, disco from src accepted by the raw disco
+// receiver for family at time at, to handleDiscoMessage. It's called
+// by handleRawDiscoDatagram, or with TS_DEBUG_RAW_DISCO_WORKERS, by
+// the workers it queues msg for.
+func (c *Conn) handleRawDisco(family string, msg []byte, src netip.AddrPort, at mono.Time) {
+	// As for disco read from the regular UDP socket, there's no node
+	// key to pass: derpNodeSrc is only for DERP, where the relay
+	// vouches for it. Over UDP, handleDiscoMessage finds peers by the
+	// sender's disco key, and learns which node is at src itself, in
+	// peerMap, once a ping about it authenticates. A node key guessed
+	// from the spoofable src would add nothing to either.
+	start := mono.Now()
+	isDisco, authFailed := c.handleDiscoMessageAuth(msg, src, key.NodePublic{}, at)
+	c.noteRawDiscoHandleTime(family, mono.Since(start))
+	if authFailed {
+		metricRecvDiscoRawUndecryptable.Add(1)
+	}
+	if (!isDisco || authFailed) && debugRawDiscoDump() {
+		c.dumpRawDisco(family, msg, src)
+	}
+}
+
+// maxRawDiscoWorkers bounds TS_DEBUG_RAW_DISCO_WORKERS.
+const maxRawDiscoWorkers = 16
+
+// rawDiscoWorkQueueLen is how many packets the raw disco workers (see
+// rawDiscoWorkerCount) can fall behind by before further ones are
+// dropped.
+const rawDiscoWorkQueueLen = 256
+
+// rawDiscoWorkerCount returns how many goroutines to hand the disco
+// the raw disco receivers accept to, from TS_DEBUG_RAW_DISCO_WORKERS,
+// or 0, the default, for the receivers' readers to call
+// handleDiscoMessage themselves.
+//
+// With workers, a slow handleDiscoMessage backs up their queue of
+// rawDiscoWorkQueueLen packets rather than the readers, and so the
+// kernel's receive buffer; once the queue's full, packets are dropped,
+// counted by metricRecvDiscoRawWorkerDropped, instead of waiting. That
+// doesn't handle more disco at once, as handleDiscoMessage serializes
+// on Conn.mu, but keeps reads going through a stall.
+//
+// One worker handles packets in the order the readers queue them, as
+// a lone reader would. More may handle them in any order, even those
+// from one peer, so that, say, an older call-me-maybe is handled after
+// a newer one and its endpoints are the ones tried. Disco tolerates
+// that much reordering from the network already, but the raw path
+// otherwise adds none with a single reader. (Duplicates are dropped
+// as before, ahead of the queue.)
+func rawDiscoWorkerCount() int {
+	if n, ok := envknob.LookupInt("TS_DEBUG_RAW_DISCO_WORKERS"); ok && n >= 1 && n <= maxRawDiscoWorkers {
+		return n
+	}
+	return 0
+}
+
+// rawDiscoWorkers are the goroutines TS_DEBUG_RAW_DISCO_WORKERS has
+// the raw disco receivers hand their disco to. They're started on the
+// first packet, and run until the Conn is closed.
+type rawDiscoWorkers struct {
+	once sync.Once
+	ch   chan rawDiscoWork // or nil with no workers
+}
+
+// rawDiscoWork is a packet queued for the raw disco workers, for
+// handleRawDisco.
+type rawDiscoWork struct {
+	family string
+	msg    []byte // a copy, the reader's buffer being reused
+	src    netip.AddrPort
+	at     mono.Time
+}
+
+// queueRawDisco queues msg, as handleRawDisco takes it, for the raw
+// disco workers, reporting whether there are any. If so, msg is copied
+// and left to them, or dropped should they be too far behind; if not,
+// it's for the caller to handle.
+func (c *Conn) queueRawDisco(family string, msg []byte, src netip.AddrPort, at mono.Time) bool {
+	w := &c.rawDiscoWorkers
+	w.once.Do(func() {
+		n := rawDiscoWorkerCount()
+		if n == 0 {
+			return
+		}
+		w.ch = make(chan rawDiscoWork, rawDiscoWorkQueueLen)
+		for i := 0; i < n; i++ {
+			go c.runRawDiscoWorker(w.ch)
+		}
+	})
+	if w.ch == nil {
+		return false
+	}
+	select {
+	case w.ch <- rawDiscoWork{family, append([]byte(nil), msg...), src, at}:
+	default:
+		metricRecvDiscoRawWorkerDropped.Add(1)
+	}
+	return true
+}
+
+func (c *Conn) runRawDiscoWorker(ch <-chan rawDiscoWork) {
+	for {
+		select {
+		case <-c.donec:
+			return
+		case w := <-ch:
+			c.handleRawDisco(w.family, w.msg, w.src, w.at)
+		}
+	}
+}
+
+// debugRawDiscoDump logs the packets the raw disco receivers accepted
+// but handleDiscoMessage rejected. See dumpRawDisco.
+var debugRawDiscoDump = envknob.RegisterBool("TS_DEBUG_RAW_DISCO_DUMP")
+
+// rawDiscoDumpMax is how many bytes of a packet dumpRawDisco logs.
+// That covers the magic, sender key and nonce, which is what tells
+// a magic number collision from a spoofed or stale disco packet.
+const rawDiscoDumpMax = 64
+
+// dumpRawDisco logs the start of msg, a packet from src that the raw
+// disco receiver for family accepted but handleDiscoMessage rejected,
+// in hex. Anyone can send these, so it's rate limited more tightly
+// than anything else here, and only hex ever gets into the log.
+func (c *Conn) dumpRawDisco(family string, msg []byte, src netip.AddrPort) {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	if s.dumpLogf == nil {
+		s.dumpLogf = logger.RateLimitedFn(c.logf, time.Minute, 5, 10)
+	}
+	logf := s.dumpLogf
+	s.mu.Unlock()
+
+	dump, more := msg, ""
+	if len(dump) > rawDiscoDumpMax {
+		dump, more = dump[:rawDiscoDumpMax], "..."
+	}
+	logf("disco raw: rejected %d byte %v packet from %v: %x%s", len(msg), family, src, dump, more)
+}
+
+// recoverRawDiscoPanic, deferred by handleRawDiscoDatagram, recovers
+// from a panic handling a packet from the raw disco receiver for
+// family, so that one bad packet can't stop the receiver's reader and
+// with it disco over that family. It's the raw path's reader
+// goroutine at stake, not the packet, so it's logged and moved past.
+// (handleDiscoMessage and everything below it unlock with defer, so
+// nothing is left locked.)
+func (c *Conn) recoverRawDiscoPanic(family string) {
+	if p := recover(); p != nil {
+		metricRecvDiscoRawPanics.Add(1)
+		c.rawDiscoErrLogf(family)("disco raw: panic handling %v packet: %v\n%s", family, p, debug.Stack())
+	}
+}
+
+// rawDiscoSlowHandle is how long handleDiscoMessage can take with a
+// packet from a raw disco receiver before it's logged: any longer, and
+// a burst of them can back up into the kernel's receive buffer.
+const rawDiscoSlowHandle = 10 * time.Millisecond
+
+// noteRawDiscoHandleTime counts how long handleDiscoMessage took, d,
+// with a packet for family from the raw disco receiver, logging it if
+// it was slow.
+func (c *Conn) noteRawDiscoHandleTime(family string, d time.Duration) {
+	switch {
+	case d < 100*time.Microsecond:
+		metricRecvDiscoRawHandleLt100us.Add(1)
+	case d < time.Millisecond:
+		metricRecvDiscoRawHandleLt1ms.Add(1)
+	case d < rawDiscoSlowHandle:
+		metricRecvDiscoRawHandleLt10ms.Add(1)
+	default:
+		metricRecvDiscoRawHandleSlow.Add(1)
+		c.rawDiscoSlowLogf(family)("disco raw: handling %v packet took %v", family, d.Round(time.Microsecond))
+	}
+}
+
+// rawDiscoSizeMetric returns the metric counting packets of payload
+// size n, of those a raw disco receiver's filter accepted, whatever
+// becomes of them. Pings and pongs are around 120 bytes, and
+// call-me-maybes grow with the endpoints they list; the larger buckets
+// show whether anything comes near rawDiscoMaxSize, or past it once
+// the filter's allowed to pass more.
+func rawDiscoSizeMetric(n int) *clientmetric.Metric {
+	switch {
+	case n < 128:
+		return metricRecvDiscoRawSizeLt128
+	case n < 256:
+		return metricRecvDiscoRawSizeLt256
+	case n < 512:
+		return metricRecvDiscoRawSizeLt512
+	case n < 1024:
+		return metricRecvDiscoRawSizeLt1024
+	case n < 2048:
+		return metricRecvDiscoRawSizeLt2048
+	default:
+		return metricRecvDiscoRawSizeLarge
+	}
+}
+
+// rawDiscoSlowLogf returns the logf for slow handling of packets from
+// the raw disco receiver for family, rate limited as slowness tends to
+// come in bursts.
+func (c *Conn) rawDiscoSlowLogf(family string) logger.Logf {
+	s := c.rawDiscoState(family)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slowLogf == nil {
+		s.slowLogf = logger.RateLimitedFn(c.logf, time.Minute, 2, 10)
+	}
+	return s.slowLogf
+}
+
+// rawDiscoKeyChanged is how Conn tells the raw disco layer its disco
+// key, or the disco protocol version it speaks, changed, so it forgets
+// what it learned of disco under the old one: the sources in
+// RawDiscoSources and the packets rawDiscoDedup remembers. It's called
+// with c.mu held.
+//
+// Neither the filters nor the readers depend on the key, so they carry
+// on as they were, and no packet is dropped meanwhile; at worst, one
+// read from both paths across the change is handled twice. The
+// metrics, including the per-version counts, are cumulative over the
+// process's lifetime and stay as they are.
+func (c *Conn) rawDiscoKeyChanged() {
+	c.rawDiscoSources.reset()
+	c.rawDiscoDedup.reset()
+}
+
+// rawDiscoVersion returns the disco protocol version of msg, going by
+// which of rawDiscoMagics it starts with, or 0 if none.
+//
+// Only version 1 exists so far, which is all handleDiscoMessage
+// decodes. Once there's another, this is where the raw path tells them
+// apart.
+func rawDiscoVersion(msg []byte) int {
+	if len(msg) < 6 {
+		return 0
+	}
+	hi := binary.BigEndian.Uint32(msg[0:4])
+	lo := binary.BigEndian.Uint16(msg[4:6])
+	for _, m := range rawDiscoMagics {
+		if m.hi == hi && m.lo == lo {
+			return m.version
+		}
+	}
+	return 0
+}
+
+// rawDiscoMaxTransientErrs is how many transient read errors in a row
+// a raw disco reader puts up with before giving up as for any other
+// error, in case one keeps failing without ever blocking.
+const rawDiscoMaxTransientErrs = 100
+
+// isTransientRawDiscoErr reports whether err, from reading a raw disco
+// receiver, is worth reading again after, such as from the kernel
+// running short of buffers in a burst.
+func isTransientRawDiscoErr(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR)
+}
+
+// isZeroDiscoSender reports whether msg, a disco message, has an
+// all-zero sender key, as testDiscoPacket does.
+func isZeroDiscoSender(msg []byte) bool {
+	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
+	if len(msg) < headerLen {
+		return false
+	}
+	for _, b := range msg[len(disco.Magic):headerLen] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stripIPv4Header returns the payload of the IPv4 packet b, or nil if
+// b is too short to hold the header its IHL field claims.
+func stripIPv4Header(b []byte) []byte {
+	if len(b) < ipv4.HeaderLen {
+		return nil
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < ipv4.HeaderLen || len(b) < ihl {
+		return nil
+	}
+	return b[ihl:]
+}
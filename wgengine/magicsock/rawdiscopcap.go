@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// debugRawDiscoPcap, if set, is the path of a pcap file to write each
+// packet the raw disco receivers' filters accept to, for debugging
+// with Wireshark or tcpdump -r. See writeRawDiscoPcap.
+var debugRawDiscoPcap = envknob.RegisterString("TS_DEBUG_RAW_DISCO_PCAP")
+
+// rawDiscoPcapMaxSize is how large TS_DEBUG_RAW_DISCO_PCAP's file grows
+// before it's moved aside to the same path with ".1" appended,
+// replacing any previous one, and started afresh. At most twice this
+// is on disk at once.
+const rawDiscoPcapMaxSize = 64 << 20
+
+const (
+	pcapMagicNanos  = 0xa1b23c4d // with nanosecond timestamps
+	pcapLinkTypeRaw = 101        // LINKTYPE_RAW: IPv4 or IPv6, by the version field
+	pcapSnapLen     = 1<<16 - 1
+	pcapHeaderLen   = 24
+	pcapRecordLen   = 16 // of each record's header
+)
+
+// rawDiscoPcap writes the file TS_DEBUG_RAW_DISCO_PCAP names. It's
+// opened on the first packet written, shared by the receivers of both
+// families and all their readers, and closed by Conn.Close.
+type rawDiscoPcap struct {
+	mu      sync.Mutex
+	f       *os.File // or nil if not open
+	size    int64    // bytes written to f
+	maxSize int64    // or 0 for rawDiscoPcapMaxSize
+	failed  bool     // opening or writing f failed; don't try again
+	closed  bool
+}
+
+// writeRawDiscoPcap appends b, a UDP datagram (from its header onwards)
+// read by the raw disco receiver for family from src, to the file
+// TS_DEBUG_RAW_DISCO_PCAP names, if it's set, timestamped as rx says.
+//
+// Each is written with an IP header made up for it, from src to the
+// unspecified address: the receivers don't keep the one it came with,
+// and the file needs one to say what's in the UDP header. The rest is
+// as read, so any checksums are left unverified.
+//
+// Should the file fail to open or take a write, it's logged and no
+// more is written.
+func (c *Conn) writeRawDiscoPcap(b []byte, src net.Addr, family string, rx rawDiscoRx) {
+	path := debugRawDiscoPcap()
+	if path == "" {
+		return
+	}
+	p := &c.rawDiscoPcap
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.failed {
+		return
+	}
+	if err := p.writeLocked(path, pcapRecord(b, src, family, rx)); err != nil {
+		c.logf("disco raw: no longer writing %s: %v", path, err)
+		p.failed = true
+		p.closeLocked()
+	}
+}
+
+func (p *rawDiscoPcap) writeLocked(path string, rec []byte) error {
+	maxSize := p.maxSize
+	if maxSize == 0 {
+		maxSize = rawDiscoPcapMaxSize
+	}
+	if p.f != nil && p.size+int64(len(rec)) > maxSize {
+		p.closeLocked()
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	if p.f == nil {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		p.f = f
+		p.size = 0
+		var hdr [pcapHeaderLen]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNanos)
+		binary.LittleEndian.PutUint16(hdr[4:6], 2) // major version
+		binary.LittleEndian.PutUint16(hdr[6:8], 4) // minor version
+		binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+		if err := p.appendLocked(hdr[:]); err != nil {
+			return err
+		}
+	}
+	return p.appendLocked(rec)
+}
+
+func (p *rawDiscoPcap) appendLocked(b []byte) error {
+	n, err := p.f.Write(b)
+	p.size += int64(n)
+	return err
+}
+
+// close closes the file, for good. It's called by Conn.Close once the
+// receivers have stopped.
+func (p *rawDiscoPcap) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.closeLocked()
+}
+
+func (p *rawDiscoPcap) closeLocked() {
+	if p.f != nil {
+		p.f.Close()
+		p.f = nil
+	}
+}
+
+// pcapRecord returns the pcap record for writeRawDiscoPcap's packet.
+func pcapRecord(b []byte, src net.Addr, family string, rx rawDiscoRx) []byte {
+	var srcIP netip.Addr
+	if ipAddr, ok := src.(*net.IPAddr); ok {
+		srcIP, _ = netip.AddrFromSlice(ipAddr.IP)
+		srcIP = srcIP.Unmap()
+	}
+	var h packet.Header
+	if family == "ip6" {
+		if !srcIP.Is6() {
+			srcIP = netip.IPv6Unspecified()
+		}
+		h = packet.IP6Header{IPProto: ipproto.UDP, Src: srcIP, Dst: netip.IPv6Unspecified()}
+	} else {
+		if !srcIP.Is4() {
+			srcIP = netip.IPv4Unspecified()
+		}
+		h = packet.IP4Header{IPProto: ipproto.UDP, Src: srcIP, Dst: netip.IPv4Unspecified()}
+	}
+	pktLen := h.Len() + len(b)
+	capLen := pktLen
+	if capLen > pcapSnapLen {
+		capLen = pcapSnapLen
+	}
+	rec := make([]byte, pcapRecordLen+pktLen)
+	// This only fails for packets too long for IP, for which the
+	// header is left zeroed.
+	h.Marshal(rec[pcapRecordLen:])
+	copy(rec[pcapRecordLen+h.Len():], b)
+	rec = rec[:pcapRecordLen+capLen]
+
+	at := rx.at.WallTime()
+	if at.IsZero() {
+		at = time.Now()
+	}
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(at.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(capLen))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(pktLen))
+	return rec
+}